@@ -0,0 +1,203 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"newgateway/config"
+	"newgateway/topic"
+	"strings"
+)
+
+//操作类型
+type Access int
+
+const (
+	AccessPublish   Access = 1
+	AccessSubscribe Access = 2
+	AccessAll              = AccessPublish | AccessSubscribe
+)
+
+const (
+	PermissionAllow = "allow"
+	PermissionDeny  = "deny"
+)
+
+//主题中可替换的占位符
+const (
+	placeholderUserName = "%u"
+	placeholderClientId = "%c"
+)
+
+var acl *ACL
+
+func init() {
+	a, err := NewACL(config.GetConfig().ACL.Default, config.GetConfig().ACL.Rules)
+	if err != nil {
+		panic(err)
+	}
+	acl = a
+}
+
+//获取按配置文件初始化的ACL
+func GetACL() *ACL {
+	return acl
+}
+
+//一条解析后的规则
+type Rule struct {
+	Allow    bool
+	UserName string
+	ClientId string
+	//为nil时匹配所有地址
+	IPNet  *net.IPNet
+	Access Access
+	Topics []string
+}
+
+//主题级别的访问控制, 规则按顺序匹配, 第一条命中的规则生效
+type ACL struct {
+	rules []*Rule
+	//没有规则命中时是否允许
+	allowByDefault bool
+}
+
+func NewACL(defaultPermission string, rules []config.ACLRule) (*ACL, error) {
+	a := &ACL{
+		allowByDefault: defaultPermission != PermissionDeny,
+	}
+	for i, v := range rules {
+		rule := &Rule{
+			UserName: v.UserName,
+			ClientId: v.ClientId,
+			Topics:   v.Topics,
+		}
+		switch v.Permission {
+		case PermissionAllow:
+			rule.Allow = true
+		case PermissionDeny:
+		default:
+			return nil, fmt.Errorf("acl rule %d: invalid permission %q", i, v.Permission)
+		}
+		switch v.Access {
+		case "pub":
+			rule.Access = AccessPublish
+		case "sub":
+			rule.Access = AccessSubscribe
+		case "", "pubsub":
+			rule.Access = AccessAll
+		default:
+			return nil, fmt.Errorf("acl rule %d: invalid access %q", i, v.Access)
+		}
+		if v.IP != "" {
+			ipNet, err := parseIPNet(v.IP)
+			if err != nil {
+				return nil, fmt.Errorf("acl rule %d: %v", i, err)
+			}
+			rule.IPNet = ipNet
+		}
+		for _, t := range v.Topics {
+			if err := topic.ValidateFilter(t); err != nil {
+				return nil, fmt.Errorf("acl rule %d: topic %q: %v", i, t, err)
+			}
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+//解析单个ip或CIDR
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+//判断客户端是否可以发布到主题名或订阅主题过滤器
+func (a *ACL) Authorize(clientId, userName string, addr net.Addr, access Access, name string) bool {
+	ip := addrIP(addr)
+	for _, rule := range a.rules {
+		if rule.Access&access == 0 || !rule.matchClient(clientId, userName, ip) {
+			continue
+		}
+		for _, t := range rule.Topics {
+			filter, ok := substitute(t, clientId, userName)
+			if !ok {
+				continue
+			}
+			if rule.matchTopic(filter, access, name) {
+				return rule.Allow
+			}
+		}
+	}
+	return a.allowByDefault
+}
+
+func (r *Rule) matchClient(clientId, userName string, ip net.IP) bool {
+	if r.UserName != "" && r.UserName != userName {
+		return false
+	}
+	if r.ClientId != "" && r.ClientId != clientId {
+		return false
+	}
+	if r.IPNet != nil && (ip == nil || !r.IPNet.Contains(ip)) {
+		return false
+	}
+	return true
+}
+
+//发布时主题名与规则匹配即命中
+//订阅时allow规则需完全覆盖订阅的过滤器, deny规则只要可能有交集即命中
+func (r *Rule) matchTopic(filter string, access Access, name string) bool {
+	if access == AccessPublish {
+		return topic.Match(filter, name)
+	}
+	if r.Allow {
+		return topic.Covers(filter, name)
+	}
+	return topic.Intersects(filter, name)
+}
+
+//替换规则主题中的%u和%c, 对应的值为空或包含通配符、层级分隔符时该主题不生效
+func substitute(t, clientId, userName string) (string, bool) {
+	if strings.Contains(t, placeholderUserName) {
+		if !validPlaceholderValue(userName) {
+			return "", false
+		}
+		t = strings.Replace(t, placeholderUserName, userName, -1)
+	}
+	if strings.Contains(t, placeholderClientId) {
+		if !validPlaceholderValue(clientId) {
+			return "", false
+		}
+		t = strings.Replace(t, placeholderClientId, clientId, -1)
+	}
+	return t, true
+}
+
+func validPlaceholderValue(v string) bool {
+	return v != "" && !strings.ContainsAny(v, topic.Separator+topic.SingleLevelWildcard+topic.MultiLevelWildcard)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,50 @@
+package acl
+
+import (
+	"net"
+	"newgateway/config"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	a, err := NewACL(PermissionDeny, []config.ACLRule{
+		{Permission: PermissionDeny, IP: "10.0.0.0/8", Topics: []string{"#"}},
+		{Permission: PermissionAllow, Access: "pubsub", Topics: []string{"devices/%c/#"}},
+		{Permission: PermissionAllow, UserName: "dashboard", Access: "sub", Topics: []string{"devices/+/status"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &net.TCPAddr{IP: net.ParseIP("192.168.0.10"), Port: 1883}
+	internal := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1883}
+	cases := []struct {
+		clientId, userName string
+		addr               net.Addr
+		access             Access
+		name               string
+		allowed            bool
+	}{
+		{"c1", "", local, AccessPublish, "devices/c1/temp", true},
+		{"c1", "", local, AccessPublish, "devices/c2/temp", false},
+		{"c1", "", local, AccessSubscribe, "devices/c1/+", true},
+		{"c1", "", local, AccessSubscribe, "devices/#", false},
+		{"c1", "", internal, AccessPublish, "devices/c1/temp", false},
+		{"d1", "dashboard", local, AccessSubscribe, "devices/+/status", true},
+		{"d1", "dashboard", local, AccessPublish, "devices/c1/status", false},
+		{"#", "", local, AccessSubscribe, "devices/#", false},
+	}
+	for _, c := range cases {
+		if allowed := a.Authorize(c.clientId, c.userName, c.addr, c.access, c.name); allowed != c.allowed {
+			t.Errorf("%+v expected %v", c, c.allowed)
+		}
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := NewACL(PermissionAllow, []config.ACLRule{{Permission: "maybe"}}); err == nil {
+		t.Error("expected invalid permission error")
+	}
+	if _, err := NewACL(PermissionAllow, []config.ACLRule{{Permission: PermissionAllow, IP: "x"}}); err == nil {
+		t.Error("expected invalid ip error")
+	}
+}
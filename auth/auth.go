@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"net"
+	"newgateway/config"
+	"newgateway/constant"
+	"time"
+)
+
+const (
+	//不做认证
+	TypeNone = "none"
+	//使用本地用户文件认证
+	TypeFile = "file"
+	//调用http接口认证
+	TypeHttp = "http"
+)
+
+//connect认证, 返回connack的返回码
+//error表示认证过程本身出错, 此时返回码通常为MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE
+type Authenticator interface {
+	Authenticate(clientId, userName, password string, addr net.Addr) (int, error)
+}
+
+//mqtt5扩展认证中一轮AUTH交换的结果
+type AuthResult struct {
+	//connect返回码, Continue为true时忽略
+	Code int
+	//为true时把Data通过AUTH发送给客户端, 等待客户端的下一个AUTH
+	Continue bool
+	//发送给客户端的认证数据
+	Data string
+	//多轮交换之间由认证器保存的状态, 下一轮原样传回
+	State string
+}
+
+//mqtt5扩展认证, 认证器可选实现, 没有实现时带Authentication Method的连接被拒绝
+//data为客户端发送的认证数据, state在第一轮为空; 不支持的认证方法返回MQTT_REASON_BAD_AUTHENTICATION_METHOD
+//error表示认证过程本身出错
+type EnhancedAuthenticator interface {
+	AuthenticateMethod(method, clientId, userName, data, state string, addr net.Addr) (*AuthResult, error)
+}
+
+var authenticator Authenticator
+
+func init() {
+	a, err := NewAuthenticator()
+	if err != nil {
+		panic(err)
+	}
+	authenticator = a
+}
+
+//获取按配置文件初始化的认证器
+func GetAuthenticator() Authenticator {
+	return authenticator
+}
+
+//替换认证器, 用于使用配置之外的认证方式
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+//根据配置创建认证器
+func NewAuthenticator() (Authenticator, error) {
+	cfg := config.GetConfig().Auth
+	switch cfg.Type {
+	case TypeFile:
+		return NewFileAuthenticator(cfg.File)
+	case TypeHttp:
+		return NewHttpAuthenticator(cfg.Url, time.Duration(cfg.Timeout)*time.Second), nil
+	default:
+		return &AllowAll{}, nil
+	}
+}
+
+//接受所有连接
+type AllowAll struct{}
+
+func (a *AllowAll) Authenticate(clientId, userName, password string, addr net.Addr) (int, error) {
+	return constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED, nil
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"newgateway/constant"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# users\ndevice:" + string(hash) + "\n")
+	f.Close()
+
+	a, err := NewFileAuthenticator(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user, pass string
+		code       int
+	}{
+		{"device", "secret", constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED},
+		{"device", "wrong", constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD},
+		{"nobody", "secret", constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD},
+	}
+	for _, c := range cases {
+		if code, _ := a.Authenticate("c1", c.user, c.pass, nil); code != c.code {
+			t.Errorf("%s/%s expected %d, got %d", c.user, c.pass, c.code, code)
+		}
+	}
+}
+
+func TestHttpAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &httpAuthRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		switch req.UserName {
+		case "device":
+			w.WriteHeader(http.StatusOK)
+		case "banned":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	a := NewHttpAuthenticator(server.URL, time.Second)
+	cases := map[string]int{
+		"device": constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED,
+		"banned": constant.MQTT_CONNECT_RETURN_CODE_REFUSED_NOT_AUTHORIZED,
+		"other":  constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD,
+	}
+	for user, expected := range cases {
+		if code, err := a.Authenticate("c1", user, "p", nil); code != expected || err != nil {
+			t.Errorf("%s expected %d, got %d %v", user, expected, code, err)
+		}
+	}
+
+	server.Close()
+	if code, err := a.Authenticate("c1", "device", "p", nil); code != constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE || err == nil {
+		t.Errorf("expected server unavailable, got %d %v", code, err)
+	}
+}
+
+func TestHttpEnhancedAuthenticator(t *testing.T) {
+	//第一轮返回挑战数据, 第二轮校验客户端的回复
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &httpAuthRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		switch {
+		case req.Method != "challenge":
+			w.WriteHeader(http.StatusBadRequest)
+		case req.State == "":
+			json.NewEncoder(w).Encode(&httpAuthResponse{Continue: true, Data: []byte("nonce"), State: "sent"})
+		case req.State == "sent" && string(req.Data) == "nonce-signed":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	a := NewHttpAuthenticator(server.URL, time.Second)
+	r, err := a.AuthenticateMethod("challenge", "c1", "device", "", "", nil)
+	if err != nil || !r.Continue || r.Data != "nonce" || r.State != "sent" {
+		t.Fatalf("expected challenge, got %+v %v", r, err)
+	}
+	r, err = a.AuthenticateMethod("challenge", "c1", "device", "nonce-signed", r.State, nil)
+	if err != nil || r.Continue || r.Code != constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED {
+		t.Fatalf("expected accepted, got %+v %v", r, err)
+	}
+	r, _ = a.AuthenticateMethod("challenge", "c1", "device", "forged", "sent", nil)
+	if r.Continue || r.Code != constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD {
+		t.Errorf("expected bad credentials, got %+v", r)
+	}
+	r, _ = a.AuthenticateMethod("unknown", "c1", "device", "", "", nil)
+	if r.Code != constant.MQTT_REASON_BAD_AUTHENTICATION_METHOD {
+		t.Errorf("expected bad authentication method, got %+v", r)
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"newgateway/constant"
+	"os"
+	"strings"
+)
+
+//使用本地用户文件认证
+//文件每行一个用户, 格式为 用户名:bcrypt哈希, 以#开头的行为注释
+type FileAuthenticator struct {
+	users map[string][]byte
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &FileAuthenticator{
+		users: make(map[string][]byte),
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid user entry", path, line)
+		}
+		a.users[text[:i]] = []byte(text[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) Authenticate(clientId, userName, password string, addr net.Addr) (int, error) {
+	hash, ok := a.users[userName]
+	if !ok || userName == "" {
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD, nil
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD, nil
+	}
+	return constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED, nil
+}
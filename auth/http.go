@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"newgateway/constant"
+	"time"
+)
+
+//调用http接口认证时提交的内容, mqtt5扩展认证时还有认证方法、认证数据和上一轮的状态
+type httpAuthRequest struct {
+	ClientId string `json:"clientid"`
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	Addr     string `json:"addr"`
+	Method   string `json:"method,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	State    string `json:"state,omitempty"`
+}
+
+//mqtt5扩展认证时接口返回200的内容, continue为true时把data发送给客户端继续认证
+type httpAuthResponse struct {
+	Continue bool   `json:"continue"`
+	Data     []byte `json:"data"`
+	State    string `json:"state"`
+}
+
+//调用外部http接口认证
+//接口返回200表示通过, 401表示用户名或密码错误, 403表示未授权, 其它情况视为服务不可用
+//扩展认证时认证数据按base64编码, 返回400表示不支持该认证方法
+type HttpAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func NewHttpAuthenticator(url string, timeout time.Duration) *HttpAuthenticator {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &HttpAuthenticator{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (a *HttpAuthenticator) Authenticate(clientId, userName, password string, addr net.Addr) (int, error) {
+	resp, err := a.post(&httpAuthRequest{
+		ClientId: clientId,
+		UserName: userName,
+		Password: password,
+	}, addr)
+	if err != nil {
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE, err
+	}
+	defer resp.Body.Close()
+	return returnCode(resp)
+}
+
+func (a *HttpAuthenticator) AuthenticateMethod(method, clientId, userName, data, state string, addr net.Addr) (*AuthResult, error) {
+	resp, err := a.post(&httpAuthRequest{
+		ClientId: clientId,
+		UserName: userName,
+		Method:   method,
+		Data:     []byte(data),
+		State:    state,
+	}, addr)
+	if err != nil {
+		return &AuthResult{Code: constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return &AuthResult{Code: constant.MQTT_REASON_BAD_AUTHENTICATION_METHOD}, nil
+	}
+	code, err := returnCode(resp)
+	if code != constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED {
+		return &AuthResult{Code: code}, err
+	}
+	//没有返回内容时直接通过
+	var r httpAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil && err != io.EOF {
+		return &AuthResult{Code: constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE}, err
+	}
+	return &AuthResult{
+		Code:     code,
+		Continue: r.Continue,
+		Data:     string(r.Data),
+		State:    r.State,
+	}, nil
+}
+
+//提交认证请求
+func (a *HttpAuthenticator) post(req *httpAuthRequest, addr net.Addr) (*http.Response, error) {
+	if addr != nil {
+		req.Addr = addr.String()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return a.client.Post(a.url, "application/json", bytes.NewReader(body))
+}
+
+//接口返回的状态码对应的connect返回码
+func returnCode(resp *http.Response) (int, error) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED, nil
+	case http.StatusUnauthorized:
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD, nil
+	case http.StatusForbidden:
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_NOT_AUTHORIZED, nil
+	default:
+		return constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE, fmt.Errorf("auth server returned %s", resp.Status)
+	}
+}
@@ -8,29 +8,98 @@ import (
 	_ "net/http/pprof"
 	"newgateway/config"
 	"newgateway/handler"
+	"newgateway/kafka"
 	"newgateway/logger"
+	"newgateway/mqtt"
+	"newgateway/retain"
+	"newgateway/server"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
+//handler名称
+const (
+	HandlerMDMP = "mdmp"
+	HandlerEcho = "echo"
+)
+
 func main() {
-	//handler := handler.NewEchoHandler()
-	handler := &handler.MDMPHandler{}
-	go func() {
-		http.ListenAndServe("0.0.0.0:9090", nil)
-	}()
-	ListenAndServe(":"+config.GetConfig().Server.Port, handler)
+	if addr := config.GetConfig().Server.PprofAddress; addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				logger.Error(fmt.Sprintf("pprof server err: %v", err))
+			}
+		}()
+	}
+	listeners := config.GetConfig().Listeners
+	if len(listeners) == 0 {
+		//兼容只配置了server.port的情况
+		listeners = []config.Listener{{
+			Protocol: config.GetConfig().Server.Network,
+			Address:  ":" + config.GetConfig().Server.Port,
+		}}
+	}
+	ListenAndServe(listeners)
+}
+
+//一个正在运行的监听
+type runningListener struct {
+	cfg      config.Listener
+	listener net.Listener
+	handler  handler.Handler
 }
-func ListenAndServe(address string, handler handler.Handler) {
+
+//启动所有监听, 收到中断信号后一起关闭
+func ListenAndServe(cfgs []config.Listener) {
+	//同类型的监听共用一个handler
+	handlers := make(map[string]handler.Handler)
+	var running []*runningListener
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			for _, r := range running {
+				r.listener.Close()
+			}
+			for name, h := range handlers {
+				logger.Info("closing handler ", name)
+				h.Close()
+			}
+			//发送qos0消息异步发布队列中剩余的消息
+			kafka.ClosePipeline()
+			if err := retain.GetStore().Close(); err != nil {
+				logger.Error("close retain store err: ", err)
+			}
+			//所有客户端关闭后会话已保存, 关闭会话存储
+			if err := mqtt.GetSessionManager().Close(); err != nil {
+				logger.Error("close session store err: ", err)
+			}
+		})
+	}
+
 	// 绑定监听地址
-	listener, err := net.Listen(config.GetConfig().Server.Network, address)
-	if err != nil {
-		logger.Error(fmt.Sprintf("listen err: %v", err))
+	for _, cfg := range cfgs {
+		h, err := getHandler(handlers, cfg.Handler)
+		if err != nil {
+			logger.Error(fmt.Sprintf("listener %s err: %v", cfg.Address, err))
+			closeAll()
+			return
+		}
+		listener, err := server.Listen(cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("listen %s err: %v", cfg.Address, err))
+			closeAll()
+			return
+		}
+		running = append(running, &runningListener{
+			cfg:      cfg,
+			listener: listener,
+			handler:  h,
+		})
 	}
 
 	// 监听中断信号
-	var closing bool
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
@@ -39,24 +108,54 @@ func ListenAndServe(address string, handler handler.Handler) {
 		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
 			// 收到中断信号后开始关闭流程
 			logger.Info("shuting down...")
-			// 设置标志位为关闭中, 使用原子操作保证线程可见性
-			closing = true
-
-			//关闭handler
-			handler.Close()
-
-			// listener 关闭后 listener.Accept() 会立即返回错误
-			listener.Close()
+			// listener 关闭后 listener.Accept() 会立即返回错误, 随后关闭handler
+			closeAll()
 		}
 	}()
 
-	defer listener.Close()
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", address))
+	wg := sync.WaitGroup{}
+	for _, r := range running {
+		wg.Add(1)
+		go func(r *runningListener) {
+			defer wg.Done()
+			defer r.listener.Close()
+			r.serve()
+		}(r)
+	}
+	wg.Wait()
+	//等待关闭流程完成
+	closeAll()
+	logger.Info("all listeners stopped")
+}
+
+//根据名称获取handler, 为空时使用mdmp
+func getHandler(handlers map[string]handler.Handler, name string) (handler.Handler, error) {
+	if name == "" {
+		name = HandlerMDMP
+	}
+	if h, ok := handlers[name]; ok {
+		return h, nil
+	}
+	var h handler.Handler
+	switch name {
+	case HandlerMDMP:
+		h = &handler.MDMPHandler{}
+	case HandlerEcho:
+		h = handler.NewEchoHandler()
+	default:
+		return nil, fmt.Errorf("unknown handler %q", name)
+	}
+	handlers[name] = h
+	return h, nil
+}
+
+func (r *runningListener) serve() {
+	logger.Info(fmt.Sprintf("bind: %s, protocol: %s, handler: %s, max connections: %d, start listening...", r.cfg.Address, r.cfg.Protocol, r.cfg.Handler, r.cfg.MaxConnections))
 
-	ctx, _ := context.WithCancel(context.Background())
+	ctx := server.WithListener(context.Background(), r.cfg)
 	for {
 		// Accept 会一直阻塞直到有新的连接建立或者listen中断才会返回
-		conn, err := listener.Accept()
+		conn, err := r.listener.Accept()
 		if err != nil {
 			// 通常是由于listener被关闭无法继续监听导致的错误
 			logger.Error(fmt.Sprintf("accept err: %v", err))
@@ -64,7 +163,6 @@ func ListenAndServe(address string, handler handler.Handler) {
 		}
 		// 开启新的 goroutine 处理该连接
 		logger.Info("accept link")
-		go handler.Handle(ctx, conn)
-		//handler.Handle(ctx, conn)
+		go r.handler.Handle(ctx, conn)
 	}
 }
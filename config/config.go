@@ -11,13 +11,107 @@ type Config struct {
 		Port           string `yaml:"port"`
 		Network        string `yaml:"network"`
 		TickerInterval int    `yaml:"ticker-interval"`
+		//重发PUBREC的最大时间间隔, 单位秒, 0表示不限制
+		MaxTickerInterval int `yaml:"max-ticker-interval"`
 		BufferSize     int    `yaml:"buffer-size"`
+		MaxPacketSize  int    `yaml:"max-packet-size"`
+		//每个客户端同时等待确认的qos1/qos2消息数量上限, 0或超过65535时为65535
+		InflightWindow int `yaml:"inflight-window"`
+		//qos1/qos2消息超过该时间未确认时重发, 单位秒, 0表示只在重连时重发
+		RetryInterval int `yaml:"retry-interval"`
+		//mqtt5客户端可以使用的主题别名最大值, 0表示不接受主题别名
+		TopicAliasMaximum int `yaml:"topic-alias-maximum"`
+		//mqtt5客户端可以同时发送的未完成qos2消息数量, 在CONNACK中告知客户端, 0表示65535
+		ReceiveMaximum int `yaml:"receive-maximum"`
+		//pprof和运行指标的http地址, 为空时不启动
+		PprofAddress string `yaml:"pprof-address"`
 	}
+	Session struct {
+		//CleanSession=0的会话在断开连接后保留的时间, 单位秒, 0表示不过期
+		ExpiryInterval int `yaml:"expiry-interval"`
+		//会话存储方式: memory, bolt
+		Store string `yaml:"store"`
+		//bolt存储的文件路径
+		Path string `yaml:"path"`
+		//合并保存未确认消息等修改的等待时间, 单位毫秒, 0时为100, 进程崩溃时最多丢失这段时间内的修改
+		SaveInterval int `yaml:"save-interval"`
+	}
+	//监听列表, 为空时使用server中的network和port
+	Listeners []Listener `yaml:"listeners"`
 	Kafka struct {
 		ServerList             []string `yaml:"server-list"`
+		Version                string   `yaml:"version"`
 		ConsumerPoolSize       int      `yaml:"consumer-pool-size"`
 		ProducerTickerInterval int      `yaml:"producer-ticker-interval"`
+		//刷新kafka元数据的间隔, 单位毫秒, 发现新增或删除的topic和分区, 0表示不刷新
+		MetadataRefreshInterval int `yaml:"metadata-refresh-interval"`
+		ConsumerGroup           struct {
+			//持久会话的消费组名称, {client-id}替换为客户端id, 为空时不提交消费位置
+			Client string `yaml:"client"`
+			//共享订阅的消费组名称, {group}替换为共享订阅的组名
+			Shared string `yaml:"shared"`
+			//没有已提交的消费位置时开始消费的位置: earliest, latest, 或RFC3339格式的时间
+			InitialOffset string `yaml:"initial-offset"`
+			//提交消费位置的间隔, 单位毫秒, 0时为1000
+			CommitInterval int `yaml:"commit-interval"`
+		} `yaml:"consumer-group"`
+		Producer struct {
+			//等待确认的副本: none, leader, all, 为空时为all
+			Acks string `yaml:"acks"`
+			//压缩方式: none, gzip, snappy, lz4, zstd, zstd需要kafka 2.1.0及以上版本
+			Compression string `yaml:"compression"`
+			//幂等生产, 避免重试产生重复消息, 需要acks为all
+			Idempotent bool `yaml:"idempotent"`
+			//单条消息的最大字节数, 0时为1000000
+			MaxMessageBytes int `yaml:"max-message-bytes"`
+			//批量发送前等待的时间, 单位毫秒, 0表示尽快发送
+			Linger int `yaml:"linger"`
+			//累积到该数量的消息时立即发送, 0表示不限制
+			FlushMessages int `yaml:"flush-messages"`
+			//发送失败的重试次数, 0时为3
+			Retries int `yaml:"retries"`
+			//分区方式: hash(按消息key), round-robin, random, manual(映射规则中的partition), 为空时为hash
+			Partitioner string `yaml:"partitioner"`
+			//映射规则没有指定key时消息key的来源: client-id, topic, none, 为空时为client-id
+			DefaultKey string `yaml:"default-key"`
+			//qos0消息异步发布, 等待发送和等待确认的消息总数上限, 0时为10000
+			QueueSize int `yaml:"queue-size"`
+			//一个topic累积到该数量的消息时立即发送, 0时为100
+			BatchSize int `yaml:"batch-size"`
+			//未满的批次最长等待的时间, 单位毫秒, 0时使用producer-ticker-interval
+			BatchInterval int `yaml:"batch-interval"`
+			//队列已满时: block(阻塞读取该连接), drop-oldest, drop-newest, 为空时为block
+			Overflow string `yaml:"overflow"`
+		} `yaml:"producer"`
+		//非持久会话的订阅共享每个kafka topic的消费, 按主题过滤器转发给订阅者
+		Router struct {
+			//每个订阅等待发送给客户端的消息数量, 0时为1000
+			QueueSize int `yaml:"queue-size"`
+			//队列已满时qos1/qos2消息等待的时间, 超时后断开发送较慢的客户端, 单位毫秒, 0时为5000
+			BlockTimeout int `yaml:"block-timeout"`
+		} `yaml:"router"`
+	}
+	Auth struct {
+		//认证方式: none, file, http
+		Type string `yaml:"type"`
+		//用户文件路径, 每行为 用户名:bcrypt哈希
+		File string `yaml:"file"`
+		//认证接口地址
+		Url string `yaml:"url"`
+		//认证接口超时时间, 单位秒
+		Timeout int `yaml:"timeout"`
 	}
+	ACL struct {
+		//没有规则命中时的策略: allow, deny
+		Default string    `yaml:"default"`
+		Rules   []ACLRule `yaml:"rules"`
+	} `yaml:"acl"`
+	Retain struct {
+		//保存保留消息的compacted kafka topic, 为空时只保存在内存中
+		KafkaTopic string `yaml:"kafka-topic"`
+	}
+	//mqtt主题与kafka topic的映射规则, 按顺序匹配
+	TopicMapping []TopicMapping `yaml:"topic-mapping"`
 	Log struct {
 		File struct {
 			Path       string `yaml:"path"`
@@ -28,6 +122,64 @@ type Config struct {
 	}
 }
 
+//一个监听地址
+type Listener struct {
+	//协议: tcp, tls, ws, wss, unix
+	Protocol string `yaml:"protocol"`
+	//绑定地址, unix协议时为socket文件路径
+	Address string `yaml:"address"`
+	//最大连接数, 0表示不限制
+	MaxConnections int `yaml:"max-connections"`
+	//处理连接的handler: mdmp, echo
+	Handler string `yaml:"handler"`
+	//tls和wss协议的证书配置
+	TLS *TLS `yaml:"tls"`
+	//ws和wss协议的配置
+	WebSocket *WebSocket `yaml:"websocket"`
+}
+
+type WebSocket struct {
+	//接受websocket连接的路径, 默认为/mqtt
+	Path string `yaml:"path"`
+}
+
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	//校验客户端证书的CA
+	CA string `yaml:"ca"`
+	//客户端证书校验方式: none, request, require, verify-if-given, require-and-verify
+	ClientAuth string `yaml:"client-auth"`
+	//使用客户端证书作为mqtt用户名: cn, san, 为空时使用connect中的用户名
+	CertUserName string `yaml:"cert-username"`
+}
+
+//一条主题映射规则
+type TopicMapping struct {
+	//mqtt主题过滤器, 支持+和#
+	MQTT string `yaml:"mqtt"`
+	//写入的kafka topic
+	Kafka string `yaml:"kafka"`
+	//消息key的来源: client-id, topic, level:N(主题的第N层, 从0开始), 为空时使用kafka.producer.default-key
+	Key string `yaml:"key"`
+	//写入的分区, 只在kafka.producer.partitioner为manual时使用
+	Partition int32 `yaml:"partition"`
+}
+
+//一条访问控制规则, 用户名、客户端id和ip为空时匹配所有客户端
+type ACLRule struct {
+	//allow, deny
+	Permission string `yaml:"permission"`
+	UserName   string `yaml:"username"`
+	ClientId   string `yaml:"client-id"`
+	//单个ip或CIDR
+	IP string `yaml:"ip"`
+	//pub, sub, pubsub, 为空时等同pubsub
+	Access string `yaml:"access"`
+	//主题过滤器, 支持%u(用户名)和%c(客户端id)替换
+	Topics []string `yaml:"topics"`
+}
+
 var config *Config
 
 var configPath string
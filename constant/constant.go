@@ -17,6 +17,15 @@ const (
 	MQTT_MSG_TYPE_PINGRESP    = 13
 	MQTT_MSG_TYPE_DISCONNECT  = 14
 	MQTT_MSG_TYPE_RESERED_END = 15
+	//mqtt5中类型15为AUTH
+	MQTT_MSG_TYPE_AUTH = 15
+)
+
+//CONNECT中的协议级别
+const (
+	MQTT_PROTOCOL_LEVEL_31  = 3
+	MQTT_PROTOCOL_LEVEL_311 = 4
+	MQTT_PROTOCOL_LEVEL_5   = 5
 )
 
 const(
@@ -27,3 +36,73 @@ const(
 	MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD = 4
 	MQTT_CONNECT_RETURN_CODE_REFUSED_NOT_AUTHORIZED = 5
 )
+
+
+//suback返回码, 0~2表示授予的Qos
+const (
+	MQTT_SUBACK_RETURN_CODE_FAILURE = 0x80
+)
+
+
+//mqtt5原因码
+const (
+	MQTT_REASON_SUCCESS                            = 0x00
+	MQTT_REASON_DISCONNECT_WITH_WILL               = 0x04
+	MQTT_REASON_NO_MATCHING_SUBSCRIBERS            = 0x10
+	MQTT_REASON_NO_SUBSCRIPTION_EXISTED            = 0x11
+	MQTT_REASON_CONTINUE_AUTHENTICATION            = 0x18
+	MQTT_REASON_REAUTHENTICATE                     = 0x19
+	MQTT_REASON_UNSPECIFIED_ERROR                  = 0x80
+	MQTT_REASON_MALFORMED_PACKET                   = 0x81
+	MQTT_REASON_PROTOCOL_ERROR                     = 0x82
+	MQTT_REASON_IMPLEMENTATION_SPECIFIC            = 0x83
+	MQTT_REASON_UNSUPPORTED_PROTOCOL_VERSION       = 0x84
+	MQTT_REASON_CLIENT_IDENTIFIER_NOT_VALID        = 0x85
+	MQTT_REASON_BAD_USERNAME_OR_PASSWORD           = 0x86
+	MQTT_REASON_NOT_AUTHORIZED                     = 0x87
+	MQTT_REASON_SERVER_UNAVAILABLE                 = 0x88
+	MQTT_REASON_SERVER_SHUTTING_DOWN               = 0x8B
+	MQTT_REASON_BAD_AUTHENTICATION_METHOD          = 0x8C
+	MQTT_REASON_KEEP_ALIVE_TIMEOUT                 = 0x8D
+	MQTT_REASON_SESSION_TAKEN_OVER                 = 0x8E
+	MQTT_REASON_TOPIC_FILTER_INVALID               = 0x8F
+	MQTT_REASON_TOPIC_NAME_INVALID                 = 0x90
+	MQTT_REASON_PACKET_IDENTIFIER_NOT_FOUND        = 0x92
+	MQTT_REASON_RECEIVE_MAXIMUM_EXCEEDED           = 0x93
+	MQTT_REASON_TOPIC_ALIAS_INVALID                = 0x94
+	MQTT_REASON_PACKET_TOO_LARGE                   = 0x95
+	MQTT_REASON_QUOTA_EXCEEDED                     = 0x97
+	MQTT_REASON_PAYLOAD_FORMAT_INVALID             = 0x99
+	MQTT_REASON_SHARED_SUBSCRIPTIONS_NOT_SUPPORTED = 0x9E
+)
+
+//mqtt5属性标识符
+const (
+	MQTT_PROP_PAYLOAD_FORMAT_INDICATOR          = 0x01
+	MQTT_PROP_MESSAGE_EXPIRY_INTERVAL           = 0x02
+	MQTT_PROP_CONTENT_TYPE                      = 0x03
+	MQTT_PROP_RESPONSE_TOPIC                    = 0x08
+	MQTT_PROP_CORRELATION_DATA                  = 0x09
+	MQTT_PROP_SUBSCRIPTION_IDENTIFIER           = 0x0B
+	MQTT_PROP_SESSION_EXPIRY_INTERVAL           = 0x11
+	MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER        = 0x12
+	MQTT_PROP_SERVER_KEEP_ALIVE                 = 0x13
+	MQTT_PROP_AUTHENTICATION_METHOD             = 0x15
+	MQTT_PROP_AUTHENTICATION_DATA               = 0x16
+	MQTT_PROP_REQUEST_PROBLEM_INFORMATION       = 0x17
+	MQTT_PROP_WILL_DELAY_INTERVAL               = 0x18
+	MQTT_PROP_REQUEST_RESPONSE_INFORMATION      = 0x19
+	MQTT_PROP_RESPONSE_INFORMATION              = 0x1A
+	MQTT_PROP_SERVER_REFERENCE                  = 0x1C
+	MQTT_PROP_REASON_STRING                     = 0x1F
+	MQTT_PROP_RECEIVE_MAXIMUM                   = 0x21
+	MQTT_PROP_TOPIC_ALIAS_MAXIMUM               = 0x22
+	MQTT_PROP_TOPIC_ALIAS                       = 0x23
+	MQTT_PROP_MAXIMUM_QOS                       = 0x24
+	MQTT_PROP_RETAIN_AVAILABLE                  = 0x25
+	MQTT_PROP_USER_PROPERTY                     = 0x26
+	MQTT_PROP_MAXIMUM_PACKET_SIZE               = 0x27
+	MQTT_PROP_WILDCARD_SUBSCRIPTION_AVAILABLE   = 0x28
+	MQTT_PROP_SUBSCRIPTION_IDENTIFIER_AVAILABLE = 0x29
+	MQTT_PROP_SHARED_SUBSCRIPTION_AVAILABLE     = 0x2A
+)
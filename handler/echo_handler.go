@@ -28,7 +28,9 @@ func (h *EchoHandler) Handle(ctx context.Context, conn net.Conn) {
 	if h.closing.Get() {
 		//关闭handler,并拒绝新的连接进入
 		conn.Close()
+		return
 	}
+	defer conn.Close()
 
 	client := &mqtt.Client{
 		Conn: conn,
@@ -41,7 +43,7 @@ func (h *EchoHandler) Handle(ctx context.Context, conn net.Conn) {
 		if err != nil {
 			if err == io.EOF {
 				logger.Info("connection close")
-				h.activeConn.Delete(conn)
+				h.activeConn.Delete(client)
 			} else {
 				logger.Warn(err)
 			}
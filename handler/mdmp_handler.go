@@ -3,14 +3,18 @@ package handler
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"net"
+	"newgateway/auth"
 	"newgateway/common"
 	"newgateway/config"
 	"newgateway/constant"
 	"newgateway/logger"
 	"newgateway/model"
 	"newgateway/mqtt"
+	"newgateway/server"
 	"strconv"
 	"sync"
 	"time"
@@ -34,7 +38,7 @@ func (h *MDMPHandler) Close() error {
 	// 尝试关闭所有的客户端
 	h.activeConn.Range(func(key interface{}, val interface{}) bool {
 		cli := key.(*mqtt.Client)
-		cli.Close()
+		cli.Disconnect(constant.MQTT_REASON_SERVER_SHUTTING_DOWN)
 		return true
 	})
 	return nil
@@ -51,107 +55,229 @@ func (h *MDMPHandler) Handle(ctx context.Context, conn net.Conn) {
 	}
 
 	client := &mqtt.Client{
-		Conn:          conn,
-		Assure:        sync.Map{},
-		SubscribeMap:  sync.Map{},
-		Ticker:        config.GetConfig().Server.TickerInterval,
-		Closing:       make(chan bool),
-		Closed:        false,
-		AssureClosing: make(chan bool),
-		Buffer:        make([]byte, 1024*1024),
-		IsBufferEmpty: true,
-		BufferOffset:  0,
-	}
-	go client.Tick()
-
-	//读
-	reader := bufio.NewReader(conn)
-
-	var (
-		buff    = make([]byte, bufferSize*1024)
-		n       = 0
-		err     error
-		connMsg *model.MQTTMessage
-	)
-	n, err = reader.Read(buff)
-	if err != nil {
-		logger.Error(err.Error())
-		return
+		Conn:              conn,
+		SubscribeMap:      sync.Map{},
+		Ticker:            config.GetConfig().Server.TickerInterval,
+		MaxTicker:         config.GetConfig().Server.MaxTickerInterval,
+		RetryInterval:     config.GetConfig().Server.RetryInterval,
+		TopicAliasMaximum: config.GetConfig().Server.TopicAliasMaximum,
+		InboundMaximum:    config.GetConfig().Server.ReceiveMaximum,
+		Closing:           make(chan bool),
+		Closed:            false,
+		AssureClosing:     make(chan bool),
 	}
-	connMsg, err = mqtt.ParseByteArray(buff[:n])
+	//按MQTT帧格式读取数据包
+	decoder := mqtt.NewDecoder(bufio.NewReaderSize(conn, bufferSize*1024))
+	decoder.MaxPacketSize = config.GetConfig().Server.MaxPacketSize
+
+	connMsg, err := decoder.Decode()
 	if err != nil {
-		logger.Error("error parsing connection string: ", buff[:n], err)
+		logger.Error("error decoding connect packet: ", err)
+		client.Close()
 		return
 	}
-	logger.Debug("accept type: ", strconv.Itoa(connMsg.FixedHeader.PackageType), " accept message: ", string(buff[:n]))
+	logger.Debug("accept type: ", strconv.Itoa(connMsg.FixedHeader.PackageType))
 
 	//dealConnect
-	if connMsg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_CONNECT && h.dealConnect(connMsg, client) {
+	if connMsg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_CONNECT && h.dealConnect(ctx, connMsg, client, decoder) {
+		//之后的数据包按协商的协议级别解析
+		decoder.ProtocolVersion = client.ProtocolVersion
+		go client.Tick()
 		x := make(chan bool)
+		done := make(chan bool)
+		defer close(done)
+		//keepalive为0时不做超时检测
+		var (
+			timeout  *time.Timer
+			timeoutC <-chan time.Time
+		)
 		dur := time.Duration(3*connMsg.VariableHeader.KeepAliveTimer/2) * time.Second
-		timeout := time.NewTimer(dur)
-		for {
-			//监听超时, 异步读取数据
-			go func() {
-				n, err = reader.Read(buff)
-				logger.Debug("received bytes of ", n, " ", string(buff[:n]), " ", err)
-				if n > 0 {
-					client.DealByteArray(buff[:n])
-					x <- true
-					return
-				}
+		if dur > 0 {
+			timeout = time.NewTimer(dur)
+			defer timeout.Stop()
+			timeoutC = timeout.C
+		}
+		//异步读取数据包
+		go func() {
+			for {
+				msg, err := decoder.Decode()
 				if err != nil {
+					//未发送DISCONNECT时在关闭客户端时发布遗嘱
 					if err == io.EOF {
 						logger.Info("connection closed by client")
 					} else {
-						client.Will(connMsg)
 						logger.Error(err.Error())
 					}
-					client.Closing <- true
+					//格式错误的数据包, mqtt5客户端先收到带原因码的DISCONNECT
+					if reason, ok := mqtt.DisconnectReason(err); ok {
+						client.Disconnect(reason)
+					}
+					select {
+					case client.Closing <- true:
+					case <-done:
+					}
 					return
 				}
-			}()
+				client.Deal(msg)
+				select {
+				case x <- true:
+				case <-done:
+					return
+				}
+			}
+		}()
+		for {
 			select {
 			case <-x: //正常收取消息
-				timeout.Reset(dur)
+				if timeout != nil {
+					timeout.Reset(dur)
+				}
 				continue
-			case <-timeout.C: //超时
+			case <-timeoutC: //超时
 				logger.Warn("connection time out")
-				client.Will(connMsg)
-				h.activeConn.Delete(client)
-				timeout.Stop()
-				close(x)
-				client.Close()
-				return
+				client.Disconnect(constant.MQTT_REASON_KEEP_ALIVE_TIMEOUT)
 			case <-client.Closing: //客户端关闭
-				h.activeConn.Delete(client)
-				timeout.Stop()
-				close(x)
-				client.Close()
-				return
 			}
+			h.activeConn.Delete(client)
+			client.Close()
+			return
 		}
 	}
 	client.Close()
 }
 
-//创建连接
-func (h *MDMPHandler) dealConnect(msg *model.MQTTMessage, cli *mqtt.Client) bool {
-	//TODO 验证身份
+//创建连接, 认证失败时返回false, mqtt5扩展认证时从decoder读取客户端的AUTH
+func (h *MDMPHandler) dealConnect(ctx context.Context, msg *model.MQTTMessage, cli *mqtt.Client, decoder *mqtt.Decoder) bool {
+	//监听配置了cert-username时, 使用客户端证书中的名称作为用户名
+	certUserName, ok, err := server.CertUserName(ctx, cli.Conn)
+	if err != nil {
+		logger.Error("tls handshake failed: ", err)
+		return false
+	}
+	if ok {
+		msg.Payload.UserName = certUserName
+	}
+
+	//按协议级别协商编解码方式, 不支持的协议级别按mqtt3.1.1返回CONNACK
+	switch msg.VariableHeader.ProtocolVersion {
+	case constant.MQTT_PROTOCOL_LEVEL_31, constant.MQTT_PROTOCOL_LEVEL_311, constant.MQTT_PROTOCOL_LEVEL_5:
+	default:
+		logger.Warn("unsupported protocol level: ", msg.VariableHeader.ProtocolVersion)
+		cli.Write(connack(constant.MQTT_CONNECT_RETURN_CODE_REFUSED_PROTOCOL_VERSION, 0))
+		return false
+	}
+	cli.Negotiate(msg)
+	v5 := cli.ProtocolVersion == constant.MQTT_PROTOCOL_LEVEL_5
+	props := msg.VariableHeader.Properties
 
+	//mqtt3中CleanSession=0的会话断开后保留, mqtt5中由会话过期时间决定
+	clean := msg.VariableHeader.ConnectFlags.CleanSession == 1
+	persistent := !clean
+	if v5 {
+		persistent = cli.SessionExpiryInterval > 0
+	}
+	//mqtt3.1必须提供客户端id, mqtt3.1.1只在CleanSession=0时必须提供, 用于保存会话; mqtt5由服务端分配客户端id
+	var assignedId string
+	if msg.Payload.ClientId == "" {
+		if v5 {
+			assignedId = assignClientId()
+			msg.Payload.ClientId = assignedId
+		} else if persistent || cli.ProtocolVersion == constant.MQTT_PROTOCOL_LEVEL_31 {
+			logger.Warn("empty client id with protocol level ", cli.ProtocolVersion, ", clean session ", msg.VariableHeader.ConnectFlags.CleanSession)
+			cli.Write(connack(constant.MQTT_CONNECT_RETURN_CODE_REFUSED_IDENTIFIER_REJECTED, 0))
+			return false
+		}
+	}
+
+	//验证身份, mqtt5带认证方法时使用扩展认证代替用户名密码认证
+	var (
+		code     int
+		authData string
+	)
+	if v5 && props != nil && props.AuthenticationMethod != "" {
+		code, authData = cli.ConnectAuth(decoder, msg)
+	} else {
+		code, err = auth.GetAuthenticator().Authenticate(msg.Payload.ClientId, msg.Payload.UserName, msg.Payload.Password, cli.Conn.RemoteAddr())
+		if err != nil {
+			logger.Error("authenticate client["+msg.Payload.ClientId+"] failed: ", err)
+		}
+	}
+
+	if code != constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED {
+		logger.Warn("client["+msg.Payload.ClientId+"] refused, return code: ", code)
+		if v5 {
+			code = mqtt.ConnackReasonCode(code)
+		}
+		//先发送connack再关闭连接
+		cli.Write(connack(code, 0))
+		return false
+	}
+
+	cli.ClientId = msg.Payload.ClientId
+	cli.UserName = msg.Payload.UserName
+	cli.SetWill(msg)
+	//取得会话, 同一客户端id的旧连接会被断开
+	session, present := mqtt.GetSessionManager().Acquire(cli, clean, persistent)
+	cli.Session = session
 	//保存连接
 	h.activeConn.Store(cli, msg)
 
-	//产生返回值
-	res := &model.MQTTMessage{
+	sessionPresent := 0
+	if present {
+		sessionPresent = 1
+	}
+	//先发送connack, 再恢复会话中的订阅和消息
+	ack := connack(code, sessionPresent)
+	if v5 {
+		ack.VariableHeader.Properties = connackProperties(cli, assignedId)
+		ack.VariableHeader.Properties.AuthenticationData = authData
+	}
+	cli.Write(ack)
+	if present {
+		cli.Resume()
+	}
+	return true
+}
+
+//产生CONNACK消息
+func connack(code, sessionPresent int) *model.MQTTMessage {
+	return &model.MQTTMessage{
 		FixedHeader: &model.FixedHeader{
 			PackageType:     constant.MQTT_MSG_TYPE_CONNECTACK,
 			RemainingLength: 2,
 		},
 		VariableHeader: &model.VariableHeader{
-			ConnectReturnCode: constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED,
+			ConnectReturnCode: code,
+			SessionPresent:    sessionPresent,
 		},
 	}
-	go cli.Write(res)
-	return true
+}
+
+//mqtt5 CONNACK属性, 告知客户端服务端的限制
+func connackProperties(cli *mqtt.Client, assignedId string) *model.Properties {
+	props := &model.Properties{
+		AssignedClientIdentifier: assignedId,
+		//暂不支持订阅标识符
+		SharedSubscriptionAvailable:     model.Int(1),
+		SubscriptionIdentifierAvailable: model.Int(0),
+		AuthenticationMethod:            cli.AuthMethod,
+	}
+	if cli.TopicAliasMaximum > 0 {
+		props.TopicAliasMaximum = model.Int(cli.TopicAliasMaximum)
+	}
+	//没有Receive Maximum时客户端按65535处理
+	if max := cli.InboundMaximum; max > 0 && max < 65535 {
+		props.ReceiveMaximum = model.Int(max)
+	}
+	if size := config.GetConfig().Server.MaxPacketSize; size > 0 {
+		props.MaximumPacketSize = model.Int(size)
+	}
+	return props
+}
+
+//为没有提供客户端id的mqtt5客户端分配id
+func assignClientId() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
 }
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"newgateway/constant"
+	"newgateway/model"
+	"newgateway/mqtt"
+	"testing"
+)
+
+func connectMessage(level, clean int, clientId string) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_CONNECT},
+		VariableHeader: &model.VariableHeader{
+			ProtocolVersion: level,
+			ConnectFlags:    &model.ConnectFlags{CleanSession: clean},
+		},
+		Payload: &model.Payload{ClientId: clientId},
+	}
+}
+
+func TestConnectEmptyClientIdRejected(t *testing.T) {
+	cases := []struct {
+		level, clean int
+	}{
+		//mqtt3.1不允许空的客户端id
+		{constant.MQTT_PROTOCOL_LEVEL_31, 1},
+		{constant.MQTT_PROTOCOL_LEVEL_31, 0},
+		//mqtt3.1.1只在CleanSession=1时允许
+		{constant.MQTT_PROTOCOL_LEVEL_311, 0},
+	}
+	for _, c := range cases {
+		server, conn := net.Pipe()
+		cli := &mqtt.Client{Conn: server}
+		h := &MDMPHandler{}
+		result := make(chan bool, 1)
+		go func() {
+			result <- h.dealConnect(context.Background(), connectMessage(c.level, c.clean, ""), cli, nil)
+		}()
+		//服务端不解码CONNACK, 直接比较字节
+		ack := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			t.Fatal(err)
+		}
+		expected := []byte{0x20, 0x02, 0x00, byte(constant.MQTT_CONNECT_RETURN_CODE_REFUSED_IDENTIFIER_REJECTED)}
+		if !bytes.Equal(ack, expected) {
+			t.Errorf("level %d clean %d: expected connack %v, got %v", c.level, c.clean, expected, ack)
+		}
+		if <-result {
+			t.Errorf("level %d clean %d: connect should be refused", c.level, c.clean)
+		}
+		server.Close()
+		conn.Close()
+	}
+}
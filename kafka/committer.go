@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/logger"
+	"sync"
+)
+
+//不自己消费分区, 只为消费组提交已确认消息的位置
+//持久会话的消息由路由转发, 消费位置通过Committer提交
+type Committer struct {
+	//提交消费位置的消费组, 为空时不提交
+	Group    string
+	consumer *Consumer
+
+	//消费组的位置管理, 没有消费组时为nil
+	om sarama.OffsetManager
+	//topic -> 分区 -> 消费位置
+	poms     map[string]map[int32]sarama.PartitionOffsetManager
+	trackers map[string]map[int32]*offsetTracker
+	closed   bool
+	mu       sync.Mutex
+}
+
+//创建消费组的Committer, group为空时不提交消费位置
+func (c *Consumer) NewCommitter(group string) (*Committer, error) {
+	committer := &Committer{
+		Group:    group,
+		consumer: c,
+		poms:     make(map[string]map[int32]sarama.PartitionOffsetManager),
+		trackers: make(map[string]map[int32]*offsetTracker),
+	}
+	if group != "" {
+		om, err := sarama.NewOffsetManagerFromClient(group, c.client)
+		if err != nil {
+			return nil, err
+		}
+		committer.om = om
+	}
+	return committer, nil
+}
+
+//管理分区的消费位置, 返回nil表示不提交
+func (c *Committer) manage(topic string, partition int32) (sarama.PartitionOffsetManager, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.om == nil || c.closed {
+		return nil, nil
+	}
+	if pom, ok := c.poms[topic][partition]; ok {
+		return pom, nil
+	}
+	pom, err := c.om.ManagePartition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.poms[topic]; !ok {
+		c.poms[topic] = make(map[int32]sarama.PartitionOffsetManager)
+		c.trackers[topic] = make(map[int32]*offsetTracker)
+	}
+	c.poms[topic][partition] = pom
+	c.trackers[topic][partition] = newOffsetTracker()
+	return pom, nil
+}
+
+//分区开始投递的位置, stored为会话中记录的位置
+//与单独消费分区时相同: 有记录时从记录和已提交位置中较后的继续, 否则按配置开始, 返回分区中实际的位置
+func (c *Committer) StartOffset(topic string, partition int32, stored map[int32]int64) (int64, error) {
+	pom, err := c.manage(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	offset, ok := stored[partition]
+	if ok && pom != nil {
+		offset = resumeOffset(offset, pom)
+	}
+	if !ok {
+		if offset, err = c.consumer.initialOffset(topic, partition, pom); err != nil {
+			return 0, err
+		}
+	}
+	return c.consumer.Offset(topic, partition, offset)
+}
+
+func (c *Committer) tracker(topic string, partition int32) *offsetTracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trackers[topic][partition]
+}
+
+//记录消息已投递给客户端, 确认之前不会提交该消息的位置
+func (c *Committer) Deliver(message *sarama.ConsumerMessage) {
+	if _, err := c.manage(message.Topic, message.Partition); err != nil {
+		logger.Error("manage offset of topic["+message.Topic+"] failed: ", err)
+		return
+	}
+	if t := c.tracker(message.Topic, message.Partition); t != nil {
+		t.deliver(message.Offset)
+	}
+}
+
+//客户端确认了消息, 或消息不需要投递, 提交到最早的未确认消息为止
+func (c *Committer) Ack(message *sarama.ConsumerMessage) {
+	t := c.tracker(message.Topic, message.Partition)
+	if t == nil {
+		return
+	}
+	if commit, ok := t.ack(message.Offset); ok {
+		c.mu.Lock()
+		pom := c.poms[message.Topic][message.Partition]
+		c.mu.Unlock()
+		pom.MarkOffset(commit, "")
+	}
+}
+
+//提交最后确认的位置并关闭, 可以重复调用
+func (c *Committer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.om == nil {
+		return
+	}
+	for topic, poms := range c.poms {
+		for _, pom := range poms {
+			if err := pom.Close(); err != nil {
+				logger.Error("close offset manager of topic["+topic+"] failed: ", err)
+			}
+		}
+	}
+	if err := c.om.Close(); err != nil {
+		logger.Error("close offset manager of group["+c.Group+"] failed: ", err)
+	}
+}
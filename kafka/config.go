@@ -0,0 +1,109 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"newgateway/logger"
+	"time"
+)
+
+//消息头需要kafka 0.11及以上版本
+var defaultVersion = sarama.V0_11_0_0
+
+//创建带有kafka版本的sarama配置
+func newSaramaConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Version = defaultVersion
+	if interval := config.GetConfig().Kafka.ConsumerGroup.CommitInterval; interval > 0 {
+		cfg.Consumer.Offsets.CommitInterval = time.Duration(interval) * time.Millisecond
+	}
+	if v := config.GetConfig().Kafka.Version; v != "" {
+		version, err := sarama.ParseKafkaVersion(v)
+		if err != nil {
+			logger.Fatal("invalid kafka version: ", v)
+		}
+		cfg.Version = version
+	}
+	return cfg
+}
+
+//生产者的确认方式
+var producerAcks = map[string]sarama.RequiredAcks{
+	"":       sarama.WaitForAll,
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+//生产者的压缩方式
+var producerCompressions = map[string]sarama.CompressionCodec{
+	"":       sarama.CompressionNone,
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+//生产者的分区方式
+var producerPartitioners = map[string]sarama.PartitionerConstructor{
+	"":            sarama.NewHashPartitioner,
+	"hash":        sarama.NewHashPartitioner,
+	"round-robin": sarama.NewRoundRobinPartitioner,
+	"random":      sarama.NewRandomPartitioner,
+	"manual":      sarama.NewManualPartitioner,
+}
+
+//按配置创建生产者的sarama配置, 配置错误时panic
+func newProducerConfig() *sarama.Config {
+	cfg, err := producerConfig(newSaramaConfig())
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func producerConfig(cfg *sarama.Config) (*sarama.Config, error) {
+	c := config.GetConfig().Kafka.Producer
+	acks, ok := producerAcks[c.Acks]
+	if !ok {
+		return nil, fmt.Errorf("invalid producer acks %q", c.Acks)
+	}
+	cfg.Producer.RequiredAcks = acks
+	compression, ok := producerCompressions[c.Compression]
+	if !ok {
+		return nil, fmt.Errorf("invalid producer compression %q", c.Compression)
+	}
+	if compression == sarama.CompressionZSTD && !cfg.Version.IsAtLeast(sarama.V2_1_0_0) {
+		return nil, fmt.Errorf("producer compression zstd requires kafka version 2.1.0 or later, got %s", cfg.Version)
+	}
+	cfg.Producer.Compression = compression
+	partitioner, ok := producerPartitioners[c.Partitioner]
+	if !ok {
+		return nil, fmt.Errorf("invalid producer partitioner %q", c.Partitioner)
+	}
+	cfg.Producer.Partitioner = partitioner
+	if c.MaxMessageBytes > 0 {
+		cfg.Producer.MaxMessageBytes = c.MaxMessageBytes
+	}
+	cfg.Producer.Flush.Frequency = time.Duration(c.Linger) * time.Millisecond
+	cfg.Producer.Flush.Messages = c.FlushMessages
+	if c.Retries > 0 {
+		cfg.Producer.Retry.Max = c.Retries
+	}
+	if c.Idempotent {
+		if acks != sarama.WaitForAll {
+			return nil, fmt.Errorf("idempotent producer requires acks all, got %q", c.Acks)
+		}
+		//幂等生产要求同一连接上只有一个未完成的请求
+		cfg.Producer.Idempotent = true
+		cfg.Net.MaxOpenRequests = 1
+	}
+	switch c.DefaultKey {
+	case "", KeyClientId, KeyTopic, KeyNone:
+	default:
+		return nil, fmt.Errorf("invalid producer default key %q", c.DefaultKey)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"testing"
+)
+
+func TestProducerConfig(t *testing.T) {
+	producer := &config.GetConfig().Kafka.Producer
+	saved := *producer
+	defer func() { *producer = saved }()
+
+	producer.Acks = "leader"
+	producer.Compression = "snappy"
+	producer.Partitioner = "round-robin"
+	producer.Linger = 5
+	producer.FlushMessages = 100
+	producer.Retries = 5
+	producer.MaxMessageBytes = 2048
+	producer.DefaultKey = KeyTopic
+	cfg, err := producerConfig(sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Producer.RequiredAcks != sarama.WaitForLocal || cfg.Producer.Compression != sarama.CompressionSnappy ||
+		cfg.Producer.Retry.Max != 5 || cfg.Producer.MaxMessageBytes != 2048 || cfg.Producer.Flush.Messages != 100 {
+		t.Errorf("unexpected producer config %+v", cfg.Producer)
+	}
+
+	//幂等生产需要acks为all
+	producer.Idempotent = true
+	if _, err := producerConfig(sarama.NewConfig()); err == nil {
+		t.Error("expected error for idempotent producer without acks all")
+	}
+	producer.Acks = "all"
+	if cfg, err := producerConfig(sarama.NewConfig()); err != nil || !cfg.Producer.Idempotent || cfg.Net.MaxOpenRequests != 1 {
+		t.Errorf("unexpected idempotent config %v", err)
+	}
+
+	//zstd需要kafka 2.1.0
+	producer.Compression = "zstd"
+	cfg = sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	if _, err := producerConfig(cfg); err == nil {
+		t.Error("expected error for zstd with kafka 0.11")
+	}
+	cfg.Version = sarama.V2_1_0_0
+	if _, err := producerConfig(cfg); err != nil {
+		t.Error(err)
+	}
+
+	for _, invalid := range []func(){
+		func() { producer.Acks = "some" },
+		func() { producer.Compression = "brotli" },
+		func() { producer.Partitioner = "sticky" },
+		func() { producer.DefaultKey = "user" },
+	} {
+		*producer = saved
+		invalid()
+		if _, err := producerConfig(sarama.NewConfig()); err == nil {
+			t.Errorf("expected error for %+v", *producer)
+		}
+	}
+}
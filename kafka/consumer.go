@@ -4,7 +4,6 @@ import (
 	"github.com/Shopify/sarama"
 	"newgateway/config"
 	"newgateway/logger"
-	"regexp"
 	"sync"
 	"time"
 )
@@ -13,6 +12,8 @@ var consumerPool *ConsumerPool
 
 type Consumer struct {
 	consumer *sarama.Consumer
+	//用于查询offset和提交消费位置
+	client sarama.Client
 }
 
 func init() {
@@ -37,13 +38,27 @@ type ConsumerPool struct {
 }
 
 func newConsumer() *Consumer {
-	consumer, err := sarama.NewConsumer(config.GetConfig().Kafka.ServerList, nil)
+	client, err := sarama.NewClient(config.GetConfig().Kafka.ServerList, newSaramaConfig())
 	if err != nil {
 		panic(err)
 		return nil
 	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		panic(err)
+	}
 	return &Consumer{
 		consumer: &consumer,
+		client:   client,
+	}
+}
+
+//使用已创建的sarama消费和客户端, 不属于消费池
+func NewConsumerFrom(consumer sarama.Consumer, client sarama.Client) *Consumer {
+	return &Consumer{
+		consumer: &consumer,
+		client:   client,
 	}
 }
 
@@ -69,46 +84,69 @@ func (c *Consumer) Release() {
 		}
 	}
 	(*c.consumer).Close()
+	c.client.Close()
+}
+
+//kafka中所有的topic
+func (c *Consumer) Topics() ([]string, error) {
+	return (*c.consumer).Topics()
+}
+
+//topic的所有分区
+func (c *Consumer) Partitions(topic string) ([]int32, error) {
+	return (*c.consumer).Partitions(topic)
 }
 
-func (c *Consumer) NewSubscriber(topic string, consumerBufferSize int) (*Subscriber, error) {
+//将OffsetNewest和OffsetOldest转换为分区中实际的位置, 其它位置原样返回
+func (c *Consumer) Offset(topic string, partition int32, offset int64) (int64, error) {
+	if offset != sarama.OffsetNewest && offset != sarama.OffsetOldest {
+		return offset, nil
+	}
+	return c.client.GetOffset(topic, partition, offset)
+}
+
+//订阅topic, offsets中记录了各分区开始消费的位置
+//没有记录的分区从消费组已提交的位置开始, 没有消费组或已提交的位置时按initial-offset配置开始
+//group为空时不提交消费位置, 没有记录的分区从最新消息开始消费
+func (c *Consumer) NewSubscriber(topic string, offsets map[int32]int64, group string, consumerBufferSize int) (*Subscriber, error) {
 	//Partitions(topic):该方法返回了该topic的所有分区id
 	partitionList, err := (*c.consumer).Partitions(topic)
 	if err != nil {
 		return nil, err
 	}
 
-	sub := &Subscriber{
-		Topic:    topic,
-		Consumer: c,
-		PcList:   make([]sarama.PartitionConsumer, 0),
+	sub, err := c.newSubscriber(topic, group)
+	if err != nil {
+		return nil, err
 	}
 
-	for partition := range partitionList {
-		//ConsumePartition方法根据主题，分区和给定的偏移量创建创建了相应的分区消费者
-		//如果该分区消费者已经消费了该信息将会返回error
-		//sarama.OffsetNewest:表明了为最新消息
-		pc, err := (*c.consumer).ConsumePartition(topic, int32(partition), sarama.OffsetNewest)
+	for _, partition := range partitionList {
+		pc, err := c.consumePartition(sub, partition, offsets)
 		if err != nil {
+			sub.Close()
 			return nil, err
 		}
 
 		//添加到列表中
-		sub.PcList = append(sub.PcList, pc)
+		sub.add(partition, pc)
 	}
 	return sub, nil
 }
 
-func (c *Consumer) NewSubscribers(tpc string, consumerBufferSize int) ([]*Subscriber, error) {
+//订阅所有满足match的topic, offsets为topic到各分区消费位置的映射
+func (c *Consumer) NewSubscribers(match func(topic string) bool, offsets map[string]map[int32]int64, group string, consumerBufferSize int) ([]*Subscriber, error) {
 	//Partitions(topic):该方法返回了该topic的所有分区id
-	var subs []*Subscriber
+	var (
+		subs []*Subscriber
+		mu   sync.Mutex
+	)
 	topicList, err := (*c.consumer).Topics()
 	if err != nil {
 		return nil, err
 	}
 	wg := sync.WaitGroup{}
 	for _, topic := range (topicList) {
-		if match, err := regexp.Match(tpc, []byte(topic)); err == nil && match {
+		if match(topic) {
 			wg.Add(1)
 			go func(tpc string) {
 				defer wg.Done()
@@ -118,26 +156,26 @@ func (c *Consumer) NewSubscribers(tpc string, consumerBufferSize int) ([]*Subscr
 					logger.Error(err)
 					return
 				}
-				sub := &Subscriber{
-					Topic:    tpc,
-					Consumer: c,
-					PcList:   make([]sarama.PartitionConsumer, 0),
+				sub, err := c.newSubscriber(tpc, group)
+				if err != nil {
+					logger.Error(err)
+					return
 				}
-				for partition := range partitionList {
-					//ConsumePartition方法根据主题，分区和给定的偏移量创建创建了相应的分区消费者
-					//如果该分区消费者已经消费了该信息将会返回error
-					//sarama.OffsetNewest:表明了为最新消息
-					pc, err := (*c.consumer).ConsumePartition(tpc, int32(partition), sarama.OffsetNewest)
+				for _, partition := range partitionList {
+					pc, err := c.consumePartition(sub, partition, offsets[tpc])
 					if err != nil {
 						logger.Error(err)
+						sub.Close()
 						return
 					}
 
 					//添加到列表中
-					sub.PcList = append(sub.PcList, pc)
+					sub.add(partition, pc)
 					logger.Debug(time.Now(), "finished subscribing topic["+tpc+"]")
 				}
+				mu.Lock()
 				subs = append(subs, sub)
+				mu.Unlock()
 			}(topic)
 		}
 	}
@@ -146,3 +184,121 @@ func (c *Consumer) NewSubscribers(tpc string, consumerBufferSize int) ([]*Subscr
 	logger.Debug(time.Now(), "wait group finished")
 	return subs, nil
 }
+
+//从offsets中的位置消费topic的部分分区, 不提交消费位置
+func (c *Consumer) ConsumePartitions(topic string, offsets map[int32]int64) (*Subscriber, error) {
+	sub, err := c.newSubscriber(topic, "")
+	if err != nil {
+		return nil, err
+	}
+	for partition := range offsets {
+		pc, err := c.consumePartition(sub, partition, offsets)
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.add(partition, pc)
+	}
+	return sub, nil
+}
+
+//消费topic中新增的分区, 新分区从最早的消息开始, 返回新增分区的消费
+func (c *Consumer) ConsumeNewPartitions(sub *Subscriber, partitions []int32) ([]sarama.PartitionConsumer, error) {
+	var pcs []sarama.PartitionConsumer
+	for _, partition := range partitions {
+		sub.mu.Lock()
+		_, ok := sub.partitions[partition]
+		closed := sub.closed
+		sub.mu.Unlock()
+		if ok || closed {
+			continue
+		}
+		logger.Info("new partition ", partition, " of topic[", sub.Topic, "] found")
+		pc, err := c.consumePartition(sub, partition, map[int32]int64{partition: sarama.OffsetOldest})
+		if err != nil {
+			return pcs, err
+		}
+		sub.add(partition, pc)
+		pcs = append(pcs, pc)
+	}
+	return pcs, nil
+}
+
+//创建订阅, group不为空时提交消费位置
+func (c *Consumer) newSubscriber(topic, group string) (*Subscriber, error) {
+	sub := &Subscriber{
+		Topic:      topic,
+		Consumer:   c,
+		PcList:     make([]sarama.PartitionConsumer, 0),
+		Group:      group,
+		poms:       make(map[int32]sarama.PartitionOffsetManager),
+		trackers:   make(map[int32]*offsetTracker),
+		partitions: make(map[int32]sarama.PartitionConsumer),
+	}
+	if group != "" {
+		om, err := sarama.NewOffsetManagerFromClient(group, c.client)
+		if err != nil {
+			return nil, err
+		}
+		sub.om = om
+	}
+	return sub, nil
+}
+
+//从记录的位置开始消费分区, 记录的位置已被kafka清理时从最早的消息开始
+func (c *Consumer) consumePartition(sub *Subscriber, partition int32, offsets map[int32]int64) (sarama.PartitionConsumer, error) {
+	topic := sub.Topic
+	pom, err := sub.managePartition(partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, ok := offsets[partition]
+	if ok && pom != nil {
+		offset = resumeOffset(offset, pom)
+	}
+	if !ok {
+		//ConsumePartition方法根据主题，分区和给定的偏移量创建创建了相应的分区消费者
+		//sarama.OffsetNewest:表明了为最新消息
+		if offset, err = c.initialOffset(topic, partition, pom); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := (*c.consumer).ConsumePartition(topic, partition, offset)
+	if err == sarama.ErrOffsetOutOfRange {
+		logger.Warn("offset ", offset, " of topic[", topic, "] partition ", partition, " is out of range, consuming from oldest")
+		return (*c.consumer).ConsumePartition(topic, partition, sarama.OffsetOldest)
+	}
+	return pc, err
+}
+
+//会话中记录的位置只在客户端断开时保存, 进程崩溃后可能落后于消费组已提交的位置
+//消费组提交的是客户端已确认的位置, 更新时从消费组的位置继续, 避免重复投递已确认的消息
+func resumeOffset(stored int64, pom sarama.PartitionOffsetManager) int64 {
+	if committed, _ := pom.NextOffset(); committed > stored {
+		return committed
+	}
+	return stored
+}
+
+//没有记录消费位置的分区开始消费的位置
+//有消费组时优先使用已提交的位置, 否则按配置从最早、最新或指定时间之后的消息开始
+func (c *Consumer) initialOffset(topic string, partition int32, pom sarama.PartitionOffsetManager) (int64, error) {
+	if pom == nil {
+		return sarama.OffsetNewest, nil
+	}
+	if next, _ := pom.NextOffset(); next >= 0 {
+		return next, nil
+	}
+	if initialOffset.at.IsZero() {
+		return initialOffset.offset, nil
+	}
+	offset, err := c.client.GetOffset(topic, partition, UnixMilli(initialOffset.at))
+	if err != nil {
+		return 0, err
+	}
+	//指定时间之后没有消息时返回-1, 从最新消息开始
+	if offset < 0 {
+		return sarama.OffsetNewest, nil
+	}
+	return offset, nil
+}
@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"testing"
+)
+
+//只返回已提交位置的分区位置管理
+type committedOffset struct {
+	sarama.PartitionOffsetManager
+	next int64
+}
+
+func (c *committedOffset) NextOffset() (int64, string) {
+	return c.next, ""
+}
+
+func TestResumeOffset(t *testing.T) {
+	cases := []struct {
+		stored, committed, expect int64
+	}{
+		//进程崩溃后会话中的位置落后于已提交的位置
+		{10, 20, 20},
+		//已投递未确认的消息在会话中重发, 从会话的位置继续
+		{20, 10, 20},
+		//消费组没有提交过
+		{20, -1, 20},
+	}
+	for _, c := range cases {
+		if offset := resumeOffset(c.stored, &committedOffset{next: c.committed}); offset != c.expect {
+			t.Errorf("stored %d committed %d: expected %d, got %d", c.stored, c.committed, c.expect, offset)
+		}
+	}
+}
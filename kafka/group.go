@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"hash/fnv"
+	"newgateway/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+//没有已提交的消费位置时开始消费的位置
+const (
+	InitialOffsetEarliest = "earliest"
+	InitialOffsetLatest   = "latest"
+)
+
+var initialOffset = mustParseInitialOffset(config.GetConfig().Kafka.ConsumerGroup.InitialOffset)
+
+//开始消费的位置, at不为零值时从该时间之后的第一条消息开始
+type startPosition struct {
+	offset int64
+	at     time.Time
+}
+
+func mustParseInitialOffset(s string) startPosition {
+	p, err := parseInitialOffset(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func parseInitialOffset(s string) (startPosition, error) {
+	switch s {
+	case "", InitialOffsetLatest:
+		return startPosition{offset: sarama.OffsetNewest}, nil
+	case InitialOffsetEarliest:
+		return startPosition{offset: sarama.OffsetOldest}, nil
+	}
+	at, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return startPosition{}, fmt.Errorf("invalid initial offset %q: %v", s, err)
+	}
+	return startPosition{offset: sarama.OffsetNewest, at: at}, nil
+}
+
+//持久会话的消费组名称, 没有配置时返回空, 表示不提交消费位置
+func ClientGroup(clientId string) string {
+	tmpl := config.GetConfig().Kafka.ConsumerGroup.Client
+	if tmpl == "" || clientId == "" {
+		return ""
+	}
+	return strings.Replace(tmpl, "{client-id}", clientId, -1)
+}
+
+//共享订阅的消费组名称, {filter}替换为主题过滤器的哈希
+//同一共享名称下不同的过滤器必须使用不同的消费组, 否则分配给一个成员的分区中另一过滤器的消息会被提交而丢失
+func SharedGroup(name, filter string) string {
+	tmpl := config.GetConfig().Kafka.ConsumerGroup.Shared
+	if tmpl == "" {
+		tmpl = "{group}"
+	}
+	if !strings.Contains(tmpl, "{filter}") {
+		tmpl += "-{filter}"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filter))
+	tmpl = strings.Replace(tmpl, "{filter}", fmt.Sprintf("%08x", h.Sum32()), -1)
+	return strings.Replace(tmpl, "{group}", name, -1)
+}
+
+//记录一个分区中已投递但未确认的消息, 计算可以提交的位置
+//消息可能不按顺序确认, 只提交到最早的未确认消息为止, 进程重启后从那里重新投递
+type offsetTracker struct {
+	pending map[int64]struct{}
+	//已投递的最大offset之后的位置
+	next int64
+	mu   sync.Mutex
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		pending: make(map[int64]struct{}),
+		next:    -1,
+	}
+}
+
+//记录已投递等待确认的消息
+func (t *offsetTracker) deliver(offset int64) {
+	t.mu.Lock()
+	t.pending[offset] = struct{}{}
+	if offset+1 > t.next {
+		t.next = offset + 1
+	}
+	t.mu.Unlock()
+}
+
+//确认消息, 返回可以提交的位置, 不是已投递等待确认的消息时返回false
+func (t *offsetTracker) ack(offset int64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[offset]; !ok {
+		return 0, false
+	}
+	delete(t.pending, offset)
+	commit := t.next
+	for o := range t.pending {
+		if o < commit {
+			commit = o
+		}
+	}
+	return commit, true
+}
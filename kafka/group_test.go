@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	tr := newOffsetTracker()
+	for _, o := range []int64{10, 11, 12} {
+		tr.deliver(o)
+	}
+	//乱序确认时只能提交到最早的未确认消息
+	if commit, _ := tr.ack(11); commit != 10 {
+		t.Fatalf("expected commit 10, got %d", commit)
+	}
+	if commit, _ := tr.ack(10); commit != 12 {
+		t.Fatalf("expected commit 12, got %d", commit)
+	}
+	if commit, _ := tr.ack(12); commit != 13 {
+		t.Fatalf("expected commit 13, got %d", commit)
+	}
+	//重复确认或没有投递过的消息不提交
+	if _, ok := tr.ack(12); ok {
+		t.Fatal("unexpected commit for acknowledged offset")
+	}
+}
+
+func TestParseInitialOffset(t *testing.T) {
+	cases := map[string]int64{
+		"":                    sarama.OffsetNewest,
+		InitialOffsetLatest:   sarama.OffsetNewest,
+		InitialOffsetEarliest: sarama.OffsetOldest,
+	}
+	for s, expected := range cases {
+		p, err := parseInitialOffset(s)
+		if err != nil || p.offset != expected || !p.at.IsZero() {
+			t.Fatalf("%q: unexpected position %+v, %v", s, p, err)
+		}
+	}
+	p, err := parseInitialOffset("2019-07-01T00:00:00+08:00")
+	if err != nil || !p.at.Equal(time.Date(2019, 6, 30, 16, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected position %+v, %v", p, err)
+	}
+	if _, err := parseInitialOffset("yesterday"); err == nil {
+		t.Fatal("expected error for invalid initial offset")
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	if g := ClientGroup(""); g != "" {
+		t.Fatalf("expected no group for empty client id, got %q", g)
+	}
+	a, b := SharedGroup("workers", "jobs/a"), SharedGroup("workers", "jobs/b")
+	if a == "" || a == b {
+		t.Fatalf("expected different groups for different filters under one share name, got %q and %q", a, b)
+	}
+	if g := SharedGroup("workers", "jobs/a"); g != a {
+		t.Fatalf("expected stable group name %q, got %q", a, g)
+	}
+	if g := SharedGroup("others", "jobs/a"); g == a {
+		t.Fatalf("expected different groups for different share names, got %q", g)
+	}
+}
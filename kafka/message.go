@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//记录mqtt消息来源的kafka消息头
+const (
+	HeaderMQTTTopic  = "mqtt-topic"
+	HeaderClientId   = "mqtt-client-id"
+	HeaderUserName   = "mqtt-username"
+	HeaderQos        = "mqtt-qos"
+	HeaderRetain     = "mqtt-retain"
+	HeaderReceivedAt = "mqtt-received-at"
+	//消息过期的时间, unix毫秒, 不存在时不过期
+	HeaderExpireAt = "mqtt-expire-at"
+	//mqtt5 PUBLISH属性
+	HeaderPayloadFormat   = "mqtt-payload-format"
+	HeaderContentType     = "mqtt-content-type"
+	HeaderResponseTopic   = "mqtt-response-topic"
+	HeaderCorrelationData = "mqtt-correlation-data"
+)
+
+//网关使用的消息头前缀, 其它消息头为mqtt5用户属性
+const reservedHeaderPrefix = "mqtt-"
+
+//写入kafka的消息, 携带来源mqtt消息的元信息
+//消息key为空时, 按kafka.producer.default-key配置使用的key
+const (
+	KeyClientId = "client-id"
+	KeyTopic    = "topic"
+	KeyNone     = "none"
+)
+
+type Message struct {
+	//kafka topic
+	Topic string
+	//消息key, 为空时按default-key配置
+	Key string
+	//写入的分区, 只在分区方式为manual时使用
+	Partition int32
+	Value     string
+	//为true时写入空值, 用于在compacted topic中删除key
+	Tombstone bool
+
+	//原始mqtt主题
+	MQTTTopic string
+	ClientId  string
+	UserName  string
+	Qos       int
+	Retain    int
+	//网关收到消息的时间
+	ReceivedAt time.Time
+	//消息过期的时间, 零值表示不过期
+	ExpireAt time.Time
+	//附加的消息头, 如mqtt5 PUBLISH属性和用户属性
+	Headers []sarama.RecordHeader
+	//异步发布完成后调用, 成功时err为nil, 队列已满被丢弃时为ErrQueueFull
+	//在处理发布结果的goroutine中调用, 不能阻塞, 耗时的处理需要另起goroutine
+	Callback func(err error)
+}
+
+//转换为sarama消息, mqtt元信息写入消息头
+//消息key, 没有指定时使用客户端id或mqtt主题, 使同一设备或主题的消息写入同一分区并保持顺序
+func (m *Message) key() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	switch config.GetConfig().Kafka.Producer.DefaultKey {
+	case "", KeyClientId:
+		return m.ClientId
+	case KeyTopic:
+		return m.MQTTTopic
+	}
+	return ""
+}
+
+func (m *Message) producerMessage() *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Value:     sarama.ByteEncoder(m.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(HeaderMQTTTopic), Value: []byte(m.MQTTTopic)},
+			{Key: []byte(HeaderClientId), Value: []byte(m.ClientId)},
+			{Key: []byte(HeaderUserName), Value: []byte(m.UserName)},
+			{Key: []byte(HeaderQos), Value: []byte(strconv.Itoa(m.Qos))},
+			{Key: []byte(HeaderRetain), Value: []byte(strconv.Itoa(m.Retain))},
+			{Key: []byte(HeaderReceivedAt), Value: []byte(strconv.FormatInt(UnixMilli(m.ReceivedAt), 10))},
+		},
+	}
+	if !m.ExpireAt.IsZero() {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(HeaderExpireAt), Value: []byte(strconv.FormatInt(UnixMilli(m.ExpireAt), 10))})
+	}
+	msg.Headers = append(msg.Headers, m.Headers...)
+	if key := m.key(); key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	if m.Tombstone {
+		msg.Value = nil
+	}
+	return msg
+}
+
+//是否为网关使用的消息头
+func IsReservedHeader(key string) bool {
+	return strings.HasPrefix(key, reservedHeaderPrefix)
+}
+
+//转换为unix毫秒
+func UnixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//读取消息的过期时间, 没有设置时返回零值
+func ExpireAt(msg *sarama.ConsumerMessage) time.Time {
+	v, ok := Header(msg, HeaderExpireAt)
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+//读取消费到的消息头, 不存在时返回false
+func Header(msg *sarama.ConsumerMessage, key string) (string, bool) {
+	for _, h := range msg.Headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,90 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"testing"
+	"time"
+)
+
+func TestMessageHeaders(t *testing.T) {
+	m := &Message{
+		Topic:      "telemetry",
+		Key:        "dev42",
+		Value:      "21.5",
+		MQTTTopic:  "sensors/dev42/temp",
+		ClientId:   "dev42",
+		UserName:   "device",
+		Qos:        1,
+		Retain:     1,
+		ReceivedAt: time.Unix(1, 0),
+	}
+	pm := m.producerMessage()
+	consumed := &sarama.ConsumerMessage{Topic: pm.Topic}
+	for i := range pm.Headers {
+		consumed.Headers = append(consumed.Headers, &pm.Headers[i])
+	}
+	expected := map[string]string{
+		HeaderMQTTTopic:  "sensors/dev42/temp",
+		HeaderClientId:   "dev42",
+		HeaderUserName:   "device",
+		HeaderQos:        "1",
+		HeaderRetain:     "1",
+		HeaderReceivedAt: "1000",
+	}
+	for k, v := range expected {
+		if h, ok := Header(consumed, k); !ok || h != v {
+			t.Errorf("header %s expected %q, got %q", k, v, h)
+		}
+	}
+	if key, _ := pm.Key.Encode(); string(key) != "dev42" {
+		t.Errorf("unexpected key %q", key)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	m := &Message{Topic: "retained", Key: "status", Tombstone: true}
+	if pm := m.producerMessage(); pm.Value != nil {
+		t.Errorf("tombstone should have nil value, got %v", pm.Value)
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	expireAt := time.Unix(100, 0)
+	m := &Message{Topic: "telemetry", ExpireAt: expireAt}
+	pm := m.producerMessage()
+	consumed := &sarama.ConsumerMessage{}
+	for i := range pm.Headers {
+		consumed.Headers = append(consumed.Headers, &pm.Headers[i])
+	}
+	if v := ExpireAt(consumed); !v.Equal(expireAt) {
+		t.Errorf("expected expire at %v, got %v", expireAt, v)
+	}
+	if v := ExpireAt(&sarama.ConsumerMessage{}); !v.IsZero() {
+		t.Errorf("expected no expiry, got %v", v)
+	}
+}
+
+func TestDefaultKey(t *testing.T) {
+	producer := &config.GetConfig().Kafka.Producer
+	defer func(key string) { producer.DefaultKey = key }(producer.DefaultKey)
+	m := &Message{Topic: "telemetry", MQTTTopic: "sensors/dev42/temp", ClientId: "dev42", Partition: 2}
+	cases := map[string]sarama.Encoder{
+		"":          sarama.StringEncoder("dev42"),
+		KeyClientId: sarama.StringEncoder("dev42"),
+		KeyTopic:    sarama.StringEncoder("sensors/dev42/temp"),
+		KeyNone:     nil,
+	}
+	for defaultKey, expected := range cases {
+		producer.DefaultKey = defaultKey
+		if pm := m.producerMessage(); pm.Key != expected || pm.Partition != 2 {
+			t.Errorf("default key %q: unexpected key %v partition %d", defaultKey, pm.Key, pm.Partition)
+		}
+	}
+	//映射规则指定的key优先
+	producer.DefaultKey = KeyTopic
+	m.Key = "level"
+	if pm := m.producerMessage(); pm.Key != sarama.StringEncoder("level") {
+		t.Errorf("expected mapped key, got %v", pm.Key)
+	}
+}
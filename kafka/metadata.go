@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"newgateway/logger"
+	"sync"
+	"time"
+)
+
+var refresher = &metadataRefresher{
+	watchers: make(map[TopicWatcher]struct{}),
+}
+
+//接收kafka元数据的刷新结果, 通配符订阅据此增加或删除topic和分区
+type TopicWatcher interface {
+	//topics为kafka中所有的topic及其分区, 在刷新的goroutine中依次调用, 不能长时间阻塞
+	Refresh(topics map[string][]int32)
+}
+
+//定时刷新kafka元数据, 通知所有的TopicWatcher
+type metadataRefresher struct {
+	watchers map[TopicWatcher]struct{}
+	started  bool
+	mu       sync.Mutex
+}
+
+//开始接收元数据刷新结果, 第一次调用时启动刷新, 没有配置刷新间隔时不刷新
+func Watch(w TopicWatcher) {
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+	refresher.watchers[w] = struct{}{}
+	interval := config.GetConfig().Kafka.MetadataRefreshInterval
+	if !refresher.started && interval > 0 {
+		refresher.started = true
+		go refresher.run(time.Duration(interval) * time.Millisecond)
+	}
+}
+
+//停止接收元数据刷新结果
+func Unwatch(w TopicWatcher) {
+	refresher.mu.Lock()
+	delete(refresher.watchers, w)
+	refresher.mu.Unlock()
+}
+
+func (r *metadataRefresher) run(interval time.Duration) {
+	var client sarama.Client
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if client == nil {
+			c, err := sarama.NewClient(config.GetConfig().Kafka.ServerList, newSaramaConfig())
+			if err != nil {
+				logger.Error("create metadata client failed: ", err)
+				continue
+			}
+			client = c
+		}
+		topics, err := fetchTopics(client)
+		if err != nil {
+			logger.Error("refresh kafka metadata failed: ", err)
+			continue
+		}
+		r.mu.Lock()
+		watchers := make([]TopicWatcher, 0, len(r.watchers))
+		for w := range r.watchers {
+			watchers = append(watchers, w)
+		}
+		r.mu.Unlock()
+		for _, w := range watchers {
+			w.Refresh(topics)
+		}
+	}
+}
+
+//从kafka获取最新的topic和分区, 不使用client中缓存的元数据
+func fetchTopics(client sarama.Client) (map[string][]int32, error) {
+	if err := client.RefreshMetadata(); err != nil {
+		return nil, err
+	}
+	topicList, err := client.Topics()
+	if err != nil {
+		return nil, err
+	}
+	topics := make(map[string][]int32, len(topicList))
+	for _, topic := range topicList {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		topics[topic] = partitions
+	}
+	return topics, nil
+}
+
+//从最早的消息开始消费所有分区, 用于订阅之后创建的topic
+func OldestOffsets(partitions []int32) map[int32]int64 {
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		offsets[p] = sarama.OffsetOldest
+	}
+	return offsets
+}
@@ -0,0 +1,272 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"newgateway/logger"
+	"newgateway/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	//队列已满, 消息按丢弃策略被丢弃
+	ErrQueueFull = errors.New("kafka: publish queue full")
+	//发布管道已关闭
+	ErrPipelineClosed = errors.New("kafka: publish pipeline closed")
+)
+
+//队列已满时的处理方式
+const (
+	//阻塞发布方, 即阻塞读取该连接的数据包, 直到kafka确认了之前的消息
+	OverflowBlock = "block"
+	//丢弃最早的等待发送的消息
+	OverflowDropOldest = "drop-oldest"
+	//丢弃新发布的消息
+	OverflowDropNewest = "drop-newest"
+)
+
+type PipelineOptions struct {
+	//等待发送和等待kafka确认的消息总数上限
+	QueueSize int
+	//一个topic累积到该数量的消息时立即发送
+	BatchSize int
+	//未满的批次最长等待的时间
+	BatchInterval time.Duration
+	//队列已满时的处理方式
+	Overflow string
+}
+
+//异步发布管道, 按topic累积消息, 达到数量或等待时间后交给sarama AsyncProducer发送
+//消息总数有上限, 超过时按Overflow阻塞或丢弃, 每条消息完成后调用Message.Callback
+//所有消息的Callback在同一个goroutine中依次调用, 阻塞会使其它消息的完成和等待队列的发布方一起停止
+type Pipeline struct {
+	producer sarama.AsyncProducer
+	opts     PipelineOptions
+	//topic -> 等待发送的消息
+	batches map[string][]queuedMessage
+	//等待发送的消息数量
+	queued int
+	//已交给producer等待确认的消息数量
+	inflight int
+	//消息进入队列的序号, 用于找到最早的消息
+	seq    uint64
+	closed bool
+	mu     sync.Mutex
+	//有消息完成时通知阻塞的发布方
+	space *sync.Cond
+	//有批次已满
+	full    chan struct{}
+	closing chan struct{}
+	//所有消息都已完成
+	done chan struct{}
+}
+
+type queuedMessage struct {
+	msg *Message
+	seq uint64
+}
+
+func NewPipeline(producer sarama.AsyncProducer, opts PipelineOptions) (*Pipeline, error) {
+	switch opts.Overflow {
+	case "":
+		opts.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		return nil, fmt.Errorf("invalid publish overflow policy %q", opts.Overflow)
+	}
+	if opts.QueueSize <= 0 {
+		return nil, fmt.Errorf("invalid publish queue size %d", opts.QueueSize)
+	}
+	if opts.BatchSize <= 0 || opts.BatchInterval <= 0 {
+		return nil, fmt.Errorf("invalid publish batch size %d or interval %v", opts.BatchSize, opts.BatchInterval)
+	}
+	p := &Pipeline{
+		producer: producer,
+		opts:     opts,
+		batches:  make(map[string][]queuedMessage),
+		full:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	p.space = sync.NewCond(&p.mu)
+	go p.run()
+	go p.results()
+	return p, nil
+}
+
+//将消息加入队列, 队列已满时按Overflow阻塞或丢弃, 被丢弃时返回ErrQueueFull
+func (p *Pipeline) Publish(m *Message) error {
+	p.mu.Lock()
+	for !p.closed && p.queued+p.inflight >= p.opts.QueueSize {
+		switch p.opts.Overflow {
+		case OverflowDropNewest:
+			p.mu.Unlock()
+			p.drop(m)
+			return ErrQueueFull
+		case OverflowDropOldest:
+			if oldest := p.removeOldest(); oldest != nil {
+				p.mu.Unlock()
+				metrics.Add("publish.async.pending", -1)
+				p.drop(oldest)
+				p.mu.Lock()
+				continue
+			}
+			//所有消息都已交给producer, 只能等待确认
+			p.space.Wait()
+		default:
+			p.space.Wait()
+		}
+	}
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPipelineClosed
+	}
+	p.seq++
+	batch := append(p.batches[m.Topic], queuedMessage{msg: m, seq: p.seq})
+	p.batches[m.Topic] = batch
+	p.queued++
+	full := len(batch) >= p.opts.BatchSize
+	p.mu.Unlock()
+	metrics.Add("publish.async.pending", 1)
+	if full {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//删除最早的等待发送的消息, 没有时返回nil, 需要持有锁
+func (p *Pipeline) removeOldest() *Message {
+	var (
+		oldest string
+		seq    uint64
+	)
+	for topic, batch := range p.batches {
+		if len(batch) > 0 && (seq == 0 || batch[0].seq < seq) {
+			oldest, seq = topic, batch[0].seq
+		}
+	}
+	if seq == 0 {
+		return nil
+	}
+	batch := p.batches[oldest]
+	p.batches[oldest] = batch[1:]
+	p.queued--
+	return batch[0].msg
+}
+
+func (p *Pipeline) drop(m *Message) {
+	metrics.Add("publish.async.dropped", 1)
+	logger.Warn("publish queue is full, message of topic[" + m.Topic + "] dropped")
+	if m.Callback != nil {
+		m.Callback(ErrQueueFull)
+	}
+}
+
+//只在一个goroutine中发送, 保证同一topic的消息按发布顺序交给producer
+func (p *Pipeline) run() {
+	tick := time.NewTicker(p.opts.BatchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			p.flush(false)
+		case <-p.full:
+			p.flush(true)
+		case <-p.closing:
+			p.flush(false)
+			p.producer.AsyncClose()
+			return
+		}
+	}
+}
+
+//发送等待的消息, onlyFull为true时只发送已满的批次
+func (p *Pipeline) flush(onlyFull bool) {
+	p.mu.Lock()
+	var send []*Message
+	for topic, batch := range p.batches {
+		if len(batch) == 0 || (onlyFull && len(batch) < p.opts.BatchSize) {
+			continue
+		}
+		for _, q := range batch {
+			send = append(send, q.msg)
+		}
+		delete(p.batches, topic)
+	}
+	p.queued -= len(send)
+	p.inflight += len(send)
+	p.mu.Unlock()
+	//producer的输入可能阻塞, 不能持有锁
+	for _, m := range send {
+		msg := m.producerMessage()
+		msg.Metadata = m
+		p.producer.Input() <- msg
+	}
+}
+
+//处理producer返回的结果, producer关闭后退出
+func (p *Pipeline) results() {
+	defer close(p.done)
+	successes, errs := p.producer.Successes(), p.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			p.complete(msg, nil)
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			p.complete(e.Msg, e.Err)
+		}
+	}
+}
+
+func (p *Pipeline) complete(msg *sarama.ProducerMessage, err error) {
+	m, ok := msg.Metadata.(*Message)
+	if !ok {
+		//不经过管道直接写入producer的消息
+		if err != nil {
+			logger.Error("publish message to topic["+msg.Topic+"] failed: ", err)
+		}
+		return
+	}
+	p.mu.Lock()
+	p.inflight--
+	p.space.Broadcast()
+	p.mu.Unlock()
+	metrics.Add("publish.async.pending", -1)
+	if err != nil {
+		metrics.Add("publish.async.error", 1)
+		logger.Error("publish message to topic["+m.Topic+"] failed: ", err)
+	} else {
+		metrics.Add("publish.async.success", 1)
+	}
+	if m.Callback != nil {
+		m.Callback(err)
+	}
+}
+
+//发送所有等待的消息并等待kafka确认, 之后的发布返回ErrPipelineClosed
+func (p *Pipeline) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.done
+		return
+	}
+	p.closed = true
+	p.space.Broadcast()
+	p.mu.Unlock()
+	close(p.closing)
+	<-p.done
+}
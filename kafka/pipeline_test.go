@@ -0,0 +1,109 @@
+package kafka
+
+import (
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录每条消息的发布结果
+type results struct {
+	errs map[string]error
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+}
+
+func newResults() *results {
+	return &results{errs: make(map[string]error)}
+}
+
+func (r *results) message(topic, value string) *Message {
+	r.wg.Add(1)
+	return &Message{Topic: topic, Value: value, Callback: func(err error) {
+		r.mu.Lock()
+		r.errs[value] = err
+		r.mu.Unlock()
+		r.wg.Done()
+	}}
+}
+
+func newTestPipeline(t *testing.T, opts PipelineOptions) (*Pipeline, *mocks.AsyncProducer) {
+	cfg := sarama.NewConfig()
+	cfg.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, cfg)
+	p, err := NewPipeline(producer, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, producer
+}
+
+func TestPipelineBatch(t *testing.T) {
+	p, producer := newTestPipeline(t, PipelineOptions{QueueSize: 10, BatchSize: 2, BatchInterval: 20 * time.Millisecond})
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(errors.New("broker down"))
+	r := newResults()
+	//满一批时立即发送, 未满的批次等待间隔后发送
+	for _, m := range []*Message{r.message("a", "1"), r.message("a", "2"), r.message("b", "3")} {
+		if err := p.Publish(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.wg.Wait()
+	if r.errs["1"] != nil || r.errs["2"] != nil || r.errs["3"] == nil {
+		t.Fatalf("unexpected results %v", r.errs)
+	}
+	p.Close()
+	if err := p.Publish(&Message{Topic: "a"}); err != ErrPipelineClosed {
+		t.Fatalf("expected ErrPipelineClosed, got %v", err)
+	}
+}
+
+func TestPipelineDropNewest(t *testing.T) {
+	p, producer := newTestPipeline(t, PipelineOptions{QueueSize: 1, BatchSize: 10, BatchInterval: time.Hour, Overflow: OverflowDropNewest})
+	producer.ExpectInputAndSucceed()
+	r := newResults()
+	if err := p.Publish(r.message("a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(r.message("a", "2")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	p.Close()
+	r.wg.Wait()
+	if r.errs["1"] != nil || r.errs["2"] != ErrQueueFull {
+		t.Fatalf("unexpected results %v", r.errs)
+	}
+}
+
+func TestPipelineDropOldest(t *testing.T) {
+	p, producer := newTestPipeline(t, PipelineOptions{QueueSize: 2, BatchSize: 10, BatchInterval: time.Hour, Overflow: OverflowDropOldest})
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+	r := newResults()
+	for _, m := range []*Message{r.message("a", "1"), r.message("b", "2"), r.message("a", "3")} {
+		if err := p.Publish(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	r.wg.Wait()
+	if r.errs["1"] != ErrQueueFull || r.errs["2"] != nil || r.errs["3"] != nil {
+		t.Fatalf("unexpected results %v", r.errs)
+	}
+}
+
+func TestPipelineOptions(t *testing.T) {
+	producer := mocks.NewAsyncProducer(t, nil)
+	defer producer.Close()
+	if _, err := NewPipeline(producer, PipelineOptions{QueueSize: 1, BatchSize: 1, BatchInterval: time.Second, Overflow: "drop-all"}); err == nil {
+		t.Error("expected invalid overflow error")
+	}
+	if _, err := NewPipeline(producer, PipelineOptions{BatchSize: 1, BatchInterval: time.Second}); err == nil {
+		t.Error("expected invalid queue size error")
+	}
+}
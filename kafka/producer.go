@@ -4,22 +4,14 @@ import (
 	"github.com/Shopify/sarama"
 	"newgateway/config"
 	"newgateway/logger"
-	"sync"
 	"time"
 )
 
 var kafkaProducer = initProducer()
 
-func init() {
-	go Tick()
-}
-
 func initProducer() *sarama.SyncProducer {
-	cfg := sarama.NewConfig()
-	// 等待服务器所有副本都保存成功后的响应
-	cfg.Producer.RequiredAcks = sarama.WaitForAll
-	// 随机的分区类型：返回一个分区器，该分区器每次选择一个随机分区
-	cfg.Producer.Partitioner = sarama.NewRandomPartitioner
+	//确认方式、压缩、分区方式等按kafka.producer配置
+	cfg := newProducerConfig()
 	// 是否等待成功和失败后的响应
 	cfg.Producer.Return.Successes = true
 
@@ -33,13 +25,9 @@ func initProducer() *sarama.SyncProducer {
 
 func initAsyncProducer() *sarama.AsyncProducer {
 
-	cfg := sarama.NewConfig()
-	// 等待服务器所有副本都保存成功后的响应
-	cfg.Producer.RequiredAcks = sarama.WaitForAll
-	// 随机的分区类型：返回一个分区器，该分区器每次选择一个随机分区
-	cfg.Producer.Partitioner = sarama.NewRandomPartitioner
-	// 是否等待成功和失败后的响应
-	cfg.Producer.Return.Successes = false
+	cfg := newProducerConfig()
+	// 是否等待成功和失败后的响应, 由发布管道处理
+	cfg.Producer.Return.Successes = true
 
 	producer, err := sarama.NewAsyncProducer(config.GetConfig().Kafka.ServerList, cfg)
 	if err != nil {
@@ -55,77 +43,50 @@ func Async(msg *sarama.ProducerMessage) {
 }
 
 //返回partition, offset, error
-func Publish(topic, value string) (int32, int64, error) {
-	msg := &sarama.ProducerMessage{
-		Topic:     topic,
-		Partition: int32(10),
-		Key:       sarama.StringEncoder("key"),
-		Value:     sarama.ByteEncoder(value),
-	}
-	return (*kafkaProducer).SendMessage(msg)
+func Publish(msg *Message) (int32, int64, error) {
+	return (*kafkaProducer).SendMessage(msg.producerMessage())
 }
 
 func BatchPublish(msgs []*sarama.ProducerMessage) error {
 	return (*kafkaProducer).SendMessages(msgs)
 }
 
-var lock = sync.RWMutex{}
-
-var buffer = make(map[string]*Buff)
+var pipeline = initPipeline()
 
-type Buff struct {
-	mu   sync.Mutex
-	data []*sarama.ProducerMessage
-}
-
-func (b *Buff) Read() []*sarama.ProducerMessage {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	arr := b.data
-	b.data = make([]*sarama.ProducerMessage, 0)
-	return arr
-}
-
-func (b *Buff) Write(msg *sarama.ProducerMessage) {
-	b.mu.Lock()
-	b.data = append(b.data, msg)
-	b.mu.Unlock()
-}
-
-func AsyncPublish(topic string, value string) {
-	msg := &sarama.ProducerMessage{
-		Topic:     topic,
-		Partition: int32(10),
-		Key:       sarama.StringEncoder("key"),
-		Value:     sarama.ByteEncoder(value),
+//qos0消息的异步发布管道, 使用asyncProducer发送
+func initPipeline() *Pipeline {
+	c := config.GetConfig().Kafka
+	opts := PipelineOptions{
+		QueueSize:     c.Producer.QueueSize,
+		BatchSize:     c.Producer.BatchSize,
+		BatchInterval: time.Duration(c.Producer.BatchInterval) * time.Millisecond,
+		Overflow:      c.Producer.Overflow,
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 100
+	}
+	if opts.BatchInterval == 0 {
+		opts.BatchInterval = time.Duration(c.ProducerTickerInterval) * time.Millisecond
+	}
+	if opts.BatchInterval == 0 {
+		opts.BatchInterval = 100 * time.Millisecond
 	}
-	lock.RLock()
-	buf, ok := buffer[topic]
-	lock.RUnlock()
-	if !ok {
-		buf = &Buff{
-			mu:   sync.Mutex{},
-			data: make([]*sarama.ProducerMessage, 0),
-		}
-		lock.Lock()
-		buffer[topic] = buf
-		lock.Unlock()
+	p, err := NewPipeline(*asyncProducer, opts)
+	if err != nil {
+		panic(err)
 	}
-	buf.Write(msg)
+	return p
 }
 
-func Tick() {
-	tick := time.Tick(time.Duration(config.GetConfig().Kafka.ProducerTickerInterval) * time.Millisecond)
-	for {
-		select {
-		case <-tick:
-			if len(buffer) > 0 {
-				lock.RLock()
-				for _, v := range (buffer) {
-					BatchPublish(v.Read())
-				}
-				lock.RUnlock()
-			}
-		}
-	}
+//异步发布, 队列已满时按overflow配置阻塞或丢弃, 结果通过m.Callback返回
+func AsyncPublish(m *Message) error {
+	return pipeline.Publish(m)
+}
+
+//发送异步发布队列中剩余的消息并等待kafka确认, 服务关闭时在所有客户端关闭后调用
+func ClosePipeline() {
+	pipeline.Close()
 }
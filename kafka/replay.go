@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"newgateway/logger"
+	"sync"
+	"time"
+)
+
+//回放时分区超过该时间没有新消息即认为已读完
+//最新位置是事务控制消息或已被压缩掉时, 读不到该位置的消息
+const replayIdleTimeout = 5 * time.Second
+
+//回放之后在后台继续读取新消息, 关闭后停止
+type Replayer struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	pcs      []sarama.PartitionConsumer
+}
+
+//从最早的消息开始读取topic的所有分区, 读到调用时的最新位置后返回, 之后在后台继续读取新消息
+//用于从compacted topic中恢复状态, handle会被多个分区的goroutine并发调用
+func Replay(topic string, handle func(msg *sarama.ConsumerMessage)) (*Replayer, error) {
+	client, err := sarama.NewClient(config.GetConfig().Kafka.ServerList, newSaramaConfig())
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	r := &Replayer{client: client, consumer: consumer}
+	partitionList, err := client.Partitions(topic)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	for _, partition := range partitionList {
+		oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		pc, err := consumer.ConsumePartition(topic, partition, oldest)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.pcs = append(r.pcs, pc)
+		wg.Add(1)
+		go func(pc sarama.PartitionConsumer, empty bool, newest int64) {
+			var once sync.Once
+			caughtUp := func() { once.Do(wg.Done) }
+			//分区为空时不需要等待
+			if empty {
+				caughtUp()
+			}
+			idle := time.AfterFunc(replayIdleTimeout, caughtUp)
+			defer idle.Stop()
+			for msg := range pc.Messages() {
+				idle.Reset(replayIdleTimeout)
+				handle(msg)
+				if msg.Offset+1 >= newest {
+					caughtUp()
+				}
+			}
+			//回放期间被关闭
+			caughtUp()
+		}(pc, oldest >= newest, newest)
+	}
+	wg.Wait()
+	logger.Info("replayed topic[" + topic + "]")
+	return r, nil
+}
+
+//停止读取新消息, 关闭消费和kafka连接
+func (r *Replayer) Close() error {
+	for _, pc := range r.pcs {
+		if err := pc.Close(); err != nil {
+			logger.Error("close replay partition consumer failed: ", err)
+		}
+	}
+	if err := r.consumer.Close(); err != nil {
+		r.client.Close()
+		return err
+	}
+	return r.client.Close()
+}
@@ -0,0 +1,266 @@
+package kafka
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"newgateway/logger"
+	"sync"
+	"time"
+)
+
+//共享订阅, 同一组的成员加入同一个kafka消费组, 由kafka在成员之间分配分区
+//每条消息只投递给组内的一个成员, 成员加入或离开时重新分配
+type SharedSubscriber struct {
+	//kafka消费组名称
+	Group  string
+	Topics []string
+
+	client   sarama.Client
+	group    sarama.ConsumerGroup
+	match    func(topic string) bool
+	messages chan *sarama.ConsumerMessage
+	//topic -> 分区数量, 变化时重新加入消费组
+	partitions map[string]int
+	//结束当前的消费, 按新的topic重新加入消费组
+	rejoin context.CancelFunc
+	//当前分配的会话, 重新分配期间为nil
+	session sarama.ConsumerGroupSession
+	//topic -> 分区 -> 已投递未确认的消息, 每次分配后重新记录
+	trackers  map[string]map[int32]*offsetTracker
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+//加入消费组, 消费所有满足match的topic, 之后创建的topic在刷新元数据时加入
+func NewSharedSubscriber(group string, match func(topic string) bool, consumerBufferSize int) (*SharedSubscriber, error) {
+	cfg := newSaramaConfig()
+	cfg.Consumer.Offsets.Initial = initialOffset.offset
+	client, err := sarama.NewClient(config.GetConfig().Kafka.ServerList, cfg)
+	if err != nil {
+		return nil, err
+	}
+	topicList, err := client.Topics()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	topics := make(map[string][]int32)
+	for _, topic := range topicList {
+		if !match(topic) {
+			continue
+		}
+		if topics[topic], err = client.Partitions(topic); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	cg, err := sarama.NewConsumerGroupFromClient(group, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SharedSubscriber{
+		Group:    group,
+		client:   client,
+		group:    cg,
+		match:    match,
+		messages: make(chan *sarama.ConsumerMessage, consumerBufferSize),
+		trackers: make(map[string]map[int32]*offsetTracker),
+		cancel:   cancel,
+	}
+	s.setTopics(topics)
+	go s.consume(ctx)
+	Watch(s)
+	return s, nil
+}
+
+//更新消费的topic, topic或分区数量没有变化时返回false
+func (s *SharedSubscriber) setTopics(topics map[string][]int32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := len(topics) != len(s.partitions)
+	for topic, partitions := range topics {
+		if n, ok := s.partitions[topic]; !ok || n != len(partitions) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	s.Topics = make([]string, 0, len(topics))
+	s.partitions = make(map[string]int, len(topics))
+	for topic, partitions := range topics {
+		s.Topics = append(s.Topics, topic)
+		s.partitions[topic] = len(partitions)
+	}
+	return true
+}
+
+//新增或删除了匹配的topic或分区时重新加入消费组, 由kafka重新分配分区
+func (s *SharedSubscriber) Refresh(topics map[string][]int32) {
+	matched := make(map[string][]int32)
+	for topic, partitions := range topics {
+		if s.match(topic) {
+			matched[topic] = partitions
+		}
+	}
+	if !s.setTopics(matched) {
+		return
+	}
+	s.mu.Lock()
+	logger.Info("topics of group[", s.Group, "] changed: ", s.Topics)
+	if s.rejoin != nil {
+		s.rejoin()
+	}
+	s.mu.Unlock()
+}
+
+//分配到的分区中的消息, 关闭后channel被关闭
+func (s *SharedSubscriber) Messages() <-chan *sarama.ConsumerMessage {
+	return s.messages
+}
+
+//Consume在每次重新分配或topic变化时返回, 循环直到关闭
+func (s *SharedSubscriber) consume(ctx context.Context) {
+	defer close(s.messages)
+	for {
+		s.mu.Lock()
+		topics := s.Topics
+		sessionCtx, rejoin := context.WithCancel(ctx)
+		s.rejoin = rejoin
+		s.mu.Unlock()
+		if len(topics) == 0 {
+			//没有匹配的topic, 等待刷新元数据时发现
+			<-sessionCtx.Done()
+		} else if err := s.group.Consume(sessionCtx, topics, s); err != nil {
+			if err == sarama.ErrClosedConsumerGroup {
+				rejoin()
+				return
+			}
+			logger.Error("consume group["+s.Group+"] failed: ", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+		rejoin()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+//分配分区后开始消费之前调用
+func (s *SharedSubscriber) Setup(session sarama.ConsumerGroupSession) error {
+	logger.Info("group[", s.Group, "] member ", session.MemberID(), " claimed ", session.Claims())
+	s.mu.Lock()
+	s.session = session
+	s.trackers = make(map[string]map[int32]*offsetTracker)
+	s.mu.Unlock()
+	s.resetInitialOffsets(session)
+	return nil
+}
+
+//重新分配前调用, 之后确认的消息不再提交, 由新分配到该分区的成员重新投递
+func (s *SharedSubscriber) Cleanup(session sarama.ConsumerGroupSession) error {
+	s.mu.Lock()
+	s.session = nil
+	s.mu.Unlock()
+	return nil
+}
+
+//将分配到的分区中的消息转发给订阅者, 重新分配或关闭时返回
+func (s *SharedSubscriber) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		select {
+		case s.messages <- message:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+//按时间指定开始位置时, 没有已提交位置的分区从该时间之后的第一条消息开始
+func (s *SharedSubscriber) resetInitialOffsets(session sarama.ConsumerGroupSession) {
+	if initialOffset.at.IsZero() {
+		return
+	}
+	coordinator, err := s.client.Coordinator(s.Group)
+	if err != nil {
+		logger.Error("find coordinator of group["+s.Group+"] failed: ", err)
+		return
+	}
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: s.Group}
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			req.AddPartition(topic, partition)
+		}
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		logger.Error("fetch offsets of group["+s.Group+"] failed: ", err)
+		return
+	}
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			if block := resp.GetBlock(topic, partition); block == nil || block.Offset >= 0 {
+				continue
+			}
+			offset, err := s.client.GetOffset(topic, partition, UnixMilli(initialOffset.at))
+			if err != nil || offset < 0 {
+				continue
+			}
+			session.ResetOffset(topic, partition, offset, "")
+		}
+	}
+}
+
+//记录消息已投递给客户端, 确认之前不会提交该消息的位置
+func (s *SharedSubscriber) Deliver(message *sarama.ConsumerMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	partitions := s.trackers[message.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]*offsetTracker)
+		s.trackers[message.Topic] = partitions
+	}
+	t := partitions[message.Partition]
+	if t == nil {
+		t = newOffsetTracker()
+		partitions[message.Partition] = t
+	}
+	t.deliver(message.Offset)
+}
+
+//客户端确认了消息, 提交到该分区最早的未确认消息为止
+//重新分配之前投递的消息不再提交
+func (s *SharedSubscriber) Ack(message *sarama.ConsumerMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.trackers[message.Topic][message.Partition]
+	if t == nil || s.session == nil {
+		return
+	}
+	if commit, ok := t.ack(message.Offset); ok {
+		s.session.MarkOffset(message.Topic, message.Partition, commit, "")
+	}
+}
+
+//离开消费组, 分区重新分配给组内其它成员, 可以重复调用
+func (s *SharedSubscriber) Close() {
+	s.closeOnce.Do(func() {
+		Unwatch(s)
+		s.cancel()
+		if err := s.group.Close(); err != nil {
+			logger.Error("close group["+s.Group+"] failed: ", err)
+		}
+		//部分sarama版本关闭消费组时会同时关闭client
+		if err := s.client.Close(); err != nil && err != sarama.ErrClosedClient {
+			logger.Error("close client of group["+s.Group+"] failed: ", err)
+		}
+	})
+}
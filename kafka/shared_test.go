@@ -0,0 +1,23 @@
+package kafka
+
+import "testing"
+
+func TestSharedSetTopics(t *testing.T) {
+	s := &SharedSubscriber{}
+	if !s.setTopics(map[string][]int32{"jobs": {0, 1}}) {
+		t.Fatal("expected topics to change")
+	}
+	if s.setTopics(map[string][]int32{"jobs": {0, 1}}) {
+		t.Fatal("expected no change for same topics")
+	}
+	//新增分区或topic时重新加入消费组
+	if !s.setTopics(map[string][]int32{"jobs": {0, 1, 2}}) {
+		t.Fatal("expected new partition to change topics")
+	}
+	if !s.setTopics(map[string][]int32{"jobs": {0, 1, 2}, "jobs-eu": {0}}) || len(s.Topics) != 2 {
+		t.Fatalf("expected new topic, got %v", s.Topics)
+	}
+	if !s.setTopics(map[string][]int32{"jobs-eu": {0}}) || len(s.Topics) != 1 || s.Topics[0] != "jobs-eu" {
+		t.Fatalf("expected deleted topic to be removed, got %v", s.Topics)
+	}
+}
@@ -2,16 +2,121 @@ package kafka
 
 import (
 	"github.com/Shopify/sarama"
+	"newgateway/logger"
+	"sync"
 )
 
 type Subscriber struct {
 	Topic    string
 	Consumer *Consumer
 	PcList   []sarama.PartitionConsumer
+	//提交消费位置的消费组, 为空时不提交
+	Group string
+
+	//消费组的位置管理, 没有消费组时为nil
+	om sarama.OffsetManager
+	//分区 -> 消费位置
+	poms     map[int32]sarama.PartitionOffsetManager
+	trackers map[int32]*offsetTracker
+	//已经开始消费的分区
+	partitions map[int32]sarama.PartitionConsumer
+	closed     bool
+	mu         sync.Mutex
+	closeOnce  sync.Once
 }
 
-func (c *Subscriber) Close() {
-	for _, v := range (c.PcList) {
-		v.Close()
+//记录开始消费的分区
+func (c *Subscriber) add(partition int32, pc sarama.PartitionConsumer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		pc.AsyncClose()
+		return
+	}
+	c.partitions[partition] = pc
+	c.PcList = append(c.PcList, pc)
+}
+
+//分区的消费, 没有消费该分区时返回nil
+func (c *Subscriber) PartitionConsumer(partition int32) sarama.PartitionConsumer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.partitions[partition]
+}
+
+//所有分区的消费, 返回副本, 之后新增的分区不包含在内
+func (c *Subscriber) PartitionConsumers() []sarama.PartitionConsumer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]sarama.PartitionConsumer(nil), c.PcList...)
+}
+
+//记录消息已投递给客户端, 确认之前不会提交该消息的位置
+func (c *Subscriber) Deliver(message *sarama.ConsumerMessage) {
+	if t := c.tracker(message.Partition); t != nil {
+		t.deliver(message.Offset)
+	}
+}
+
+//客户端确认了消息, 或消息不需要投递, 提交到最早的未确认消息为止
+func (c *Subscriber) Ack(message *sarama.ConsumerMessage) {
+	t := c.tracker(message.Partition)
+	if t == nil {
+		return
 	}
-}
\ No newline at end of file
+	if commit, ok := t.ack(message.Offset); ok {
+		c.mu.Lock()
+		pom := c.poms[message.Partition]
+		c.mu.Unlock()
+		pom.MarkOffset(commit, "")
+	}
+}
+
+func (c *Subscriber) tracker(partition int32) *offsetTracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trackers[partition]
+}
+
+//管理分区的消费位置, 返回nil表示不提交
+func (c *Subscriber) managePartition(partition int32) (sarama.PartitionOffsetManager, error) {
+	if c.om == nil {
+		return nil, nil
+	}
+	pom, err := c.om.ManagePartition(c.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.poms[partition] = pom
+	c.trackers[partition] = newOffsetTracker()
+	c.mu.Unlock()
+	return pom, nil
+}
+
+//关闭分区消费, 并提交最后确认的位置, 可以重复调用
+func (c *Subscriber) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		pcs := c.PcList
+		c.mu.Unlock()
+		//关闭分区消费时等待消息被取走, 不能持有锁
+		for _, v := range (pcs) {
+			v.Close()
+		}
+		if c.om == nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, pom := range c.poms {
+			if err := pom.Close(); err != nil {
+				logger.Error("close offset manager of topic["+c.Topic+"] failed: ", err)
+			}
+		}
+		if err := c.om.Close(); err != nil {
+			logger.Error("close offset manager of group["+c.Group+"] failed: ", err)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package mapping
+
+import (
+	"fmt"
+	"newgateway/config"
+	"newgateway/topic"
+	"strconv"
+	"strings"
+)
+
+const (
+	//使用客户端id作为消息key
+	KeyClientId = "client-id"
+	//使用完整的mqtt主题作为消息key
+	KeyTopic = "topic"
+	//使用mqtt主题的某一层作为消息key, 例如level:1
+	KeyLevelPrefix = "level:"
+)
+
+//未配置映射规则时, mqtt主题中的/替换为kafka topic中的.
+const defaultSeparator = "."
+
+var mapper *Mapper
+
+func init() {
+	m, err := NewMapper(config.GetConfig().TopicMapping)
+	if err != nil {
+		panic(err)
+	}
+	mapper = m
+}
+
+//获取按配置文件初始化的映射器
+func GetMapper() *Mapper {
+	return mapper
+}
+
+//一条解析后的映射规则
+type Rule struct {
+	MQTT  string
+	Kafka string
+	Key   string
+	//分区方式为manual时写入的分区
+	Partition int32
+	//Key为level:N时的层级, 否则为-1
+	keyLevel int
+}
+
+//mqtt主题与kafka topic之间的双向映射
+type Mapper struct {
+	rules []*Rule
+}
+
+func NewMapper(mappings []config.TopicMapping) (*Mapper, error) {
+	m := &Mapper{}
+	for _, v := range mappings {
+		if err := topic.ValidateFilter(v.MQTT); err != nil {
+			return nil, fmt.Errorf("topic mapping %q: %v", v.MQTT, err)
+		}
+		if v.Kafka == "" {
+			return nil, fmt.Errorf("topic mapping %q: empty kafka topic", v.MQTT)
+		}
+		if v.Partition < 0 {
+			return nil, fmt.Errorf("topic mapping %q: invalid partition %d", v.MQTT, v.Partition)
+		}
+		rule := &Rule{
+			MQTT:      v.MQTT,
+			Kafka:     v.Kafka,
+			Key:       v.Key,
+			Partition: v.Partition,
+			keyLevel:  -1,
+		}
+		switch {
+		case v.Key == "", v.Key == KeyClientId, v.Key == KeyTopic:
+		case strings.HasPrefix(v.Key, KeyLevelPrefix):
+			level, err := strconv.Atoi(strings.TrimPrefix(v.Key, KeyLevelPrefix))
+			if err != nil || level < 0 {
+				return nil, fmt.Errorf("topic mapping %q: invalid key %q", v.MQTT, v.Key)
+			}
+			rule.keyLevel = level
+		default:
+			return nil, fmt.Errorf("topic mapping %q: invalid key %q", v.MQTT, v.Key)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+//查找第一条与mqtt主题匹配的规则
+func (m *Mapper) match(mqttTopic string) *Rule {
+	for _, rule := range m.rules {
+		if topic.Match(rule.MQTT, mqttTopic) {
+			return rule
+		}
+	}
+	return nil
+}
+
+//将mqtt主题映射为kafka topic和消息key
+func (m *Mapper) ToKafka(mqttTopic, clientId string) (string, string) {
+	rule := m.match(mqttTopic)
+	if rule == nil {
+		return strings.Replace(mqttTopic, topic.Separator, defaultSeparator, -1), ""
+	}
+	switch {
+	case rule.Key == KeyClientId:
+		return rule.Kafka, clientId
+	case rule.Key == KeyTopic:
+		return rule.Kafka, mqttTopic
+	case rule.keyLevel >= 0:
+		levels := strings.Split(mqttTopic, topic.Separator)
+		if rule.keyLevel < len(levels) {
+			return rule.Kafka, levels[rule.keyLevel]
+		}
+	}
+	return rule.Kafka, ""
+}
+
+//mqtt主题写入的分区, 只在分区方式为manual时使用, 没有匹配的规则时为0
+func (m *Mapper) Partition(mqttTopic string) int32 {
+	if rule := m.match(mqttTopic); rule != nil {
+		return rule.Partition
+	}
+	return 0
+}
+
+//根据kafka topic和消息key还原mqtt主题
+//规则中的主题不含通配符, 或仅在key所在层级为+时可以还原, 否则返回false
+func (m *Mapper) ToMQTT(kafkaTopic string, key []byte) (string, bool) {
+	mapped := false
+	for _, rule := range m.rules {
+		if rule.Kafka != kafkaTopic {
+			continue
+		}
+		mapped = true
+		if !topic.HasWildcard(rule.MQTT) {
+			return rule.MQTT, true
+		}
+		if rule.Key == KeyTopic && len(key) > 0 {
+			return string(key), true
+		}
+		if rule.keyLevel < 0 || len(key) == 0 {
+			continue
+		}
+		levels := strings.Split(rule.MQTT, topic.Separator)
+		if rule.keyLevel >= len(levels) || levels[rule.keyLevel] != topic.SingleLevelWildcard {
+			continue
+		}
+		levels[rule.keyLevel] = string(key)
+		if name := strings.Join(levels, topic.Separator); !topic.HasWildcard(name) {
+			return name, true
+		}
+	}
+	if mapped {
+		return kafkaTopic, false
+	}
+	return strings.Replace(kafkaTopic, defaultSeparator, topic.Separator, -1), true
+}
+
+//判断订阅mqtt主题过滤器时是否需要消费该kafka topic
+func (m *Mapper) Consumes(filter, kafkaTopic string) bool {
+	mapped := false
+	for _, rule := range m.rules {
+		if rule.Kafka != kafkaTopic {
+			continue
+		}
+		mapped = true
+		if topic.Intersects(rule.MQTT, filter) {
+			return true
+		}
+	}
+	if mapped {
+		return false
+	}
+	return topic.Match(filter, strings.Replace(kafkaTopic, defaultSeparator, topic.Separator, -1))
+}
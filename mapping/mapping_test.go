@@ -0,0 +1,98 @@
+package mapping
+
+import (
+	"newgateway/config"
+	"testing"
+)
+
+func newTestMapper(t *testing.T) *Mapper {
+	m, err := NewMapper([]config.TopicMapping{
+		{MQTT: "sensors/+/temp", Kafka: "telemetry", Key: "level:1"},
+		{MQTT: "fleet/#", Kafka: "fleet", Key: KeyClientId},
+		{MQTT: "status", Kafka: "device-status"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestToKafka(t *testing.T) {
+	m := newTestMapper(t)
+	cases := []struct {
+		mqtt, kafka, key string
+	}{
+		{"sensors/dev42/temp", "telemetry", "dev42"},
+		{"fleet/truck/1", "fleet", "client-1"},
+		{"status", "device-status", ""},
+		{"other/topic", "other.topic", ""},
+	}
+	for _, c := range cases {
+		kafkaTopic, key := m.ToKafka(c.mqtt, "client-1")
+		if kafkaTopic != c.kafka || key != c.key {
+			t.Errorf("ToKafka(%q) = %q, %q", c.mqtt, kafkaTopic, key)
+		}
+	}
+}
+
+func TestToMQTT(t *testing.T) {
+	m := newTestMapper(t)
+	if name, ok := m.ToMQTT("telemetry", []byte("dev42")); !ok || name != "sensors/dev42/temp" {
+		t.Errorf("unexpected %q %v", name, ok)
+	}
+	if name, ok := m.ToMQTT("device-status", nil); !ok || name != "status" {
+		t.Errorf("unexpected %q %v", name, ok)
+	}
+	if name, ok := m.ToMQTT("other.topic", nil); !ok || name != "other/topic" {
+		t.Errorf("unexpected %q %v", name, ok)
+	}
+	//fleet/#无法由key还原
+	if _, ok := m.ToMQTT("fleet", []byte("client-1")); ok {
+		t.Errorf("fleet should not be reversible")
+	}
+}
+
+func TestConsumes(t *testing.T) {
+	m := newTestMapper(t)
+	cases := []struct {
+		filter, kafka string
+		consumes      bool
+	}{
+		{"sensors/+/temp", "telemetry", true},
+		{"sensors/dev42/#", "telemetry", true},
+		{"sensors/+/humidity", "telemetry", false},
+		{"#", "fleet", true},
+		{"other/+", "other.topic", true},
+		{"other/+", "telemetry", false},
+	}
+	for _, c := range cases {
+		if m.Consumes(c.filter, c.kafka) != c.consumes {
+			t.Errorf("Consumes(%q, %q) expected %v", c.filter, c.kafka, c.consumes)
+		}
+	}
+}
+
+func TestInvalidMapping(t *testing.T) {
+	if _, err := NewMapper([]config.TopicMapping{{MQTT: "a/#/b", Kafka: "a"}}); err == nil {
+		t.Error("expected invalid filter error")
+	}
+	if _, err := NewMapper([]config.TopicMapping{{MQTT: "a/+", Kafka: "a", Key: "level:x"}}); err == nil {
+		t.Error("expected invalid key error")
+	}
+	if _, err := NewMapper([]config.TopicMapping{{MQTT: "a/+", Kafka: "a", Partition: -1}}); err == nil {
+		t.Error("expected invalid partition error")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	m, err := NewMapper([]config.TopicMapping{{MQTT: "alarms/#", Kafka: "alarms", Partition: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m.Partition("alarms/dev1"); p != 3 {
+		t.Errorf("expected partition 3, got %d", p)
+	}
+	if p := m.Partition("status"); p != 0 {
+		t.Errorf("expected partition 0 without rule, got %d", p)
+	}
+}
@@ -0,0 +1,13 @@
+package metrics
+
+import (
+	"expvar"
+)
+
+//网关运行指标, 通过pprof服务的/debug/vars查看
+var gateway = expvar.NewMap("newgateway")
+
+//累加计数
+func Add(name string, delta int64) {
+	gateway.Add(name, delta)
+}
@@ -24,8 +24,11 @@ type VariableHeader struct {
 	ConnectFlags      *ConnectFlags
 	KeepAliveTimer    int
 	ConnectReturnCode int
+	SessionPresent    int //connack中的会话存在标志, 1表示服务端沿用了之前的会话
 	TopicName         string
-	MessageId         int //要求在一个特定方向（服务器发往客户端为一个方向，客户端发送到服务器端为另一个方向）的通信消息中必须唯一
+	MessageId         int         //要求在一个特定方向（服务器发往客户端为一个方向，客户端发送到服务器端为另一个方向）的通信消息中必须唯一
+	ReasonCode        int         //mqtt5中PUBACK、PUBREC、PUBREL、PUBCOMP、DISCONNECT、AUTH的原因码
+	Properties        *Properties //mqtt5属性
 }
 
 type ConnectFlags struct {
@@ -34,7 +37,7 @@ type ConnectFlags struct {
 	WillRetain   int
 	WillQos      int
 	WillFlag     int
-	CleanSession int //0，表示如果订阅的客户机断线了，要保存为其要推送的消息（QoS为1和QoS为2），若其重新连接时，需将这些消息推送（若客户端长时间不连接，需要设置一个过期值）; 1，断线服务器即清理相关信息，重新连接上来之后，会再次订阅。
+	CleanSession int //mqtt5中为Clean Start; 0，表示如果订阅的客户机断线了，要保存为其要推送的消息（QoS为1和QoS为2），若其重新连接时，需将这些消息推送（若客户端长时间不连接，需要设置一个过期值）; 1，断线服务器即清理相关信息，重新连接上来之后，会再次订阅。
 	Reserved     int
 }
 
@@ -42,10 +45,21 @@ type Payload struct {
 	ClientId          string
 	WillTopic         string
 	WillMessage       string
+	WillProperties    *Properties //mqtt5遗嘱属性
 	UserName          string
 	Password          string
-	SubscribePayload  string
-	SubscribeAckQos   int
-	UnsubscribeTopics string
+	Subscriptions     []*Subscription //subscribe中的主题过滤器列表
+	ReturnCodes       []int           //suback和mqtt5 unsuback中与每个主题过滤器对应的返回码
+	UnsubscribeTopics []string
 	Data              string
 }
+
+//subscribe中的一个主题过滤器及其请求的Qos
+type Subscription struct {
+	TopicFilter string
+	Qos         int
+	//mqtt5订阅选项
+	NoLocal           int
+	RetainAsPublished int
+	RetainHandling    int
+}
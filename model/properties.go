@@ -0,0 +1,43 @@
+package model
+
+//mqtt5属性, 只在协议级别为5时编解码, 指针类型的字段为nil表示未设置
+type Properties struct {
+	PayloadFormatIndicator          *int
+	MessageExpiryInterval           *int
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 string
+	SubscriptionIdentifiers         []int
+	SessionExpiryInterval           *int
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *int
+	AuthenticationMethod            string
+	AuthenticationData              string
+	RequestProblemInformation       *int
+	WillDelayInterval               *int
+	RequestResponseInformation      *int
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *int
+	TopicAliasMaximum               *int
+	TopicAlias                      *int
+	MaximumQos                      *int
+	RetainAvailable                 *int
+	UserProperties                  []*UserProperty
+	MaximumPacketSize               *int
+	WildcardSubscriptionAvailable   *int
+	SubscriptionIdentifierAvailable *int
+	SharedSubscriptionAvailable     *int
+}
+
+//用户属性, 同一个key可以出现多次
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+//返回指向v的指针, 用于设置属性
+func Int(v int) *int {
+	return &v
+}
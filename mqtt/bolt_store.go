@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"errors"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+var sessionBucket = []byte("sessions")
+
+//基于bolt的会话存储, 会话在进程重启后仍然保留
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, errors.New("session store path is empty")
+	}
+	//文件被其它进程占用时不无限等待
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) LoadAll() ([]*Session, error) {
+	var sessions []*Session
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionBucket).ForEach(func(k, v []byte) error {
+			s, err := decodeSession(v)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, s)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (b *BoltStore) Save(s *Session) error {
+	data, err := encodeSession(s)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionBucket).Put([]byte(s.ClientId), data)
+	})
+}
+
+func (b *BoltStore) Delete(clientId string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionBucket).Delete([]byte(clientId))
+	})
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
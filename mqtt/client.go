@@ -3,14 +3,18 @@ package mqtt
 import (
 	"github.com/Shopify/sarama"
 	"net"
+	"newgateway/acl"
 	"newgateway/common"
 	"newgateway/constant"
 	"newgateway/kafka"
 	"newgateway/logger"
+	"newgateway/mapping"
+	"newgateway/metrics"
 	"newgateway/model"
-	"regexp"
+	"newgateway/retain"
+	"newgateway/router"
+	"newgateway/topic"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -21,62 +25,161 @@ type Client struct {
 	Conn net.Conn
 	// 当服务端开始发送数据时进入waiting, 阻止其它goroutine关闭连接
 	Waiting common.Wait
-	//Qos=2的消息
-	Assure sync.Map
 	//Client下的订阅
 	SubscribeMap sync.Map
-	//Assure定时发送的时间间隔
+	//第一次重发PUBREC的时间间隔, 之后每次翻倍, 单位秒
 	Ticker int
+	//重发PUBREC的最大时间间隔, 单位秒, 0表示不限制
+	MaxTicker int
+	//发送给客户端的qos1/qos2消息超过该时间未确认时重发, 单位秒, 0表示只在重连时重发
+	RetryInterval int
 	//Client关闭信号
 	Closing chan bool
 	//Client是否关闭
 	Closed bool
-	//关闭Assure的信号
+	//停止定时重发的信号
 	AssureClosing chan bool
-	//kafka消费
-	Consumer *kafka.Consumer
+	//connect中的客户端id
+	ClientId string
+	//connect中的用户名
+	UserName string
+	//客户端会话, 保存订阅和未确认的消息
+	Session *Session
+	//CONNECT中的协议级别, 决定数据包的编解码方式
+	ProtocolVersion int
+	//mqtt5客户端能同时处理的qos1/qos2消息数量, 0表示不限制
+	ReceiveMaximum int
+	//mqtt5客户端能接收的最大数据包长度, 0表示不限制
+	MaxPacketSize int
+	//mqtt5会话过期时间, 单位秒
+	SessionExpiryInterval int
+	//服务端接受的主题别名最大值, 0表示不接受主题别名
+	TopicAliasMaximum int
+	//服务端接受的mqtt5客户端未完成qos2消息数量, 0表示65535
+	InboundMaximum int
+	//mqtt5扩展认证方法, 为空时没有使用扩展认证, 重新认证时必须相同
+	AuthMethod string
 
-	Buffer        []byte
-	IsBufferEmpty bool
-	BufferOffset  int
+	//遗嘱消息, 没有遗嘱时为nil
+	will *model.MQTTMessage
+	//是否收到了DISCONNECT, 收到后不再发布遗嘱
+	disconnected common.AtomicBool
+	closeOnce    sync.Once
+	//客户端发布时设置的主题别名, 别名 -> 主题, 只在读取数据包的goroutine中访问
+	topicAliases map[int]string
+	//扩展认证中认证器在多轮AUTH之间的状态, 只在读取数据包的goroutine中访问
+	authState string
+	//是否正在重新认证
+	reauthenticating bool
 }
 
 // 关闭客户端连接
 func (c *Client) Close() error {
-	// 等待数据发送完成或超时
-	c.Waiting.WaitWithTimeout(10 * time.Second)
-	//关闭订阅组
-	c.SubscribeMap.Range(func(k, v interface{}) bool {
-		sub := v.(*kafka.Subscriber)
-		go sub.Close()
-		return true
+	//可能同时由handler和会话接管触发, 只关闭一次
+	c.closeOnce.Do(func() {
+		//没有收到DISCONNECT时发布遗嘱, 包括读取出错、keepalive超时、被新连接接管和服务关闭
+		c.publishWill()
+		// 等待数据发送完成或超时
+		c.Waiting.WaitWithTimeout(10 * time.Second)
+		//关闭订阅组, 并保存订阅快照到会话中
+		var (
+			subs []*Subscription
+			wg   sync.WaitGroup
+		)
+		c.SubscribeMap.Range(func(k, v interface{}) bool {
+			sub := v.(*Subscription)
+			subs = append(subs, sub.Snapshot())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sub.Close()
+			}()
+			return true
+		})
+		GetSessionManager().Release(c, subs)
+		//停止定时重发
+		close(c.AssureClosing)
+		//先关闭连接, 让阻塞在发送上的消费结束, 再等待订阅提交完offset
+		c.Conn.Close()
+		wg.Wait()
+		c.Closed = true
 	})
-	//关闭Assure
-	c.AssureClosing <- true
-	c.Conn.Close()
-	if c.Consumer != nil {
-		c.Consumer.Release()
-	}
-	c.Closed = true
 	return nil
 }
 
-func (c *Client) Will(conn *model.MQTTMessage) {
-	if conn.VariableHeader.ConnectFlags.WillFlag == 1 {
-		kafka.Publish(conn.Payload.WillTopic, conn.Payload.WillMessage)
+//恢复持久会话: 按保存的offset重新订阅, 并重发未确认的消息
+func (c *Client) Resume() {
+	s := c.Session
+	s.mu.Lock()
+	subs := make([]*Subscription, 0, len(s.Subscriptions))
+	for _, sub := range s.Subscriptions {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+	for _, sub := range subs {
+		if err := c.subscribeFilter(sub.options(), sub.Offsets); err != nil {
+			logger.Error("resume subscription["+sub.Filter+"] of client["+c.ClientId+"] failed: ", err)
+		}
+	}
+	//按原来的发送顺序重发
+	for _, msg := range s.retransmit(0) {
+		c.Write(msg)
 	}
 }
 
-//处理字节数组
-//func (c *Client) Deal(arr []byte) {
-//	//c.Parse(arr)
-//}
-//
-//func (c *Client) Parse(arr []byte) {
-//}
+//保存CONNECT中的遗嘱消息, 在连接异常断开时发布
+func (c *Client) SetWill(conn *model.MQTTMessage) {
+	flags := conn.VariableHeader.ConnectFlags
+	if flags.WillFlag != 1 {
+		return
+	}
+	if err := topic.ValidateName(conn.Payload.WillTopic); err != nil {
+		logger.Warn("invalid will topic["+conn.Payload.WillTopic+"] of client["+c.ClientId+"]: ", err)
+		return
+	}
+	c.will = publishMessage(conn.Payload.WillTopic, conn.Payload.WillMessage, flags.WillQos, flags.WillRetain)
+	c.will.VariableHeader.Properties = conn.Payload.WillProperties
+}
+
+//与客户端发布的消息一样经过ACL检查和主题映射, 按遗嘱的Qos和Retain发布
+func (c *Client) publishWill() {
+	if c.will == nil || c.disconnected.Get() {
+		return
+	}
+	logger.Info("publishing will of client[" + c.ClientId + "] to topic[" + c.will.VariableHeader.TopicName + "]")
+	if err := c.publish(c.will); err != nil {
+		logger.Error("publish will of client["+c.ClientId+"] failed: ", err)
+	}
+}
+
+//构造写入kafka的消息, 主题经过映射, mqtt元信息写入消息头
+func (c *Client) kafkaMessage(topicName, data string, qos, retain int) *kafka.Message {
+	kafkaTopic, key := mapping.GetMapper().ToKafka(topicName, c.ClientId)
+	return &kafka.Message{
+		Topic:      kafkaTopic,
+		Key:        key,
+		Partition:  mapping.GetMapper().Partition(topicName),
+		Value:      data,
+		MQTTTopic:  topicName,
+		ClientId:   c.ClientId,
+		UserName:   c.UserName,
+		Qos:        qos,
+		Retain:     retain,
+		ReceivedAt: time.Now(),
+	}
+}
+
+//处理解码后的数据包, 并在读取数据包的goroutine中写回响应, 保证响应按请求的顺序发送
+func (c *Client) Deal(msg *model.MQTTMessage) {
+	logger.Debug("receive message type: ", strconv.Itoa(msg.FixedHeader.PackageType))
+	resMsg := c.DealMQTTMessage(msg)
+	if resMsg != nil {
+		c.Write(resMsg)
+	}
+}
 
 func (c *Client) Write(msg *model.MQTTMessage) {
-	resByte := MQTT2ByteArr(msg)
+	resByte := Encode(msg, c.ProtocolVersion)
 	if resByte != nil && len(resByte) > 0 {
 		logger.Debug("return type: ", strconv.Itoa(msg.FixedHeader.PackageType), " return message: ", string(resByte))
 		// 发送数据前先置为waiting状态
@@ -88,71 +191,160 @@ func (c *Client) Write(msg *model.MQTTMessage) {
 	}
 }
 
-//针对publish qos=2的消息,启动轮询发送确保的消息
+//针对publish qos=2的消息,启动轮询按退避间隔重发PUBREC, 并重发超时未确认的消息
 func (c *Client) Tick() {
-	tick := time.Tick(time.Duration(c.Ticker) * time.Second)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	interval := time.Duration(c.Ticker) * time.Second
+	maxInterval := time.Duration(c.MaxTicker) * time.Second
+	retry := time.Duration(c.RetryInterval) * time.Second
 	for {
 		select {
-		case <-tick:
-			c.Assure.Range(func(key, value interface{}) bool {
-				msg := value.(*model.MQTTMessage)
-				go c.Write(msg)
-				return true
-			})
+		case <-tick.C:
+			if interval > 0 {
+				for _, msg := range c.Session.resendReceived(interval, maxInterval) {
+					c.Write(msg)
+				}
+			}
+			if retry > 0 {
+				for _, msg := range c.Session.retransmit(retry) {
+					logger.Debug("retransmit message ", strconv.Itoa(msg.VariableHeader.MessageId), " to client[", c.ClientId, "]")
+					c.Write(msg)
+				}
+			}
 		case <-c.AssureClosing:
 			return
 		}
 	}
 }
 
-//取消订阅
-func (c *Client) Unsubscribe(topicName string) {
-	val, ok := c.SubscribeMap.Load(topicName)
+//取消订阅, 主题过滤器需与订阅时完全一致
+func (c *Client) Unsubscribe(filter string) {
+	val, ok := c.SubscribeMap.Load(filter)
 	if !ok {
 		return
 	}
-	sub := val.(*kafka.Subscriber)
+	sub := val.(*Subscription)
 	sub.Close()
-	logger.Debug(time.Now(), "unsubscribed topic["+topicName+"]")
-	c.SubscribeMap.Delete(topicName)
-}
-
-//订阅
-func (c *Client) Subscribe(s *kafka.Subscriber, msg *model.MQTTMessage) {
-	c.SubscribeMap.Store(s.Topic, s)
-	count := 0
-	for _, pc := range (s.PcList) {
-		go func(sarama.PartitionConsumer) {
-			//Messages()该方法返回一个消费消息类型的只读通道，由代理产生
-			for message := range pc.Messages() {
-				//fmt.Printf("%s---Partition:%d, Offset:%d, Key:%s, Value:%s\n", msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value))
-				arr := message.Value
-				pub := &model.MQTTMessage{
-					FixedHeader: &model.FixedHeader{
-						PackageType: constant.MQTT_MSG_TYPE_PUBLISH,
-						SpecificToken: &model.SpecificToken{
-							DUP:    0,
-							Qos:    msg.Payload.SubscribeAckQos,
-							Retain: 0,
-						},
-						RemainingLength: 2 + len(msg.Payload.SubscribePayload) + len(arr),
-					},
-					VariableHeader: &model.VariableHeader{
-						TopicName: msg.Payload.SubscribePayload,
-						MessageId: count,
-					},
-					Payload: &model.Payload{
-						Data: string(arr),
-					},
-				}
-				if msg.Payload.SubscribeAckQos > 0 {
-					pub.FixedHeader.RemainingLength += 2
-				}
-				count++
-				go c.Write(pub)
+	logger.Debug(time.Now(), "unsubscribed topic["+filter+"]")
+	c.SubscribeMap.Delete(filter)
+	c.Session.removeSubscription(filter)
+}
+
+//提交kafka消费位置, 由router.Subscriber和kafka.SharedSubscriber实现
+type offsetCommitter interface {
+	Deliver(message *sarama.ConsumerMessage)
+	Ack(message *sarama.ConsumerMessage)
+}
+
+//共享订阅, 只接收kafka分配给该成员的分区中的消息
+func (c *Client) SubscribeShared(s *kafka.SharedSubscriber, sub *Subscription) {
+	go c.consume(s.Messages(), s, sub)
+}
+
+func (c *Client) consume(messages <-chan *sarama.ConsumerMessage, committer offsetCommitter, sub *Subscription) {
+	for message := range messages {
+		committer.Deliver(message)
+		//还原消息对应的mqtt主题, 并过滤掉与订阅不匹配的消息
+		topicName := router.MQTTTopic(message)
+		if !topic.Match(sub.topicFilter, topicName) || !c.deliverable(sub, message) {
+			//记录下一条要消费的位置, 会话恢复时从这里继续
+			sub.SetOffset(message.Topic, message.Partition, message.Offset+1)
+			committer.Ack(message)
+			continue
+		}
+		retainFlag := 0
+		if sub.RetainAsPublished {
+			if v, _ := kafka.Header(message, kafka.HeaderRetain); v == "1" {
+				retainFlag = 1
 			}
-		}(pc)
+		}
+		pub := publishMessage(topicName, string(message.Value), deliveryQos(sub.Qos, message), retainFlag)
+		if c.v5() {
+			pub.VariableHeader.Properties = messageProperties(message)
+		}
+		//按分区顺序发送, 客户端关闭时停止消费, 未发送的消息在会话恢复后重新消费
+		//客户端确认后提交kafka消费位置
+		m := message
+		if !c.deliver(pub, func() { committer.Ack(m) }) {
+			return
+		}
+		sub.SetOffset(message.Topic, message.Partition, message.Offset+1)
+	}
+}
+
+//以订阅和原消息中较小的Qos发送, 没有Qos消息头的kafka消息按订阅的Qos发送
+func deliveryQos(qos int, message *sarama.ConsumerMessage) int {
+	v, ok := kafka.Header(message, kafka.HeaderQos)
+	if !ok {
+		return qos
+	}
+	published, err := strconv.Atoi(v)
+	if err != nil || published < 0 {
+		logger.Warn("invalid qos header[" + v + "] of message from topic[" + message.Topic + "]")
+		return qos
+	}
+	if published < qos {
+		return published
+	}
+	return qos
+}
+
+//构造发送给客户端的PUBLISH消息, qos>0时报文标识符在发送时分配
+func publishMessage(topicName, data string, qos, retain int) *model.MQTTMessage {
+	pub := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType: constant.MQTT_MSG_TYPE_PUBLISH,
+			SpecificToken: &model.SpecificToken{
+				DUP:    0,
+				Qos:    qos,
+				Retain: retain,
+			},
+			RemainingLength: 2 + len(topicName) + len(data),
+		},
+		VariableHeader: &model.VariableHeader{
+			TopicName: topicName,
+		},
+		Payload: &model.Payload{
+			Data: data,
+		},
+	}
+	if qos > 0 {
+		pub.FixedHeader.RemainingLength += 2
 	}
+	return pub
+}
+
+//发送消息给客户端, qos1/qos2消息在发送窗口已满时等待客户端确认
+//ack在客户端确认收到后调用, qos0消息在发送后调用, 可以为nil; 客户端关闭时返回false
+func (c *Client) deliver(pub *model.MQTTMessage, ack func()) bool {
+	//超过客户端能接收的最大长度的消息直接丢弃
+	if c.MaxPacketSize > 0 && len(Encode(pub, c.ProtocolVersion)) > c.MaxPacketSize {
+		logger.Warn("message of topic[" + pub.VariableHeader.TopicName + "] exceeds maximum packet size of client[" + c.ClientId + "], dropped")
+		metrics.Add("publish.dropped.too_large", 1)
+		if ack != nil {
+			ack()
+		}
+		return true
+	}
+	if pub.FixedHeader.SpecificToken.Qos > 0 {
+		if !c.Session.acquireWindow(c.AssureClosing) {
+			return false
+		}
+		//等待客户端确认, 超时或断线重连后重发
+		if err := c.Session.allocateInflight(pub, ack); err != nil {
+			logger.Error("deliver message to client["+c.ClientId+"] failed: ", err)
+			c.Session.releaseWindow()
+			return false
+		}
+		c.Write(pub)
+		return true
+	}
+	c.Write(pub)
+	if ack != nil {
+		ack()
+	}
+	return true
 }
 
 //处理业务逻辑并返回
@@ -163,26 +355,70 @@ func (cli *Client) DealMQTTMessage(msg *model.MQTTMessage) *model.MQTTMessage {
 		retMsg = cli.dealDisconnect(msg)
 	case constant.MQTT_MSG_TYPE_PUBLISH: //publish
 		retMsg = cli.dealPublish(msg)
+	case constant.MQTT_MSG_TYPE_PUBACK: //puback
+		cli.dealPuback(msg)
+	case constant.MQTT_MSG_TYPE_PUBREC: //pubrec
+		retMsg = cli.dealPubrec(msg)
 	case constant.MQTT_MSG_TYPE_PUBREL: //pubrel
 		retMsg = cli.dealPubrel(msg)
+	case constant.MQTT_MSG_TYPE_PUBCOMP: //pubcomp
+		cli.dealPubcomp(msg)
 	case constant.MQTT_MSG_TYPE_SUBSCRIBE: //subscribe
 		retMsg = cli.dealSubscribe(msg)
 	case constant.MQTT_MSG_TYPE_UNSUBSCRIBE: //unsubscribe
 		retMsg = cli.dealUnsubscribe(msg)
 	case constant.MQTT_MSG_TYPE_PINGREQ: //pingreq
 		retMsg = cli.dealPing(msg)
+	case constant.MQTT_MSG_TYPE_AUTH: //auth
+		retMsg = cli.dealAuth(msg)
 	}
 	return retMsg
 }
 
+//发布消息到kafka, qos0加入异步发布队列, qos>0时同步发布, retain=1时在发布成功后更新保留消息
+//无权限发布的消息直接丢弃并返回ErrNotAuthorized
+func (cli *Client) publish(msg *model.MQTTMessage) error {
+	if !cli.authorize(acl.AccessPublish, msg.VariableHeader.TopicName) {
+		logger.Warn("client["+cli.ClientId+"] is not allowed to publish topic["+msg.VariableHeader.TopicName+"], message dropped")
+		metrics.Add("acl.publish.denied", 1)
+		return ErrNotAuthorized
+	}
+	token := msg.FixedHeader.SpecificToken
+	kafkaMsg := cli.kafkaMessage(msg.VariableHeader.TopicName, msg.Payload.Data, token.Qos, token.Retain)
+	setMessageProperties(kafkaMsg, msg.VariableHeader.Properties)
+	if token.Qos == 0 {
+		//在读取数据包的goroutine中加入发布队列, 队列已满时按overflow配置阻塞读取或丢弃
+		if token.Retain == 1 {
+			//保留消息写入kafka时会同步发布, 不能阻塞管道处理发布结果, 交给保留消息的写入队列按顺序处理
+			kafkaMsg.Callback = func(err error) {
+				if err == nil {
+					retain.GetStore().RetainAsync(retainMessage(msg))
+				}
+			}
+		}
+		return kafka.AsyncPublish(kafkaMsg)
+	}
+	if _, _, err := kafka.Publish(kafkaMsg); err != nil {
+		return err
+	}
+	if token.Retain == 1 {
+		cli.retain(msg)
+	}
+	return nil
+}
+
 //Publish
 func (cli *Client) dealPublish(msg *model.MQTTMessage) *model.MQTTMessage {
-	//发布消息
-	//产生返回值
+	//mqtt5主题别名
+	if code := cli.resolveTopicAlias(msg); code != constant.MQTT_REASON_SUCCESS {
+		cli.Disconnect(code)
+		return nil
+	}
+	//产生返回值, 无权限发布的消息仍按Qos返回确认, 避免客户端重发, mqtt5在原因码中说明
 	switch msg.FixedHeader.SpecificToken.Qos {
 	case 1:
-		_, _, err := kafka.Publish(msg.VariableHeader.TopicName, msg.Payload.Data)
-		if err != nil {
+		code, ok := cli.publishReason(cli.publish(msg))
+		if !ok {
 			//TODO
 			return nil
 		}
@@ -193,12 +429,24 @@ func (cli *Client) dealPublish(msg *model.MQTTMessage) *model.MQTTMessage {
 				RemainingLength: 2,
 			},
 			VariableHeader: &model.VariableHeader{
-				MessageId: msg.VariableHeader.MessageId,
+				MessageId:  msg.VariableHeader.MessageId,
+				ReasonCode: code,
 			},
 		}
 	case 2:
-		_, _, err := kafka.Publish(msg.VariableHeader.TopicName, msg.Payload.Data)
-		if err != nil {
+		//客户端在收到PUBREC之前重发的消息, 只返回PUBREC而不重复发布
+		if pubrec, ok := cli.Session.received(msg.VariableHeader.MessageId); ok {
+			logger.Debug("duplicate qos2 message ", strconv.Itoa(msg.VariableHeader.MessageId), " from client[", cli.ClientId, "]")
+			return pubrec
+		}
+		//mqtt5客户端未完成的qos2消息超过了CONNACK中的Receive Maximum
+		if cli.v5() && cli.Session.receivedCount() >= cli.receiveLimit() {
+			logger.Warn("client[" + cli.ClientId + "] exceeded receive maximum")
+			cli.Disconnect(constant.MQTT_REASON_RECEIVE_MAXIMUM_EXCEEDED)
+			return nil
+		}
+		code, ok := cli.publishReason(cli.publish(msg))
+		if !ok {
 			//TODO
 			return nil
 		}
@@ -209,68 +457,193 @@ func (cli *Client) dealPublish(msg *model.MQTTMessage) *model.MQTTMessage {
 				RemainingLength: 2,
 			},
 			VariableHeader: &model.VariableHeader{
-				MessageId: msg.VariableHeader.MessageId,
+				MessageId:  msg.VariableHeader.MessageId,
+				ReasonCode: code,
 			},
 		}
-		cli.Assure.Store(msg.VariableHeader.MessageId, pubrec)
+		//mqtt5中原因码表示失败的PUBREC结束qos2流程, 不再等待PUBREL
+		if code < constant.MQTT_REASON_UNSPECIFIED_ERROR {
+			cli.Session.storeReceived(pubrec)
+		}
 		return pubrec
 	default:
-		go kafka.AsyncPublish(msg.VariableHeader.TopicName, msg.Payload.Data)
+		cli.publish(msg)
 		return nil
 	}
 }
 
+//PUBLISH对应的保留消息
+func retainMessage(msg *model.MQTTMessage) *retain.Message {
+	return &retain.Message{
+		Topic:    msg.VariableHeader.TopicName,
+		Payload:  msg.Payload.Data,
+		Qos:      msg.FixedHeader.SpecificToken.Qos,
+		ExpireAt: expireAt(msg.VariableHeader.Properties),
+	}
+}
+
+//更新主题的保留消息, payload为空时清除
+func (cli *Client) retain(msg *model.MQTTMessage) {
+	if err := retain.GetStore().Retain(retainMessage(msg)); err != nil {
+		logger.Error("retain message of topic["+msg.VariableHeader.TopicName+"] failed: ", err)
+	}
+}
+
+//检查ACL
+func (cli *Client) authorize(access acl.Access, name string) bool {
+	return acl.GetACL().Authorize(cli.ClientId, cli.UserName, cli.Conn.RemoteAddr(), access, name)
+}
+
 //Subscribe
 func (cli *Client) dealSubscribe(msg *model.MQTTMessage) *model.MQTTMessage {
-	//订阅
-	if cli.Consumer == nil {
-		c := kafka.GetConsumer()
-		if c == nil {
-			return &model.MQTTMessage{}
+	//逐个处理主题过滤器, 每个过滤器对应一个返回码
+	codes := make([]int, 0, len(msg.Payload.Subscriptions))
+	//新订阅匹配的保留消息, 在SUBACK之后发送
+	var retained []*model.MQTTMessage
+	for _, sub := range msg.Payload.Subscriptions {
+		if err := topic.ValidateFilter(sub.TopicFilter); err != nil {
+			logger.Warn("invalid topic filter["+sub.TopicFilter+"]: ", err)
+			codes = append(codes, cli.subackFailure(constant.MQTT_REASON_TOPIC_FILTER_INVALID))
+			continue
 		}
-		cli.Consumer = c
-	}
-	if strings.Index(msg.Payload.SubscribePayload, "*") != -1 {
-		s, err := cli.Consumer.NewSubscribers(msg.Payload.SubscribePayload, 200)
-		if err != nil {
-			logger.Error(err.Error())
-			return &model.MQTTMessage{}
+		_, topicFilter, shared := topic.ParseShared(sub.TopicFilter)
+		//mqtt5不允许在共享订阅上设置No Local
+		if shared && sub.NoLocal == 1 {
+			logger.Warn("client[" + cli.ClientId + "] set no local on shared subscription[" + sub.TopicFilter + "]")
+			cli.Disconnect(constant.MQTT_REASON_PROTOCOL_ERROR)
+			return nil
 		}
-		for _, sub := range (s) {
-			go cli.Subscribe(sub, msg)
+		if !cli.authorize(acl.AccessSubscribe, topicFilter) {
+			logger.Warn("client[" + cli.ClientId + "] is not allowed to subscribe topic[" + sub.TopicFilter + "]")
+			metrics.Add("acl.subscribe.denied", 1)
+			codes = append(codes, cli.subackFailure(constant.MQTT_REASON_NOT_AUTHORIZED))
+			continue
 		}
-	} else {
-		s, err := cli.Consumer.NewSubscriber(msg.Payload.SubscribePayload, 200)
-		if err != nil {
-			logger.Error(err.Error())
-			return &model.MQTTMessage{}
+		_, existed := cli.SubscribeMap.Load(sub.TopicFilter)
+		if err := cli.subscribeFilter(sub, nil); err != nil {
+			logger.Error("subscribe topic["+sub.TopicFilter+"] failed: ", err)
+			codes = append(codes, constant.MQTT_SUBACK_RETURN_CODE_FAILURE)
+			continue
+		}
+		codes = append(codes, sub.Qos)
+		//mqtt5 Retain Handling: 1只在新订阅时发送保留消息, 2不发送; 共享订阅不发送保留消息
+		if shared || sub.RetainHandling == 2 || (sub.RetainHandling == 1 && existed) {
+			continue
+		}
+		for _, r := range retain.GetStore().Match(sub.TopicFilter) {
+			//以保留消息和订阅中较小的Qos发送
+			qos := r.Qos
+			if sub.Qos < qos {
+				qos = sub.Qos
+			}
+			retained = append(retained, publishMessage(r.Topic, r.Payload, qos, 1))
 		}
-		go cli.Subscribe(s, msg)
 	}
 
 	//产生SUBACK消息
-	return &model.MQTTMessage{
+	suback := &model.MQTTMessage{
 		FixedHeader: &model.FixedHeader{
 			PackageType:     constant.MQTT_MSG_TYPE_SUBACK,
-			RemainingLength: 2,
+			RemainingLength: 2 + len(codes),
 		},
 		VariableHeader: &model.VariableHeader{
 			MessageId: msg.VariableHeader.MessageId,
 		},
+		Payload: &model.Payload{
+			ReturnCodes: codes,
+		},
+	}
+	if len(retained) == 0 {
+		return suback
+	}
+	//先写回SUBACK, 保留消息的发送可能等待发送窗口, 不能阻塞读取
+	cli.Write(suback)
+	go func() {
+		for _, pub := range retained {
+			if !cli.deliver(pub, nil) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//订阅单个主题过滤器, 已存在的相同过滤器会被替换
+//offsets为恢复会话时各kafka topic分区的消费位置, 新订阅时为nil
+//非共享订阅都由路由转发, 不单独消费kafka, 持久会话的订阅由路由从记录的位置补发离线期间的消息
+func (cli *Client) subscribeFilter(sub *model.Subscription, offsets map[string]map[int32]int64) error {
+	group, topicFilter, shared := topic.ParseShared(sub.TopicFilter)
+	s := &Subscription{
+		Filter:            sub.TopicFilter,
+		Qos:               sub.Qos,
+		NoLocal:           sub.NoLocal == 1,
+		RetainAsPublished: sub.RetainAsPublished == 1,
+		Offsets:           offsets,
+		topicFilter:       topicFilter,
+	}
+	kafkaTopic, _ := mapping.GetMapper().ToKafka(topicFilter, cli.ClientId)
+	match := func(name string) bool {
+		if topic.HasWildcard(topicFilter) {
+			return mapping.GetMapper().Consumes(topicFilter, name)
+		}
+		return name == kafkaTopic
+	}
+	switch {
+	case shared:
+		//共享订阅从消费组提交的位置继续, 不使用会话中记录的位置
+		subscriber, err := kafka.NewSharedSubscriber(kafka.SharedGroup(group, topicFilter), match, 200)
+		if err != nil {
+			return err
+		}
+		s.Shared = subscriber
+	case cli.Session.isPersistent():
+		//已确认的位置提交到客户端的消费组, 使离线期间的消息在重连后继续投递
+		subscriber, err := router.GetRouter().SubscribePersistent(topicFilter, sub.Qos, match, kafka.ClientGroup(cli.ClientId), offsets)
+		if err != nil {
+			return err
+		}
+		s.Routed = subscriber
+	default:
+		subscriber, err := router.GetRouter().Subscribe(topicFilter, sub.Qos, match)
+		if err != nil {
+			return err
+		}
+		s.Routed = subscriber
+	}
+	cli.Unsubscribe(sub.TopicFilter)
+	cli.SubscribeMap.Store(sub.TopicFilter, s)
+	cli.Session.storeSubscription(s.Snapshot())
+	if s.Shared != nil {
+		cli.SubscribeShared(s.Shared, s)
+	}
+	if s.Routed != nil {
+		go cli.consume(s.Routed.Messages(), s.Routed, s)
+		go cli.watchOverflow(s.Routed)
+	}
+	return nil
+}
+
+//路由中的订阅因为客户端接收太慢被关闭时断开连接
+func (cli *Client) watchOverflow(s *router.Subscriber) {
+	<-s.Done()
+	if s.Overflowed() {
+		logger.Warn("client[" + cli.ClientId + "] is too slow to receive messages of subscription[" + s.Filter + "]")
+		cli.Disconnect(constant.MQTT_REASON_QUOTA_EXCEEDED)
 	}
 }
 
 //Unsubscribe
 func (cli *Client) dealUnsubscribe(msg *model.MQTTMessage) *model.MQTTMessage {
-	//删除订阅
-	for _, topic := range (strings.Split(msg.Payload.UnsubscribeTopics, ",")) {
-		cli.SubscribeMap.Range(func(key, val interface{}) bool {
-			if match, err := regexp.Match(topic, []byte(key.(string))); err == nil && match {
-				logger.Debug(time.Now(), " unsubscribing topic["+key.(string)+"]")
-				go cli.Unsubscribe(key.(string))
-			}
-			return true
-		})
+	//删除订阅, mqtt5对每个过滤器返回原因码
+	codes := make([]int, 0, len(msg.Payload.UnsubscribeTopics))
+	for _, filter := range msg.Payload.UnsubscribeTopics {
+		logger.Debug(time.Now(), " unsubscribing topic["+filter+"]")
+		code := constant.MQTT_REASON_SUCCESS
+		if _, ok := cli.SubscribeMap.Load(filter); !ok {
+			code = constant.MQTT_REASON_NO_SUBSCRIPTION_EXISTED
+		}
+		codes = append(codes, code)
+		cli.Unsubscribe(filter)
 	}
 	//产生UNSUBACK消息
 	res := &model.MQTTMessage{
@@ -281,6 +654,9 @@ func (cli *Client) dealUnsubscribe(msg *model.MQTTMessage) *model.MQTTMessage {
 		VariableHeader: &model.VariableHeader{
 			MessageId: msg.VariableHeader.MessageId,
 		},
+		Payload: &model.Payload{
+			ReturnCodes: codes,
+		},
 	}
 	return res
 }
@@ -296,10 +672,43 @@ func (cli *Client) dealPing(msg *model.MQTTMessage) *model.MQTTMessage {
 	}
 }
 
+//Puback 客户端对qos1消息的确认
+func (cli *Client) dealPuback(msg *model.MQTTMessage) {
+	if !cli.Session.ackInflight(msg.VariableHeader.MessageId, constant.MQTT_MSG_TYPE_PUBACK) {
+		logger.Warn("client[" + cli.ClientId + "] acknowledged unknown message " + strconv.Itoa(msg.VariableHeader.MessageId))
+	}
+}
+
+//Pubrec 客户端收到qos2消息, 返回PUBREL
+func (cli *Client) dealPubrec(msg *model.MQTTMessage) *model.MQTTMessage {
+	//mqtt5客户端拒绝了消息, qos2流程结束
+	if msg.VariableHeader.ReasonCode >= constant.MQTT_REASON_UNSPECIFIED_ERROR {
+		cli.Session.ackInflight(msg.VariableHeader.MessageId, constant.MQTT_MSG_TYPE_PUBREC)
+		return nil
+	}
+	pubrel, ok := cli.Session.pubrec(msg.VariableHeader.MessageId)
+	if !ok {
+		//未知的报文标识符仍返回PUBREL, 使客户端能结束该消息的流程
+		logger.Warn("client[" + cli.ClientId + "] received unknown message " + strconv.Itoa(msg.VariableHeader.MessageId))
+		pubrel.VariableHeader.ReasonCode = constant.MQTT_REASON_PACKET_IDENTIFIER_NOT_FOUND
+	}
+	return pubrel
+}
+
+//Pubcomp 客户端对PUBREL的确认, qos2消息发送完成
+func (cli *Client) dealPubcomp(msg *model.MQTTMessage) {
+	if !cli.Session.ackInflight(msg.VariableHeader.MessageId, constant.MQTT_MSG_TYPE_PUBCOMP) {
+		logger.Warn("client[" + cli.ClientId + "] completed unknown message " + strconv.Itoa(msg.VariableHeader.MessageId))
+	}
+}
+
 //Pubrel publish端发过来的Pubrec消息的返回
 func (cli *Client) dealPubrel(msg *model.MQTTMessage) *model.MQTTMessage {
 	//处理Pubrel消息
-	cli.Assure.Delete(msg.VariableHeader.MessageId)
+	code := constant.MQTT_REASON_SUCCESS
+	if !cli.Session.removeReceived(msg.VariableHeader.MessageId) {
+		code = constant.MQTT_REASON_PACKET_IDENTIFIER_NOT_FOUND
+	}
 	//产生一条Pubcomp消息
 	return &model.MQTTMessage{
 		FixedHeader: &model.FixedHeader{
@@ -307,13 +716,23 @@ func (cli *Client) dealPubrel(msg *model.MQTTMessage) *model.MQTTMessage {
 			RemainingLength: 2,
 		},
 		VariableHeader: &model.VariableHeader{
-			MessageId: msg.VariableHeader.MessageId,
+			MessageId:  msg.VariableHeader.MessageId,
+			ReasonCode: code,
 		},
 	}
 }
 
 //Disconnect
 func (cli *Client) dealDisconnect(msg *model.MQTTMessage) *model.MQTTMessage {
+	//正常断开, 丢弃遗嘱; mqtt5原因码0x04表示仍然发布遗嘱
+	if header := msg.VariableHeader; header != nil {
+		cli.updateSessionExpiry(header.Properties)
+		if header.ReasonCode != constant.MQTT_REASON_DISCONNECT_WITH_WILL {
+			cli.disconnected.Set(true)
+		}
+	} else {
+		cli.disconnected.Set(true)
+	}
 	//断开连接
 	cli.Closing <- true
 	//产生一条空消息
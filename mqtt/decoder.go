@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"newgateway/model"
+)
+
+// 协议允许的最大剩余长度(4个字节的变长编码)
+const MaxRemainingLength = 268435455
+
+var (
+	// 剩余长度超过4个字节
+	ErrMalformedRemainingLength = errors.New("mqtt: malformed remaining length")
+	// 数据包超过允许的最大长度
+	ErrPacketTooLarge = errors.New("mqtt: packet too large")
+	// 数据包内容与声明的长度或格式不符
+	ErrMalformedPacket = errors.New("mqtt: malformed packet")
+	// 未知或保留的数据包类型
+	ErrUnknownPacketType = errors.New("mqtt: unknown packet type")
+)
+
+// 解码失败时返回的错误, 携带出错的数据包类型
+type DecodeError struct {
+	PackageType int
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode packet type %d: %v", e.PackageType, e.Err)
+}
+
+// 从字节流中按MQTT帧格式读取完整的数据包
+// 一个数据包被拆分到多次读取, 或多个数据包在一次读取中到达, 都能被正确还原
+type Decoder struct {
+	reader *bufio.Reader
+	// 允许的最大剩余长度, 0表示使用协议上限
+	MaxPacketSize int
+	// 连接的协议级别, 收到CONNECT后设置, 为5时按mqtt5解析原因码和属性
+	ProtocolVersion int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Decoder{
+		reader: reader,
+	}
+}
+
+// 读取并解析下一个数据包, 在数据包完整到达之前阻塞
+// 连接在数据包边界处关闭时返回io.EOF, 在数据包中间关闭时返回io.ErrUnexpectedEOF
+func (d *Decoder) Decode() (*model.MQTTMessage, error) {
+	first, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	remainingLength, err := d.readRemainingLength()
+	if err != nil {
+		return nil, err
+	}
+	maxSize := d.MaxPacketSize
+	if maxSize <= 0 || maxSize > MaxRemainingLength {
+		maxSize = MaxRemainingLength
+	}
+	if remainingLength > maxSize {
+		return nil, &DecodeError{PackageType: int(first) >> 4, Err: ErrPacketTooLarge}
+	}
+	body := make([]byte, remainingLength)
+	if _, err := io.ReadFull(d.reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return ParsePacket(first, body, d.ProtocolVersion)
+}
+
+//解析变长编码的剩余长度
+func (d *Decoder) readRemainingLength() (int, error) {
+	length := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		b, err := d.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		length += int(b&127) * multiplier
+		if b&128 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedRemainingLength
+}
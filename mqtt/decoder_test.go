@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"newgateway/constant"
+	"testing"
+)
+
+//每次只返回一个字节, 模拟被拆分到多个tcp分段的数据包
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+var (
+	connectPacket = []byte{
+		0x10, 0x12,
+		0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c,
+		0x00, 0x06, 'd', 'e', 'v', '-', '4', '2',
+	}
+	publishPacket = []byte{
+		0x32, 0x0c,
+		0x00, 0x03, 'a', '/', 'b', 0x00, 0x07, 'h', 'e', 'l', 'l', 'o',
+	}
+	pingPacket = []byte{0xc0, 0x00}
+)
+
+func TestDecodeSplitPacket(t *testing.T) {
+	d := NewDecoder(&oneByteReader{data: connectPacket})
+	msg, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.FixedHeader.PackageType != constant.MQTT_MSG_TYPE_CONNECT {
+		t.Fatalf("unexpected type %d", msg.FixedHeader.PackageType)
+	}
+	if msg.Payload.ClientId != "dev-42" || msg.VariableHeader.KeepAliveTimer != 60 {
+		t.Fatalf("unexpected connect %+v %+v", msg.VariableHeader, msg.Payload)
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestDecodeCoalescedPackets(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(publishPacket)
+	buf.Write(pingPacket)
+	buf.Write(publishPacket)
+	d := NewDecoder(&buf)
+
+	types := []int{constant.MQTT_MSG_TYPE_PUBLISH, constant.MQTT_MSG_TYPE_PINGREQ, constant.MQTT_MSG_TYPE_PUBLISH}
+	for _, typ := range types {
+		msg, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.FixedHeader.PackageType != typ {
+			t.Fatalf("expected type %d, got %d", typ, msg.FixedHeader.PackageType)
+		}
+		if typ == constant.MQTT_MSG_TYPE_PUBLISH {
+			if msg.VariableHeader.TopicName != "a/b" || msg.VariableHeader.MessageId != 7 || msg.Payload.Data != "hello" {
+				t.Fatalf("unexpected publish %+v %+v", msg.VariableHeader, msg.Payload)
+			}
+		}
+	}
+}
+
+func TestDecodeTruncatedPacket(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(publishPacket[:6]))
+	if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	//剩余长度超过4个字节
+	d := NewDecoder(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}))
+	if _, err := d.Decode(); err != ErrMalformedRemainingLength {
+		t.Fatalf("expected ErrMalformedRemainingLength, got %v", err)
+	}
+
+	//topic长度超出数据包
+	d = NewDecoder(bytes.NewReader([]byte{0x30, 0x03, 0x00, 0x09, 'a'}))
+	_, err := d.Decode()
+	if e, ok := err.(*DecodeError); !ok || e.Err != ErrMalformedPacket {
+		t.Fatalf("expected malformed packet, got %v", err)
+	}
+
+	//超过允许的最大长度
+	d = NewDecoder(bytes.NewReader(publishPacket))
+	d.MaxPacketSize = 4
+	_, err = d.Decode()
+	if e, ok := err.(*DecodeError); !ok || e.Err != ErrPacketTooLarge {
+		t.Fatalf("expected packet too large, got %v", err)
+	}
+}
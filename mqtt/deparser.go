@@ -5,79 +5,159 @@ import (
 	"newgateway/model"
 )
 
+//按mqtt3.1.1编码数据包
 func MQTT2ByteArr(msg *model.MQTTMessage) []byte {
-	arr := make([]byte, 0)
-	//固定头
-	arr = appendFixedHeader(msg, arr)
+	return Encode(msg, constant.MQTT_PROTOCOL_LEVEL_311)
+}
+
+//按连接的协议级别编码数据包, 剩余长度根据编码后的可变头和payload计算
+func Encode(msg *model.MQTTMessage, version int) []byte {
+	if msg.FixedHeader == nil {
+		return []byte{}
+	}
+	v5 := version == constant.MQTT_PROTOCOL_LEVEL_5
+	body := make([]byte, 0)
 	//可变头
-	arr = appendVariableHeader(msg, arr)
+	body = appendVariableHeader(msg, body, v5)
 	//payload
-	arr = appendPayload(msg, arr)
-	return arr
+	body = appendPayload(msg, body, v5)
+	//固定头
+	arr := appendFixedHeader(msg, make([]byte, 0, len(body)+5), len(body))
+	return append(arr, body...)
 }
 
 //创建固定头
-func appendFixedHeader(msg *model.MQTTMessage, arr []byte) []byte {
-	if msg.FixedHeader != nil {
-		//消息类型
-		arr = append(arr, byte(msg.FixedHeader.PackageType<<4))
-		//剩余长度
-		x := msg.FixedHeader.RemainingLength
-		flag := true
-		for ; flag; {
-			flag = x/128 > 0
-			a := x % 128
-			if flag {
-				a += 128
-			}
-			arr = append(arr, byte(a))
-			x /= 128
+func appendFixedHeader(msg *model.MQTTMessage, arr []byte, remainingLength int) []byte {
+	//消息类型和标志位
+	first := byte(msg.FixedHeader.PackageType << 4)
+	switch msg.FixedHeader.PackageType {
+	case constant.MQTT_MSG_TYPE_PUBLISH:
+		if token := msg.FixedHeader.SpecificToken; token != nil {
+			first |= byte(token.DUP<<3 | token.Qos<<1 | token.Retain)
 		}
+	case constant.MQTT_MSG_TYPE_PUBREL, constant.MQTT_MSG_TYPE_SUBSCRIBE, constant.MQTT_MSG_TYPE_UNSUBSCRIBE:
+		first |= 0x02
 	}
-	return arr
+	arr = append(arr, first)
+	//剩余长度
+	return appendVarInt(arr, remainingLength)
 }
 
 //可变头
-func appendVariableHeader(msg *model.MQTTMessage, arr []byte) []byte {
-	if msg.FixedHeader != nil && msg.VariableHeader != nil {
-		switch msg.FixedHeader.PackageType {
-		case constant.MQTT_MSG_TYPE_CONNECTACK:
-			arr = append(arr, byte(0))
-			arr = append(arr, byte(msg.VariableHeader.ConnectReturnCode))
-		case constant.MQTT_MSG_TYPE_PUBLISH:
-			arr = append(arr, byte(0))
-			arr = append(arr, byte(len(msg.VariableHeader.TopicName)))
-			arr = appendArray(arr, []byte(msg.VariableHeader.TopicName))
-			if msg.FixedHeader.SpecificToken.Qos > 0 {
-				msgInt := int(msg.VariableHeader.MessageId)
-				arr = append(arr, byte(msgInt>>8))
-				arr = append(arr, byte(msgInt))
-			}
-		case constant.MQTT_MSG_TYPE_PUBACK, constant.MQTT_MSG_TYPE_PUBREC, constant.MQTT_MSG_TYPE_PUBREL, constant.MQTT_MSG_TYPE_SUBACK, constant.MQTT_MSG_TYPE_UNSUBACK, constant.MQTT_MSG_TYPE_PUBCOMP:
-			msgInt := int(msg.VariableHeader.MessageId)
-			arr = append(arr, byte(msgInt>>8))
-			arr = append(arr, byte(msgInt))
+func appendVariableHeader(msg *model.MQTTMessage, arr []byte, v5 bool) []byte {
+	header := msg.VariableHeader
+	if header == nil {
+		return arr
+	}
+	switch msg.FixedHeader.PackageType {
+	case constant.MQTT_MSG_TYPE_CONNECT:
+		arr = appendString(arr, header.ProtocolName)
+		arr = append(arr, byte(header.ProtocolVersion))
+		arr = append(arr, connectFlagsByte(header.ConnectFlags))
+		arr = appendUint16(arr, header.KeepAliveTimer)
+		if v5 {
+			arr = appendProperties(arr, header.Properties)
+		}
+	case constant.MQTT_MSG_TYPE_CONNECTACK:
+		//连接确认标志, 最低位为session present
+		arr = append(arr, byte(header.SessionPresent&1))
+		arr = append(arr, byte(header.ConnectReturnCode))
+		if v5 {
+			arr = appendProperties(arr, header.Properties)
+		}
+	case constant.MQTT_MSG_TYPE_PUBLISH:
+		arr = appendString(arr, header.TopicName)
+		if msg.FixedHeader.SpecificToken.Qos > 0 {
+			arr = appendUint16(arr, header.MessageId)
+		}
+		if v5 {
+			arr = appendProperties(arr, header.Properties)
+		}
+	case constant.MQTT_MSG_TYPE_PUBACK, constant.MQTT_MSG_TYPE_PUBREC, constant.MQTT_MSG_TYPE_PUBREL, constant.MQTT_MSG_TYPE_PUBCOMP:
+		arr = appendUint16(arr, header.MessageId)
+		if v5 {
+			arr = appendReason(arr, header)
+		}
+	case constant.MQTT_MSG_TYPE_SUBSCRIBE, constant.MQTT_MSG_TYPE_SUBACK, constant.MQTT_MSG_TYPE_UNSUBSCRIBE, constant.MQTT_MSG_TYPE_UNSUBACK:
+		arr = appendUint16(arr, header.MessageId)
+		if v5 {
+			arr = appendProperties(arr, header.Properties)
+		}
+	case constant.MQTT_MSG_TYPE_DISCONNECT, constant.MQTT_MSG_TYPE_AUTH:
+		if v5 {
+			arr = appendReason(arr, header)
 		}
 	}
 	return arr
 }
 
-//正文
-func appendPayload(msg *model.MQTTMessage, arr []byte) []byte {
-	if msg.FixedHeader != nil && msg.Payload != nil {
-		switch msg.FixedHeader.PackageType {
-		case constant.MQTT_MSG_TYPE_PUBLISH:
-			arr = appendArray(arr, []byte(msg.Payload.Data))
-		case constant.MQTT_MSG_TYPE_SUBACK:
-			arr = append(arr, byte(msg.Payload.SubscribeAckQos))
-		}
+//写入mqtt5原因码和属性, 原因码为0且没有属性时都省略
+func appendReason(arr []byte, header *model.VariableHeader) []byte {
+	props := encodeProperties(header.Properties)
+	if header.ReasonCode == constant.MQTT_REASON_SUCCESS && len(props) == 0 {
+		return arr
+	}
+	arr = append(arr, byte(header.ReasonCode))
+	if len(props) > 0 {
+		arr = appendVarInt(arr, len(props))
+		arr = append(arr, props...)
 	}
 	return arr
 }
 
-func appendArray(arr, tail []byte) []byte {
-	for _, v := range (tail) {
-		arr = append(arr, v)
+func connectFlagsByte(flags *model.ConnectFlags) byte {
+	if flags == nil {
+		return 0
+	}
+	return byte(flags.UserNameFlag<<7 | flags.PasswordFlag<<6 | flags.WillRetain<<5 |
+		flags.WillQos<<3 | flags.WillFlag<<2 | flags.CleanSession<<1)
+}
+
+//正文
+func appendPayload(msg *model.MQTTMessage, arr []byte, v5 bool) []byte {
+	payload := msg.Payload
+	if payload == nil {
+		return arr
+	}
+	switch msg.FixedHeader.PackageType {
+	case constant.MQTT_MSG_TYPE_CONNECT:
+		flags := msg.VariableHeader.ConnectFlags
+		arr = appendString(arr, payload.ClientId)
+		if flags != nil && flags.WillFlag == 1 {
+			if v5 {
+				arr = appendProperties(arr, payload.WillProperties)
+			}
+			arr = appendString(arr, payload.WillTopic)
+			arr = appendString(arr, payload.WillMessage)
+		}
+		if flags != nil && flags.UserNameFlag == 1 {
+			arr = appendString(arr, payload.UserName)
+		}
+		if flags != nil && flags.PasswordFlag == 1 {
+			arr = appendString(arr, payload.Password)
+		}
+	case constant.MQTT_MSG_TYPE_PUBLISH:
+		arr = append(arr, payload.Data...)
+	case constant.MQTT_MSG_TYPE_SUBSCRIBE:
+		for _, sub := range payload.Subscriptions {
+			arr = appendString(arr, sub.TopicFilter)
+			arr = append(arr, byte(sub.Qos|sub.NoLocal<<2|sub.RetainAsPublished<<3|sub.RetainHandling<<4))
+		}
+	case constant.MQTT_MSG_TYPE_UNSUBSCRIBE:
+		for _, topic := range payload.UnsubscribeTopics {
+			arr = appendString(arr, topic)
+		}
+	case constant.MQTT_MSG_TYPE_SUBACK:
+		for _, code := range payload.ReturnCodes {
+			arr = append(arr, byte(code))
+		}
+	case constant.MQTT_MSG_TYPE_UNSUBACK:
+		//mqtt3的UNSUBACK没有payload
+		if v5 {
+			for _, code := range payload.ReturnCodes {
+				arr = append(arr, byte(code))
+			}
+		}
 	}
 	return arr
 }
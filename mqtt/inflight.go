@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"newgateway/constant"
+	"newgateway/model"
+	"sort"
+	"time"
+)
+
+//已发送给客户端但还未确认的消息
+//qos1消息和未收到PUBREC的qos2消息保存PUBLISH, 收到PUBREC的qos2消息保存PUBREL
+type InflightMessage struct {
+	Message *model.MQTTMessage
+	//最近一次发送的时间, 超时未确认时重发
+	SentAt time.Time
+	//已重发的次数
+	Retries int
+
+	//客户端确认收到PUBLISH时调用, 用于提交kafka消费位置; 从存储中恢复的消息为nil
+	ack func()
+}
+
+//客户端已确认收到消息
+func (m *InflightMessage) acked() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+//按连接重新创建发送窗口, 会话中已有的未确认消息占用窗口
+//窗口不超过报文标识符的数量, 占用窗口后总能分配到报文标识符
+func (s *Session) resetWindow(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size <= 0 || size > MaxMessageId {
+		size = MaxMessageId
+	}
+	s.window = make(chan struct{}, size)
+	for i := 0; i < len(s.Inflight) && i < size; i++ {
+		s.window <- struct{}{}
+	}
+}
+
+//占用发送窗口中的一个位置, 窗口已满时阻塞, 直到有消息被确认或done被关闭
+func (s *Session) acquireWindow(done <-chan bool) bool {
+	s.mu.Lock()
+	window := s.window
+	s.mu.Unlock()
+	if window == nil {
+		return true
+	}
+	select {
+	case window <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+//释放发送窗口中的一个位置, 不能持有s.mu
+func (s *Session) releaseWindow() {
+	s.mu.Lock()
+	window := s.window
+	s.mu.Unlock()
+	if window == nil {
+		return
+	}
+	select {
+	case <-window:
+	default:
+	}
+}
+
+//记录等待确认的消息
+func (s *Session) storeInflight(msg *model.MQTTMessage) {
+	s.mu.Lock()
+	s.Inflight[msg.VariableHeader.MessageId] = &InflightMessage{
+		Message: msg,
+		SentAt:  time.Now(),
+	}
+	s.mu.Unlock()
+	s.saveLater()
+}
+
+//收到PUBACK或PUBCOMP后删除处于对应状态的消息并释放窗口, 返回是否删除了消息
+//PUBACK只确认qos1的PUBLISH, PUBCOMP只确认已发送PUBREL的qos2消息
+//mqtt5中原因码表示失败的PUBREC也结束qos2的PUBLISH
+func (s *Session) ackInflight(messageId, packageType int) bool {
+	s.mu.Lock()
+	inflight, ok := s.Inflight[messageId]
+	if ok {
+		msg := inflight.Message
+		switch packageType {
+		case constant.MQTT_MSG_TYPE_PUBACK:
+			ok = msg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_PUBLISH && msg.FixedHeader.SpecificToken.Qos == 1
+		case constant.MQTT_MSG_TYPE_PUBCOMP:
+			ok = msg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_PUBREL
+		case constant.MQTT_MSG_TYPE_PUBREC:
+			ok = msg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_PUBLISH && msg.FixedHeader.SpecificToken.Qos == 2
+		default:
+			ok = false
+		}
+	}
+	if ok {
+		delete(s.Inflight, messageId)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.releaseWindow()
+		inflight.acked()
+		s.saveLater()
+	}
+	return ok
+}
+
+//收到qos2消息的PUBREC, 消息进入等待PUBCOMP的状态, 之后只重发PUBREL而不再重发PUBLISH
+//返回需要发送的PUBREL, 重复的PUBREC返回同一个PUBREL, 未知的报文标识符返回false
+func (s *Session) pubrec(messageId int) (*model.MQTTMessage, bool) {
+	pubrel := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:     constant.MQTT_MSG_TYPE_PUBREL,
+			RemainingLength: 2,
+		},
+		VariableHeader: &model.VariableHeader{
+			MessageId: messageId,
+		},
+	}
+	s.mu.Lock()
+	inflight, ok := s.Inflight[messageId]
+	if !ok {
+		s.mu.Unlock()
+		return pubrel, false
+	}
+	msg := inflight.Message
+	switch {
+	case msg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_PUBREL:
+		//重复的PUBREC
+		inflight.SentAt = time.Now()
+		s.mu.Unlock()
+		return msg, true
+	case msg.FixedHeader.SpecificToken.Qos != 2:
+		s.mu.Unlock()
+		return pubrel, false
+	}
+	s.Inflight[messageId] = &InflightMessage{
+		Message: pubrel,
+		SentAt:  time.Now(),
+	}
+	s.mu.Unlock()
+	//收到PUBREC后客户端已持有消息, 之后只需完成PUBREL/PUBCOMP
+	inflight.acked()
+	s.saveLater()
+	return pubrel, true
+}
+
+//返回超过timeout未确认的消息, 并置DUP=1和更新发送时间; timeout为0时返回所有消息
+//返回的消息按报文标识符排序
+func (s *Session) retransmit(timeout time.Duration) []*model.MQTTMessage {
+	s.mu.Lock()
+	now := time.Now()
+	var msgs []*model.MQTTMessage
+	for _, inflight := range s.Inflight {
+		if timeout > 0 && now.Sub(inflight.SentAt) < timeout {
+			continue
+		}
+		if token := inflight.Message.FixedHeader.SpecificToken; token != nil {
+			token.DUP = 1
+		}
+		inflight.SentAt = now
+		inflight.Retries++
+		msgs = append(msgs, inflight.Message)
+	}
+	s.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	sortMessages(msgs)
+	s.saveLater()
+	return msgs
+}
+
+//按报文标识符排序
+func sortMessages(msgs []*model.MQTTMessage) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].VariableHeader.MessageId < msgs[j].VariableHeader.MessageId
+	})
+}
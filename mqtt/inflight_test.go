@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"newgateway/constant"
+	"newgateway/model"
+	"testing"
+	"time"
+)
+
+func testPublish(id int) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:   constant.MQTT_MSG_TYPE_PUBLISH,
+			SpecificToken: &model.SpecificToken{Qos: 1},
+		},
+		VariableHeader: &model.VariableHeader{TopicName: "a/b", MessageId: id},
+		Payload:        &model.Payload{},
+	}
+}
+
+func TestInflightWindow(t *testing.T) {
+	s := newSession("c1", false)
+	s.resetWindow(2)
+	done := make(chan bool)
+	for i := 1; i <= 2; i++ {
+		if !s.acquireWindow(done) {
+			t.Fatal("window should not be full")
+		}
+		s.storeInflight(testPublish(i))
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- s.acquireWindow(done)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("window should be full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !s.ackInflight(1, constant.MQTT_MSG_TYPE_PUBACK) {
+		t.Fatal("message 1 should be inflight")
+	}
+	if !<-acquired {
+		t.Fatal("expected window to be released by puback")
+	}
+
+	//客户端关闭时不再等待
+	go func() {
+		acquired <- s.acquireWindow(done)
+	}()
+	close(done)
+	if <-acquired {
+		t.Fatal("expected acquire to fail after close")
+	}
+}
+
+//重新连接时替换发送窗口, 与之前连接的确认并发
+func TestWindowResetConcurrent(t *testing.T) {
+	s := newSession("c1", false)
+	s.resetWindow(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.releaseWindow()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.resetWindow(2)
+	}
+	<-done
+}
+
+func TestRetransmit(t *testing.T) {
+	s := newSession("c1", false)
+	s.storeInflight(testPublish(2))
+	s.storeInflight(testPublish(1))
+	if msgs := s.retransmit(time.Hour); len(msgs) != 0 {
+		t.Fatalf("unexpected retransmit %v", msgs)
+	}
+	msgs := s.retransmit(0)
+	if len(msgs) != 2 || msgs[0].VariableHeader.MessageId != 1 || msgs[1].VariableHeader.MessageId != 2 {
+		t.Fatalf("unexpected retransmit %v", msgs)
+	}
+	for _, msg := range msgs {
+		if msg.FixedHeader.SpecificToken.DUP != 1 {
+			t.Fatal("retransmitted message should have DUP=1")
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package mqtt
+
+import (
+	"errors"
+	"github.com/Shopify/sarama"
+	"newgateway/auth"
+	"newgateway/constant"
+	"newgateway/kafka"
+	"newgateway/logger"
+	"newgateway/model"
+	"strconv"
+	"time"
+)
+
+//mqtt5会话过期时间为该值时会话不过期
+const SessionNeverExpire = 0xFFFFFFFF
+
+//客户端没有发布该主题的权限
+var ErrNotAuthorized = errors.New("mqtt: not authorized")
+
+//connect返回码对应的mqtt5原因码
+var connackReasonCodes = map[int]int{
+	constant.MQTT_CONNECT_RETURN_CODE_REFUSED_PROTOCOL_VERSION:    constant.MQTT_REASON_UNSUPPORTED_PROTOCOL_VERSION,
+	constant.MQTT_CONNECT_RETURN_CODE_REFUSED_IDENTIFIER_REJECTED: constant.MQTT_REASON_CLIENT_IDENTIFIER_NOT_VALID,
+	constant.MQTT_CONNECT_RETURN_CODE_REFUSED_SERVER_UNAVAILABLE:  constant.MQTT_REASON_SERVER_UNAVAILABLE,
+	constant.MQTT_CONNECT_RETURN_CODE_REFUSED_USERNAME_PASSWORD:   constant.MQTT_REASON_BAD_USERNAME_OR_PASSWORD,
+	constant.MQTT_CONNECT_RETURN_CODE_REFUSED_NOT_AUTHORIZED:      constant.MQTT_REASON_NOT_AUTHORIZED,
+}
+
+//将connect返回码转换为mqtt5原因码
+func ConnackReasonCode(code int) int {
+	if reason, ok := connackReasonCodes[code]; ok {
+		return reason
+	}
+	return code
+}
+
+//解码错误对应的mqtt5 DISCONNECT原因码, 连接关闭等非协议错误返回false
+func DisconnectReason(err error) (int, bool) {
+	e, ok := err.(*DecodeError)
+	if !ok {
+		return 0, false
+	}
+	switch e.Err {
+	case ErrPacketTooLarge:
+		return constant.MQTT_REASON_PACKET_TOO_LARGE, true
+	case ErrUnknownPacketType:
+		return constant.MQTT_REASON_PROTOCOL_ERROR, true
+	default:
+		return constant.MQTT_REASON_MALFORMED_PACKET, true
+	}
+}
+
+//连接是否使用mqtt5
+func (c *Client) v5() bool {
+	return c.ProtocolVersion == constant.MQTT_PROTOCOL_LEVEL_5
+}
+
+//按CONNECT协商连接参数: 协议级别, 以及mqtt5客户端的Receive Maximum、Maximum Packet Size和会话过期时间
+func (c *Client) Negotiate(conn *model.MQTTMessage) {
+	c.ProtocolVersion = conn.VariableHeader.ProtocolVersion
+	props := conn.VariableHeader.Properties
+	if !c.v5() || props == nil {
+		return
+	}
+	if props.ReceiveMaximum != nil {
+		c.ReceiveMaximum = *props.ReceiveMaximum
+	}
+	if props.MaximumPacketSize != nil {
+		c.MaxPacketSize = *props.MaximumPacketSize
+	}
+	if props.SessionExpiryInterval != nil {
+		c.SessionExpiryInterval = *props.SessionExpiryInterval
+	}
+}
+
+//断开连接, mqtt5客户端在关闭连接前先收到带原因码的DISCONNECT
+func (c *Client) Disconnect(reason int) {
+	if c.v5() {
+		logger.Info("disconnecting client[" + c.ClientId + "], reason code: " + strconv.Itoa(reason))
+		c.Write(&model.MQTTMessage{
+			FixedHeader: &model.FixedHeader{
+				PackageType: constant.MQTT_MSG_TYPE_DISCONNECT,
+			},
+			VariableHeader: &model.VariableHeader{
+				ReasonCode: reason,
+			},
+		})
+	}
+	c.Close()
+}
+
+//将PUBLISH中的主题别名替换为主题, 返回mqtt5原因码
+//带主题的PUBLISH设置别名, 主题为空的PUBLISH使用之前设置的别名
+func (c *Client) resolveTopicAlias(msg *model.MQTTMessage) int {
+	header := msg.VariableHeader
+	if header.Properties == nil || header.Properties.TopicAlias == nil {
+		return constant.MQTT_REASON_SUCCESS
+	}
+	alias := *header.Properties.TopicAlias
+	if alias == 0 || alias > c.TopicAliasMaximum {
+		logger.Warn("invalid topic alias " + strconv.Itoa(alias) + " from client[" + c.ClientId + "]")
+		return constant.MQTT_REASON_TOPIC_ALIAS_INVALID
+	}
+	if header.TopicName != "" {
+		if c.topicAliases == nil {
+			c.topicAliases = make(map[int]string)
+		}
+		c.topicAliases[alias] = header.TopicName
+		return constant.MQTT_REASON_SUCCESS
+	}
+	name, ok := c.topicAliases[alias]
+	if !ok {
+		logger.Warn("unknown topic alias " + strconv.Itoa(alias) + " from client[" + c.ClientId + "]")
+		return constant.MQTT_REASON_PROTOCOL_ERROR
+	}
+	header.TopicName = name
+	return constant.MQTT_REASON_SUCCESS
+}
+
+//根据发布结果返回PUBACK/PUBREC的原因码, 返回false表示不回复确认
+//mqtt3客户端在发布失败时不回复确认, 由客户端重发
+func (c *Client) publishReason(err error) (int, bool) {
+	switch {
+	case err == nil:
+		return constant.MQTT_REASON_SUCCESS, true
+	case err == ErrNotAuthorized:
+		if c.v5() {
+			return constant.MQTT_REASON_NOT_AUTHORIZED, true
+		}
+		return constant.MQTT_REASON_SUCCESS, true
+	case c.v5():
+		logger.Error("publish message of client["+c.ClientId+"] failed: ", err)
+		return constant.MQTT_REASON_UNSPECIFIED_ERROR, true
+	default:
+		return 0, false
+	}
+}
+
+//订阅失败时的返回码, mqtt3只有0x80
+func (c *Client) subackFailure(reason int) int {
+	if c.v5() {
+		return reason
+	}
+	return constant.MQTT_SUBACK_RETURN_CODE_FAILURE
+}
+
+//服务端接受的未完成qos2消息数量
+func (c *Client) receiveLimit() int {
+	if c.InboundMaximum <= 0 || c.InboundMaximum > 65535 {
+		return 65535
+	}
+	return c.InboundMaximum
+}
+
+//产生mqtt5 AUTH消息
+func authMessage(reason int, method, data string) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType: constant.MQTT_MSG_TYPE_AUTH,
+		},
+		VariableHeader: &model.VariableHeader{
+			ReasonCode: reason,
+			Properties: &model.Properties{
+				AuthenticationMethod: method,
+				AuthenticationData:   data,
+			},
+		},
+	}
+}
+
+//AUTH中的认证方法和认证数据
+func authProperties(msg *model.MQTTMessage) (string, string) {
+	props := msg.VariableHeader.Properties
+	if props == nil {
+		return "", ""
+	}
+	return props.AuthenticationMethod, props.AuthenticationData
+}
+
+//通过认证器进行一轮扩展认证, 返回mqtt5原因码和发送给客户端的认证数据
+//需要继续时原因码为MQTT_REASON_CONTINUE_AUTHENTICATION, 认证通过时为MQTT_REASON_SUCCESS
+func (c *Client) authStep(clientId, userName, data string) (int, string) {
+	a, ok := auth.GetAuthenticator().(auth.EnhancedAuthenticator)
+	if !ok {
+		logger.Warn("unsupported authentication method[" + c.AuthMethod + "]")
+		return constant.MQTT_REASON_BAD_AUTHENTICATION_METHOD, ""
+	}
+	result, err := a.AuthenticateMethod(c.AuthMethod, clientId, userName, data, c.authState, c.Conn.RemoteAddr())
+	if err != nil {
+		logger.Error("authenticate client["+clientId+"] failed: ", err)
+		return constant.MQTT_REASON_SERVER_UNAVAILABLE, ""
+	}
+	if result.Continue {
+		c.authState = result.State
+		return constant.MQTT_REASON_CONTINUE_AUTHENTICATION, result.Data
+	}
+	c.authState = ""
+	if result.Code != constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED {
+		logger.Warn("client["+clientId+"] failed authentication method["+c.AuthMethod+"], return code: ", result.Code)
+		return ConnackReasonCode(result.Code), ""
+	}
+	return constant.MQTT_REASON_SUCCESS, result.Data
+}
+
+//CONNECT中带Authentication Method时进行扩展认证, 发送CONNACK前通过AUTH与客户端交换认证数据
+//返回CONNACK的原因码和最后一轮发送给客户端的认证数据
+func (c *Client) ConnectAuth(dec *Decoder, conn *model.MQTTMessage) (int, string) {
+	method, data := authProperties(conn)
+	c.AuthMethod = method
+	dec.ProtocolVersion = c.ProtocolVersion
+	for {
+		code, reply := c.authStep(conn.Payload.ClientId, conn.Payload.UserName, data)
+		if code != constant.MQTT_REASON_CONTINUE_AUTHENTICATION {
+			return code, reply
+		}
+		c.Write(authMessage(code, method, reply))
+		msg, err := dec.Decode()
+		if err != nil {
+			logger.Error("error decoding auth packet: ", err)
+			if reason, ok := DisconnectReason(err); ok {
+				return reason, ""
+			}
+			return constant.MQTT_REASON_UNSPECIFIED_ERROR, ""
+		}
+		//认证结束前只能收到同一认证方法的AUTH
+		var next string
+		if msg.FixedHeader.PackageType == constant.MQTT_MSG_TYPE_AUTH && msg.VariableHeader.ReasonCode == constant.MQTT_REASON_CONTINUE_AUTHENTICATION {
+			next, data = authProperties(msg)
+		}
+		if next != method {
+			logger.Warn("unexpected packet type " + strconv.Itoa(msg.FixedHeader.PackageType) + " during authentication")
+			return constant.MQTT_REASON_PROTOCOL_ERROR, ""
+		}
+	}
+}
+
+//连接建立后的AUTH用于重新认证, 认证方法必须与CONNECT中相同, 认证失败时断开连接
+func (c *Client) dealAuth(msg *model.MQTTMessage) *model.MQTTMessage {
+	method, data := authProperties(msg)
+	var ok bool
+	switch {
+	case c.AuthMethod == "" || method != c.AuthMethod:
+	case msg.VariableHeader.ReasonCode == constant.MQTT_REASON_REAUTHENTICATE:
+		ok = !c.reauthenticating
+		c.authState = ""
+	case msg.VariableHeader.ReasonCode == constant.MQTT_REASON_CONTINUE_AUTHENTICATION:
+		ok = c.reauthenticating
+	}
+	if !ok {
+		logger.Warn("unexpected AUTH from client[" + c.ClientId + "], reason code: " + strconv.Itoa(msg.VariableHeader.ReasonCode))
+		c.Disconnect(constant.MQTT_REASON_PROTOCOL_ERROR)
+		return nil
+	}
+	c.reauthenticating = true
+	code, reply := c.authStep(c.ClientId, c.UserName, data)
+	switch code {
+	case constant.MQTT_REASON_CONTINUE_AUTHENTICATION:
+		return authMessage(code, method, reply)
+	case constant.MQTT_REASON_SUCCESS:
+		c.reauthenticating = false
+		return authMessage(code, method, reply)
+	default:
+		c.Disconnect(constant.MQTT_REASON_NOT_AUTHORIZED)
+		return nil
+	}
+}
+
+//DISCONNECT中更新会话过期时间, 为0时断开后不再保留会话
+func (c *Client) updateSessionExpiry(props *model.Properties) {
+	if props == nil || props.SessionExpiryInterval == nil || c.Session == nil {
+		return
+	}
+	c.Session.mu.Lock()
+	//CONNECT中过期时间为0的会话不能在断开时改为保留
+	if c.Session.Persistent {
+		c.Session.ExpiryInterval = *props.SessionExpiryInterval
+		c.Session.Persistent = c.Session.ExpiryInterval > 0
+	}
+	c.Session.mu.Unlock()
+}
+
+//检查kafka消息是否需要发送给订阅者: 过期的消息和No Local订阅中客户端自己发布的消息不发送
+func (c *Client) deliverable(sub *Subscription, message *sarama.ConsumerMessage) bool {
+	if expireAt := kafka.ExpireAt(message); !expireAt.IsZero() && time.Now().After(expireAt) {
+		return false
+	}
+	if sub.NoLocal {
+		if id, _ := kafka.Header(message, kafka.HeaderClientId); id == c.ClientId {
+			return false
+		}
+	}
+	return true
+}
+
+//PUBLISH属性中的消息过期时间, 没有设置时返回零值
+func expireAt(props *model.Properties) time.Time {
+	if props == nil || props.MessageExpiryInterval == nil {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(*props.MessageExpiryInterval) * time.Second)
+}
+
+//将PUBLISH属性写入kafka消息头, 用户属性的key直接作为消息头
+func setMessageProperties(msg *kafka.Message, props *model.Properties) {
+	if props == nil {
+		return
+	}
+	msg.ExpireAt = expireAt(props)
+	header := func(key, value string) {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	if props.PayloadFormatIndicator != nil {
+		header(kafka.HeaderPayloadFormat, strconv.Itoa(*props.PayloadFormatIndicator))
+	}
+	if props.ContentType != "" {
+		header(kafka.HeaderContentType, props.ContentType)
+	}
+	if props.ResponseTopic != "" {
+		header(kafka.HeaderResponseTopic, props.ResponseTopic)
+	}
+	if props.CorrelationData != "" {
+		header(kafka.HeaderCorrelationData, props.CorrelationData)
+	}
+	for _, up := range props.UserProperties {
+		//与网关消息头冲突的用户属性无法还原, 直接丢弃
+		if kafka.IsReservedHeader(up.Key) {
+			continue
+		}
+		header(up.Key, up.Value)
+	}
+}
+
+//从kafka消息头还原发送给mqtt5客户端的PUBLISH属性, 消息过期时间为剩余的秒数
+func messageProperties(message *sarama.ConsumerMessage) *model.Properties {
+	props := &model.Properties{}
+	for _, h := range message.Headers {
+		if h == nil {
+			continue
+		}
+		key, value := string(h.Key), string(h.Value)
+		switch key {
+		case kafka.HeaderPayloadFormat:
+			if v, err := strconv.Atoi(value); err == nil {
+				props.PayloadFormatIndicator = model.Int(v)
+			}
+		case kafka.HeaderContentType:
+			props.ContentType = value
+		case kafka.HeaderResponseTopic:
+			props.ResponseTopic = value
+		case kafka.HeaderCorrelationData:
+			props.CorrelationData = value
+		default:
+			if !kafka.IsReservedHeader(key) {
+				props.UserProperties = append(props.UserProperties, &model.UserProperty{Key: key, Value: value})
+			}
+		}
+	}
+	if expireAt := kafka.ExpireAt(message); !expireAt.IsZero() {
+		remaining := (expireAt.Sub(time.Now()) + time.Second - 1) / time.Second
+		if remaining < 1 {
+			remaining = 1
+		}
+		props.MessageExpiryInterval = model.Int(int(remaining))
+	}
+	return props
+}
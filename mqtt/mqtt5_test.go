@@ -0,0 +1,376 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/Shopify/sarama"
+	"net"
+	"newgateway/auth"
+	"newgateway/constant"
+	"newgateway/kafka"
+	"newgateway/model"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//按给定协议级别编码后再解码
+func roundTrip(t *testing.T, msg *model.MQTTMessage, version int) *model.MQTTMessage {
+	dec := NewDecoder(bytes.NewReader(Encode(msg, version)))
+	dec.ProtocolVersion = version
+	decoded, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	props := &model.Properties{
+		PayloadFormatIndicator:  model.Int(1),
+		MessageExpiryInterval:   model.Int(3600),
+		TopicAlias:              model.Int(3),
+		ContentType:             "application/json",
+		ResponseTopic:           "reply/dev42",
+		CorrelationData:         "\x00\x01",
+		SubscriptionIdentifiers: []int{1, 200000},
+		UserProperties: []*model.UserProperty{
+			{Key: "region", Value: "cn"},
+			{Key: "region", Value: "us"},
+		},
+	}
+	r := &packetReader{body: appendProperties(nil, props)}
+	parsed, err := parseProperties(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(props, parsed) {
+		t.Fatalf("expected %+v, got %+v", props, parsed)
+	}
+	if r.remaining() != 0 {
+		t.Fatalf("%d bytes left after properties", r.remaining())
+	}
+}
+
+func TestPropertiesMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		//重复的属性
+		"duplicate": {0x04, constant.MQTT_PROP_TOPIC_ALIAS, 0x00, 0x01, constant.MQTT_PROP_TOPIC_ALIAS},
+		//未知的属性
+		"unknown": {0x02, 0x7f, 0x00},
+		//长度超出数据包
+		"truncated": {0x05, constant.MQTT_PROP_TOPIC_ALIAS, 0x00},
+	}
+	for name, body := range cases {
+		if _, err := parseProperties(&packetReader{body: body}); err != ErrMalformedPacket {
+			t.Errorf("%s: expected ErrMalformedPacket, got %v", name, err)
+		}
+	}
+}
+
+func TestPublishV5(t *testing.T) {
+	pub := publishMessage("a/b", "hello", 1, 0)
+	pub.VariableHeader.MessageId = 9
+	pub.VariableHeader.Properties = &model.Properties{
+		TopicAlias:     model.Int(2),
+		UserProperties: []*model.UserProperty{{Key: "k", Value: "v"}},
+	}
+	msg := roundTrip(t, pub, constant.MQTT_PROTOCOL_LEVEL_5)
+	if msg.VariableHeader.TopicName != "a/b" || msg.VariableHeader.MessageId != 9 || msg.Payload.Data != "hello" {
+		t.Fatalf("unexpected publish %+v %+v", msg.VariableHeader, msg.Payload)
+	}
+	if !reflect.DeepEqual(pub.VariableHeader.Properties, msg.VariableHeader.Properties) {
+		t.Fatalf("unexpected properties %+v", msg.VariableHeader.Properties)
+	}
+
+	//mqtt3不编码属性
+	if arr := MQTT2ByteArr(pub); len(arr) != 2+2+3+2+5 {
+		t.Fatalf("unexpected v3 publish length %d", len(arr))
+	}
+}
+
+func TestEncodeRemainingLength(t *testing.T) {
+	//主题超过255字节, 剩余长度需要两个字节
+	name := strings.Repeat("t", 300)
+	msg := roundTrip(t, publishMessage(name, "x", 0, 0), constant.MQTT_PROTOCOL_LEVEL_311)
+	if msg.VariableHeader.TopicName != name || msg.Payload.Data != "x" {
+		t.Fatalf("unexpected publish topic length %d", len(msg.VariableHeader.TopicName))
+	}
+}
+
+func TestAckReasonCode(t *testing.T) {
+	ack := ackMessage(constant.MQTT_MSG_TYPE_PUBACK, 5)
+	//原因码为0且没有属性时剩余长度为2
+	if arr := Encode(ack, constant.MQTT_PROTOCOL_LEVEL_5); !bytes.Equal(arr, []byte{0x40, 0x02, 0x00, 0x05}) {
+		t.Fatalf("unexpected puback %v", arr)
+	}
+	ack.VariableHeader.ReasonCode = constant.MQTT_REASON_NOT_AUTHORIZED
+	if arr := Encode(ack, constant.MQTT_PROTOCOL_LEVEL_5); !bytes.Equal(arr, []byte{0x40, 0x03, 0x00, 0x05, 0x87}) {
+		t.Fatalf("unexpected puback %v", arr)
+	}
+	//mqtt3忽略原因码
+	if arr := Encode(ack, constant.MQTT_PROTOCOL_LEVEL_311); !bytes.Equal(arr, []byte{0x40, 0x02, 0x00, 0x05}) {
+		t.Fatalf("unexpected puback %v", arr)
+	}
+	msg := roundTrip(t, ack, constant.MQTT_PROTOCOL_LEVEL_5)
+	if msg.VariableHeader.MessageId != 5 || msg.VariableHeader.ReasonCode != constant.MQTT_REASON_NOT_AUTHORIZED {
+		t.Fatalf("unexpected puback %+v", msg.VariableHeader)
+	}
+}
+
+func TestConnectV5(t *testing.T) {
+	conn := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_CONNECT},
+		VariableHeader: &model.VariableHeader{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5,
+			ConnectFlags:    &model.ConnectFlags{WillFlag: 1, WillQos: 1},
+			KeepAliveTimer:  60,
+			Properties: &model.Properties{
+				SessionExpiryInterval: model.Int(120),
+				ReceiveMaximum:        model.Int(4),
+				MaximumPacketSize:     model.Int(1024),
+			},
+		},
+		Payload: &model.Payload{
+			ClientId:       "dev42",
+			WillTopic:      "status/dev42",
+			WillMessage:    "offline",
+			WillProperties: &model.Properties{MessageExpiryInterval: model.Int(10)},
+		},
+	}
+	//CONNECT按自身的协议级别解析
+	msg, err := NewDecoder(bytes.NewReader(Encode(conn, constant.MQTT_PROTOCOL_LEVEL_5))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload.ClientId != "dev42" || msg.Payload.WillTopic != "status/dev42" || msg.Payload.WillMessage != "offline" {
+		t.Fatalf("unexpected connect payload %+v", msg.Payload)
+	}
+	if msg.Payload.WillProperties == nil || *msg.Payload.WillProperties.MessageExpiryInterval != 10 {
+		t.Fatalf("unexpected will properties %+v", msg.Payload.WillProperties)
+	}
+
+	cli := &Client{}
+	cli.Negotiate(msg)
+	if cli.ProtocolVersion != 5 || cli.SessionExpiryInterval != 120 || cli.ReceiveMaximum != 4 || cli.MaxPacketSize != 1024 {
+		t.Fatalf("unexpected negotiated client %+v", cli)
+	}
+	m := &SessionManager{InflightWindow: 32}
+	if size := m.window(cli); size != 4 {
+		t.Fatalf("expected window limited by receive maximum, got %d", size)
+	}
+}
+
+func TestSubscribeOptions(t *testing.T) {
+	packet := []byte{
+		0x82, 0x09,
+		0x00, 0x01,
+		0x00,
+		0x00, 0x03, 'a', '/', 'b', 0x2d,
+	}
+	dec := NewDecoder(bytes.NewReader(packet))
+	dec.ProtocolVersion = constant.MQTT_PROTOCOL_LEVEL_5
+	msg, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := msg.Payload.Subscriptions[0]
+	if sub.Qos != 1 || sub.NoLocal != 1 || sub.RetainAsPublished != 1 || sub.RetainHandling != 2 {
+		t.Fatalf("unexpected subscription options %+v", sub)
+	}
+
+	//mqtt3中保留位不为0
+	if _, err := ParsePacket(0x82, []byte{0x00, 0x01, 0x00, 0x01, 'a', 0x04}, constant.MQTT_PROTOCOL_LEVEL_311); err == nil {
+		t.Fatal("expected malformed subscribe")
+	}
+}
+
+func TestAuthPacket(t *testing.T) {
+	if _, err := ParsePacket(0xf0, nil, constant.MQTT_PROTOCOL_LEVEL_311); err == nil {
+		t.Fatal("AUTH should be rejected before mqtt5")
+	}
+	msg, err := ParsePacket(0xf0, []byte{0x18, 0x00}, constant.MQTT_PROTOCOL_LEVEL_5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.FixedHeader.PackageType != constant.MQTT_MSG_TYPE_AUTH || msg.VariableHeader.ReasonCode != constant.MQTT_REASON_CONTINUE_AUTHENTICATION {
+		t.Fatalf("unexpected auth %+v", msg.VariableHeader)
+	}
+}
+
+//挑战应答方式的扩展认证, 第二轮数据为挑战加上-signed时通过
+type challengeAuth struct {
+	auth.AllowAll
+}
+
+func (a *challengeAuth) AuthenticateMethod(method, clientId, userName, data, state string, addr net.Addr) (*auth.AuthResult, error) {
+	switch {
+	case method != "challenge":
+		return &auth.AuthResult{Code: constant.MQTT_REASON_BAD_AUTHENTICATION_METHOD}, nil
+	case state == "":
+		return &auth.AuthResult{Continue: true, Data: "nonce", State: "sent"}, nil
+	case state == "sent" && data == "nonce-signed":
+		return &auth.AuthResult{Code: constant.MQTT_CONNECT_RETURN_CODE_ACCEPTED, Data: "welcome"}, nil
+	default:
+		return &auth.AuthResult{Code: constant.MQTT_CONNECT_RETURN_CODE_REFUSED_NOT_AUTHORIZED}, nil
+	}
+}
+
+//替换认证器, 返回恢复原认证器的函数
+func withAuthenticator(a auth.Authenticator) func() {
+	old := auth.GetAuthenticator()
+	auth.SetAuthenticator(a)
+	return func() { auth.SetAuthenticator(old) }
+}
+
+func authConnect(method, data string) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_CONNECT},
+		VariableHeader: &model.VariableHeader{
+			ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5,
+			Properties:      &model.Properties{AuthenticationMethod: method, AuthenticationData: data},
+		},
+		Payload: &model.Payload{ClientId: "dev42"},
+	}
+}
+
+func TestConnectAuth(t *testing.T) {
+	defer withAuthenticator(&challengeAuth{})()
+	cases := []struct {
+		reply string
+		code  int
+	}{
+		{"nonce-signed", constant.MQTT_REASON_SUCCESS},
+		{"forged", constant.MQTT_REASON_NOT_AUTHORIZED},
+	}
+	for _, c := range cases {
+		server, conn := net.Pipe()
+		cli := &Client{Conn: server, ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5}
+		type result struct {
+			code int
+			data string
+		}
+		done := make(chan result, 1)
+		go func() {
+			code, data := cli.ConnectAuth(NewDecoder(server), authConnect("challenge", ""))
+			done <- result{code, data}
+		}()
+		//CONNACK之前先收到服务端的挑战
+		dec := NewDecoder(conn)
+		dec.ProtocolVersion = constant.MQTT_PROTOCOL_LEVEL_5
+		msg := decodeType(t, dec, constant.MQTT_MSG_TYPE_AUTH)
+		if msg.VariableHeader.ReasonCode != constant.MQTT_REASON_CONTINUE_AUTHENTICATION || msg.VariableHeader.Properties.AuthenticationData != "nonce" {
+			t.Fatalf("unexpected challenge %+v", msg.VariableHeader)
+		}
+		conn.Write(Encode(authMessage(constant.MQTT_REASON_CONTINUE_AUTHENTICATION, "challenge", c.reply), constant.MQTT_PROTOCOL_LEVEL_5))
+		r := <-done
+		if r.code != c.code {
+			t.Errorf("reply %s: expected reason code %#x, got %#x", c.reply, c.code, r.code)
+		}
+		if c.code == constant.MQTT_REASON_SUCCESS && r.data != "welcome" {
+			t.Errorf("expected final auth data, got %q", r.data)
+		}
+		server.Close()
+		conn.Close()
+	}
+
+	//认证器不支持扩展认证
+	auth.SetAuthenticator(&auth.AllowAll{})
+	server, conn := net.Pipe()
+	defer conn.Close()
+	cli := &Client{Conn: server, ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5}
+	if code, _ := cli.ConnectAuth(NewDecoder(server), authConnect("challenge", "")); code != constant.MQTT_REASON_BAD_AUTHENTICATION_METHOD {
+		t.Errorf("expected bad authentication method, got %#x", code)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	defer withAuthenticator(&challengeAuth{})()
+	server, conn := net.Pipe()
+	defer conn.Close()
+	cli := &Client{Conn: server, ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5, AuthMethod: "challenge"}
+
+	ret := cli.dealAuth(authMessage(constant.MQTT_REASON_REAUTHENTICATE, "challenge", ""))
+	if ret == nil || ret.VariableHeader.ReasonCode != constant.MQTT_REASON_CONTINUE_AUTHENTICATION || ret.VariableHeader.Properties.AuthenticationData != "nonce" {
+		t.Fatalf("expected challenge, got %+v", ret)
+	}
+	ret = cli.dealAuth(authMessage(constant.MQTT_REASON_CONTINUE_AUTHENTICATION, "challenge", "nonce-signed"))
+	if ret == nil || ret.VariableHeader.ReasonCode != constant.MQTT_REASON_SUCCESS || ret.VariableHeader.Properties.AuthenticationData != "welcome" {
+		t.Fatalf("expected success, got %+v", ret)
+	}
+	if cli.reauthenticating || cli.authState != "" {
+		t.Fatalf("reauthentication should be finished, state %q", cli.authState)
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	cli := &Client{TopicAliasMaximum: 2}
+	pub := publishMessage("a/b", "1", 0, 0)
+	pub.VariableHeader.Properties = &model.Properties{TopicAlias: model.Int(1)}
+	if code := cli.resolveTopicAlias(pub); code != constant.MQTT_REASON_SUCCESS {
+		t.Fatalf("unexpected reason code %d", code)
+	}
+
+	//只带别名的PUBLISH使用之前设置的主题
+	pub = publishMessage("", "2", 0, 0)
+	pub.VariableHeader.Properties = &model.Properties{TopicAlias: model.Int(1)}
+	if code := cli.resolveTopicAlias(pub); code != constant.MQTT_REASON_SUCCESS || pub.VariableHeader.TopicName != "a/b" {
+		t.Fatalf("unexpected alias resolution %d %q", code, pub.VariableHeader.TopicName)
+	}
+
+	pub.VariableHeader.Properties.TopicAlias = model.Int(3)
+	if code := cli.resolveTopicAlias(pub); code != constant.MQTT_REASON_TOPIC_ALIAS_INVALID {
+		t.Fatalf("expected topic alias invalid, got %d", code)
+	}
+	pub = publishMessage("", "3", 0, 0)
+	pub.VariableHeader.Properties = &model.Properties{TopicAlias: model.Int(2)}
+	if code := cli.resolveTopicAlias(pub); code != constant.MQTT_REASON_PROTOCOL_ERROR {
+		t.Fatalf("expected protocol error for unknown alias, got %d", code)
+	}
+}
+
+func TestMessageProperties(t *testing.T) {
+	msg := &kafka.Message{Topic: "telemetry", ReceivedAt: time.Now()}
+	setMessageProperties(msg, &model.Properties{
+		MessageExpiryInterval: model.Int(60),
+		ContentType:           "text/plain",
+		UserProperties: []*model.UserProperty{
+			{Key: "trace", Value: "abc"},
+			//与网关消息头冲突
+			{Key: kafka.HeaderQos, Value: "2"},
+		},
+	})
+	if len(msg.Headers) != 2 {
+		t.Fatalf("unexpected headers %v", msg.Headers)
+	}
+	consumed := &sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(kafka.HeaderQos), Value: []byte("1")},
+			{Key: []byte(kafka.HeaderExpireAt), Value: []byte("0")},
+		},
+	}
+	for i := range msg.Headers {
+		consumed.Headers = append(consumed.Headers, &msg.Headers[i])
+	}
+	consumed.Headers[1].Value = []byte(strconvMilli(msg.ExpireAt))
+	props := messageProperties(consumed)
+	if props.ContentType != "text/plain" || len(props.UserProperties) != 1 || props.UserProperties[0].Key != "trace" {
+		t.Fatalf("unexpected properties %+v", props)
+	}
+	if props.MessageExpiryInterval == nil || *props.MessageExpiryInterval < 59 || *props.MessageExpiryInterval > 60 {
+		t.Fatalf("unexpected message expiry %v", props.MessageExpiryInterval)
+	}
+
+	//过期的消息不再投递
+	cli := &Client{ClientId: "c1"}
+	consumed.Headers[1].Value = []byte(strconvMilli(time.Now().Add(-time.Second)))
+	if cli.deliverable(&Subscription{}, consumed) {
+		t.Fatal("expired message should not be delivered")
+	}
+}
+
+func strconvMilli(t time.Time) string {
+	return strconv.FormatInt(kafka.UnixMilli(t), 10)
+}
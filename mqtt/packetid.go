@@ -0,0 +1,50 @@
+package mqtt
+
+import (
+	"errors"
+	"newgateway/model"
+	"time"
+)
+
+//报文标识符的最大值, 0不是合法的报文标识符
+const MaxMessageId = 65535
+
+var ErrMessageIdExhausted = errors.New("no packet identifier available")
+
+//分配一个不在飞行中的报文标识符, 取值范围1~65535, 从上次分配的位置开始依次查找
+//调用方需持有s.mu
+func (s *Session) allocateMessageId() (int, error) {
+	id := s.NextMessageId
+	for i := 0; i < MaxMessageId; i++ {
+		if id <= 0 || id > MaxMessageId {
+			id = 1
+		}
+		if _, ok := s.Inflight[id]; !ok {
+			s.NextMessageId = id + 1
+			return id, nil
+		}
+		id++
+	}
+	return 0, ErrMessageIdExhausted
+}
+
+//为发送给客户端的qos1/qos2消息分配报文标识符, 并记录为等待确认
+//所有订阅共用同一个会话的报文标识符, 发送窗口保证分配时总有空闲的标识符
+//ack在客户端确认收到消息时调用, 可以为nil
+func (s *Session) allocateInflight(msg *model.MQTTMessage, ack func()) error {
+	s.mu.Lock()
+	id, err := s.allocateMessageId()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	msg.VariableHeader.MessageId = id
+	s.Inflight[id] = &InflightMessage{
+		Message: msg,
+		SentAt:  time.Now(),
+		ack:     ack,
+	}
+	s.mu.Unlock()
+	s.saveLater()
+	return nil
+}
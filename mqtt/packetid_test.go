@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestAllocateMessageId(t *testing.T) {
+	s := newSession("c1", false)
+	for i := 1; i <= 3; i++ {
+		pub := testPublish(0)
+		if err := s.allocateInflight(pub, nil); err != nil {
+			t.Fatal(err)
+		}
+		if pub.VariableHeader.MessageId != i {
+			t.Fatalf("expected id %d, got %d", i, pub.VariableHeader.MessageId)
+		}
+	}
+}
+
+func TestAllocateMessageIdSkipsInflight(t *testing.T) {
+	s := newSession("c1", false)
+	s.storeInflight(testPublish(MaxMessageId))
+	s.storeInflight(testPublish(1))
+	s.NextMessageId = MaxMessageId
+	pub := testPublish(0)
+	if err := s.allocateInflight(pub, nil); err != nil {
+		t.Fatal(err)
+	}
+	//65535和1都在飞行中, 回绕后分配2
+	if pub.VariableHeader.MessageId != 2 {
+		t.Fatalf("expected id 2, got %d", pub.VariableHeader.MessageId)
+	}
+}
+
+func TestAllocateMessageIdExhausted(t *testing.T) {
+	s := newSession("c1", false)
+	for i := 1; i <= MaxMessageId; i++ {
+		s.Inflight[i] = &InflightMessage{Message: testPublish(i)}
+	}
+	if err := s.allocateInflight(testPublish(0), nil); err != ErrMessageIdExhausted {
+		t.Fatalf("expected ErrMessageIdExhausted, got %v", err)
+	}
+	delete(s.Inflight, 100)
+	pub := testPublish(0)
+	if err := s.allocateInflight(pub, nil); err != nil || pub.VariableHeader.MessageId != 100 {
+		t.Fatalf("expected id 100, got %d %v", pub.VariableHeader.MessageId, err)
+	}
+}
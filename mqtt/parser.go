@@ -1,232 +1,258 @@
 package mqtt
 
 import (
-	"errors"
 	"newgateway/constant"
 	"newgateway/logger"
 	"newgateway/model"
-	"newgateway/utils"
-	"strconv"
 )
 
-func (c *Client) DealByteArray(byteArr []byte) {
-	var offset = 0
-	//捕获可能异常
-	defer func() {
-		if err := recover(); err != nil {
-			if offset > 0 {
-				logger.Warn("parse error, array length = ", len(byteArr), " offset = ", offset, " msg = ", string(byteArr))
-				copy(c.Buffer[c.BufferOffset:], byteArr[offset:])
-				c.BufferOffset += len(byteArr) - offset
-				c.IsBufferEmpty = false
-			} else {
-				logger.Warn("emergency error, array length = ", len(byteArr), " offset = ", offset, " msg(from offset) = ", string(byteArr[offset:]))
-				////试探下一个完整的数据节点
-				for offset++; offset < len(byteArr); offset++ {
-					if msg, err := ParseByteArray(byteArr[offset:]); msg != nil && err == nil {
-						break
-					}
-				}
-				logger.Info("new pointer found, array length = ", len(byteArr), " offset = ", offset, " msg = ", string(byteArr[offset:]))
-				c.DealByteArray(byteArr[offset:])
+//按顺序读取数据包内容, 越界时返回ErrMalformedPacket
+type packetReader struct {
+	body   []byte
+	offset int
+}
 
-				//丢掉出问题的数据
-				c.BufferOffset = 0
-				c.IsBufferEmpty = true
-			}
-		}
-	}()
-	if !c.IsBufferEmpty {
-		byteArr = appendArray(c.Buffer[:c.BufferOffset], byteArr)
-		c.BufferOffset = 0
+func (r *packetReader) readByte() (byte, error) {
+	if r.offset >= len(r.body) {
+		return 0, ErrMalformedPacket
 	}
+	b := r.body[r.offset]
+	r.offset++
+	return b, nil
+}
 
-	//Parse(byteArr,&offset,func(msg *model.MQTTMessage){
-	//	//处理消息业务逻辑
-	//	if msg.FixedHeader != nil {
-	//		logger.Debug("message type: " + strconv.Itoa(msg.FixedHeader.PackageType))
-	//		resMsg := c.DealMQTTMessage(msg)
-	//		if resMsg != nil {
-	//			go c.Write(resMsg)
-	//		}
-	//	}
-	//})
-
-	for offset = 0; offset < len(byteArr); {
-		msg := &model.MQTTMessage{}
-		//解析固定头
-		fixedHeader, fixHeaderLen := parseFixedHeader(byteArr[offset:])
-		msg.FixedHeader = fixedHeader
-
-		//解析可变头
-		variableHeader, varHeaderLen := parseVariableHeader(byteArr[offset+fixHeaderLen:offset+fixHeaderLen+msg.FixedHeader.RemainingLength], msg)
-		msg.VariableHeader = variableHeader
-
-		//解析消息体
-		msg.Payload = parsePayload(byteArr[fixHeaderLen+varHeaderLen+offset:offset+msg.FixedHeader.RemainingLength+fixHeaderLen], msg)
-
-		logger.Debug("receive message type: "+strconv.Itoa(msg.FixedHeader.PackageType)+", body: ", string(byteArr[0:msg.FixedHeader.RemainingLength+fixHeaderLen]))
+func (r *packetReader) readUint16() (int, error) {
+	if r.offset+2 > len(r.body) {
+		return 0, ErrMalformedPacket
+	}
+	v := int(r.body[r.offset])<<8 + int(r.body[r.offset+1])
+	r.offset += 2
+	return v, nil
+}
 
-		offset += msg.FixedHeader.RemainingLength + fixHeaderLen
-		//处理消息业务逻辑
-		if msg.FixedHeader != nil {
-			resMsg := c.DealMQTTMessage(msg)
-			if resMsg != nil {
-				go c.Write(resMsg)
-			}
-		}
+//读取带两字节长度前缀的数据
+func (r *packetReader) readBytes() ([]byte, error) {
+	length, err := r.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if r.offset+length > len(r.body) {
+		return nil, ErrMalformedPacket
 	}
-	c.IsBufferEmpty = true
+	b := r.body[r.offset : r.offset+length]
+	r.offset += length
+	return b, nil
 }
 
-func Parse(byteArr []byte, offset *int, f func(msg *model.MQTTMessage)) {
-	for *offset = 0; *offset < len(byteArr); {
-		msg := &model.MQTTMessage{}
-		//解析固定头
-		fixedHeader, fixHeaderLen := parseFixedHeader(byteArr[:])
-		msg.FixedHeader = fixedHeader
+func (r *packetReader) readString() (string, error) {
+	b, err := r.readBytes()
+	return string(b), err
+}
 
-		//解析可变头
-		variableHeader, varHeaderLen := parseVariableHeader(byteArr[fixHeaderLen:fixHeaderLen+msg.FixedHeader.RemainingLength], msg)
-		msg.VariableHeader = variableHeader
+func (r *packetReader) remaining() int {
+	return len(r.body) - r.offset
+}
 
-		//解析消息体
-		msg.Payload = parsePayload(byteArr[fixHeaderLen+varHeaderLen:msg.FixedHeader.RemainingLength+fixHeaderLen], msg)
-		*offset += msg.FixedHeader.RemainingLength + fixHeaderLen
-		f(msg)
-	}
+func (r *packetReader) rest() []byte {
+	b := r.body[r.offset:]
+	r.offset = len(r.body)
+	return b
 }
 
-func ParseByteArray(byteArr []byte) (*model.MQTTMessage, error) {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Error(err)
-		}
-	}()
+//根据首字节和完整的剩余数据解析一个数据包, version为连接的协议级别, 决定是否解析mqtt5的原因码和属性
+//CONNECT按其自身声明的协议级别解析
+func ParsePacket(first byte, body []byte, version int) (*model.MQTTMessage, error) {
 	msg := &model.MQTTMessage{}
 	//解析固定头
-	fixedHeader, fixHeaderLen := parseFixedHeader(byteArr[:])
+	fixedHeader, err := parseFixedHeader(first, len(body), version)
+	if err != nil {
+		return nil, &DecodeError{PackageType: int(first) >> 4, Err: err}
+	}
 	msg.FixedHeader = fixedHeader
 
+	r := &packetReader{body: body}
 	//解析可变头
-	if len(byteArr) < fixHeaderLen+msg.FixedHeader.RemainingLength {
-		return nil, errors.New("invalid message")
+	msg.VariableHeader, err = parseVariableHeader(r, msg, version)
+	if err != nil {
+		return nil, &DecodeError{PackageType: fixedHeader.PackageType, Err: err}
 	}
-	variableHeader, varHeaderLen := parseVariableHeader(byteArr[fixHeaderLen:fixHeaderLen+msg.FixedHeader.RemainingLength], msg)
-	msg.VariableHeader = variableHeader
 
 	//解析消息体
-	if len(byteArr) < fixHeaderLen+varHeaderLen {
-		return nil, errors.New("invalid message")
+	msg.Payload, err = parsePayload(r, msg, version)
+	if err != nil {
+		return nil, &DecodeError{PackageType: fixedHeader.PackageType, Err: err}
 	}
-	msg.Payload = parsePayload(byteArr[fixHeaderLen+varHeaderLen:msg.FixedHeader.RemainingLength+fixHeaderLen], msg)
-
-	logger.Debug("message type: " + strconv.Itoa(msg.FixedHeader.PackageType))
-	//处理消息业务逻辑
 	return msg, nil
 }
 
 //解析固定头
-func parseFixedHeader(input []byte) (*model.FixedHeader, int) {
+func parseFixedHeader(first byte, remainingLength int, version int) (*model.FixedHeader, error) {
 	header := &model.FixedHeader{
-		PackageType: int(input[0]) >> 4,
+		PackageType:     int(first) >> 4,
+		RemainingLength: remainingLength,
 	}
-	if header.PackageType == constant.MQTT_MSG_TYPE_PUBLISH {
-		tokenInt := int(input[0]) & 15
+	flags := int(first) & 15
+	switch header.PackageType {
+	case constant.MQTT_MSG_TYPE_RESERVED:
+		return nil, ErrUnknownPacketType
+	case constant.MQTT_MSG_TYPE_AUTH:
+		//AUTH只存在于mqtt5
+		if version != constant.MQTT_PROTOCOL_LEVEL_5 {
+			return nil, ErrUnknownPacketType
+		}
+		if flags != 0 {
+			return nil, ErrMalformedPacket
+		}
+	case constant.MQTT_MSG_TYPE_PUBLISH:
 		token := &model.SpecificToken{
-			Retain: tokenInt % 2,
+			Retain: flags % 2,
+		}
+		flags >>= 1
+		token.Qos = flags % 4
+		flags >>= 2
+		token.DUP = flags % 2
+		if token.Qos > 2 {
+			return nil, ErrMalformedPacket
 		}
-		tokenInt >>= 1
-		token.Qos = tokenInt % 4
-		tokenInt >>= 2
-		token.DUP = tokenInt % 2
 		header.SpecificToken = token
+	case constant.MQTT_MSG_TYPE_PUBREL, constant.MQTT_MSG_TYPE_SUBSCRIBE, constant.MQTT_MSG_TYPE_UNSUBSCRIBE:
+		//这几类数据包的标识位固定为0010
+		if flags != 2 {
+			return nil, ErrMalformedPacket
+		}
 	}
-	flag := int(input[1]) >> 7
-	header.RemainingLength = int(input[1] & 127)
-	var i int
-	for i = 2; flag == 1; i++ {
-		header.RemainingLength += int(input[i]&127) * utils.Pow(128, (i - 1))
-		flag = int(input[i]) >> 7
-	}
-
-	return header, i
+	return header, nil
 }
 
 //解析可变头
-func parseVariableHeader(body []byte, msg *model.MQTTMessage) (*model.VariableHeader, int) {
-	var (
-		header *model.VariableHeader
-		offset int
-	)
+func parseVariableHeader(r *packetReader, msg *model.MQTTMessage, version int) (*model.VariableHeader, error) {
+	v5 := version == constant.MQTT_PROTOCOL_LEVEL_5
 	switch msg.FixedHeader.PackageType {
 	case constant.MQTT_MSG_TYPE_CONNECT: //connect
-		header, offset = parseConnectVariableHeader(body)
+		return parseConnectVariableHeader(r)
 	case constant.MQTT_MSG_TYPE_PUBLISH: //publish
-		header, offset = parsePublishVariableHeader(body, msg)
-	case constant.MQTT_MSG_TYPE_PUBREL: //pubrel
-		header, offset = parsePubrelVariableHeader(body)
-	case constant.MQTT_MSG_TYPE_SUBSCRIBE: //subscribe
-		header, offset = parseSubscribeVariableHeader(body)
-	case constant.MQTT_MSG_TYPE_UNSUBSCRIBE: //unsubscribe
-		header, offset = parseUnsubscribeVariableHeader(body)
-	}
-	return header, offset
+		return parsePublishVariableHeader(r, msg, v5)
+	case constant.MQTT_MSG_TYPE_PUBACK, constant.MQTT_MSG_TYPE_PUBREC, constant.MQTT_MSG_TYPE_PUBREL, constant.MQTT_MSG_TYPE_PUBCOMP:
+		return parseAckVariableHeader(r, v5)
+	case constant.MQTT_MSG_TYPE_SUBSCRIBE, constant.MQTT_MSG_TYPE_UNSUBSCRIBE: //subscribe, unsubscribe
+		header, err := parseMessageIdVariableHeader(r)
+		if err == nil && v5 {
+			header.Properties, err = parseProperties(r)
+		}
+		return header, err
+	case constant.MQTT_MSG_TYPE_DISCONNECT, constant.MQTT_MSG_TYPE_AUTH:
+		if v5 {
+			return parseReasonVariableHeader(r)
+		}
+	}
+	return nil, nil
 }
 
 //处理connect消息的可变头
-func parseConnectVariableHeader(body []byte) (*model.VariableHeader, int) {
+func parseConnectVariableHeader(r *packetReader) (*model.VariableHeader, error) {
 	header := &model.VariableHeader{}
-	length := int(body[1])
+	var err error
 	//默认以UTF-8编码解析协议名
-	header.ProtocolName = string(body[2 : 2+length])
+	if header.ProtocolName, err = r.readString(); err != nil {
+		return nil, err
+	}
 	//协议版本
-	header.ProtocolVersion = int(body[2+length])
+	version, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	header.ProtocolVersion = int(version)
 	//连接标识
-	header.ConnectFlags = parseConnectFlags(body[3+length])
+	flags, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	header.ConnectFlags = parseConnectFlags(flags)
 	//keepalive
-	header.KeepAliveTimer = int(body[4+length])<<8 + int(body[5+length])
-	return header, 6 + length
+	if header.KeepAliveTimer, err = r.readUint16(); err != nil {
+		return nil, err
+	}
+	if header.ProtocolVersion == constant.MQTT_PROTOCOL_LEVEL_5 {
+		if header.Properties, err = parseProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
 }
 
 //处理publish消息的可变头
-func parsePublishVariableHeader(body []byte, msg *model.MQTTMessage) (*model.VariableHeader, int) {
+func parsePublishVariableHeader(r *packetReader, msg *model.MQTTMessage, v5 bool) (*model.VariableHeader, error) {
 	header := &model.VariableHeader{}
-	topicLen := int(body[0])<<8 + int(body[1])
-	header.TopicName = string(body[2 : 2+topicLen])
-	offset := 2 + topicLen
+	var err error
+	if header.TopicName, err = r.readString(); err != nil {
+		return nil, err
+	}
 	if msg.FixedHeader.SpecificToken.Qos > 0 {
-		header.MessageId = int(body[offset])<<8 + int(body[offset+1])
-		offset += 2
+		if header.MessageId, err = r.readUint16(); err != nil {
+			return nil, err
+		}
 	}
-	return header, offset
+	if v5 {
+		if header.Properties, err = parseProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
 }
 
-//处理subscribe消息的可变头
-func parsePubrelVariableHeader(body []byte) (*model.VariableHeader, int) {
-	header := &model.VariableHeader{}
-	header.MessageId = int(body[0])<<8 + int(body[1])
-	return header, 2
+//处理PUBACK、PUBREC、PUBREL、PUBCOMP的可变头, mqtt5中剩余长度为2时原因码为0且没有属性
+func parseAckVariableHeader(r *packetReader, v5 bool) (*model.VariableHeader, error) {
+	header, err := parseMessageIdVariableHeader(r)
+	if err != nil || !v5 || r.remaining() == 0 {
+		return header, err
+	}
+	code, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	header.ReasonCode = int(code)
+	if r.remaining() > 0 {
+		if header.Properties, err = parseProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
 }
 
-//处理subscribe消息的可变头
-func parseSubscribeVariableHeader(body []byte) (*model.VariableHeader, int) {
+//处理mqtt5 DISCONNECT和AUTH的可变头, 原因码和属性都可以省略
+func parseReasonVariableHeader(r *packetReader) (*model.VariableHeader, error) {
 	header := &model.VariableHeader{}
-	header.MessageId = int(body[0])<<8 + int(body[1])
-	return header, 2
+	if r.remaining() == 0 {
+		return header, nil
+	}
+	code, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	header.ReasonCode = int(code)
+	if r.remaining() > 0 {
+		if header.Properties, err = parseProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
 }
 
-//处理unsubscribe消息的可变头
-func parseUnsubscribeVariableHeader(body []byte) (*model.VariableHeader, int) {
+//处理只包含报文标识符的可变头
+func parseMessageIdVariableHeader(r *packetReader) (*model.VariableHeader, error) {
 	header := &model.VariableHeader{}
-	header.MessageId = int(body[0])<<8 + int(body[1])
-	return header, 2
+	var err error
+	if header.MessageId, err = r.readUint16(); err != nil {
+		return nil, err
+	}
+	return header, nil
 }
 
 //解析标识符
 func parseConnectFlags(body byte) *model.ConnectFlags {
 	flags := &model.ConnectFlags{}
 	tmp := int(body)
+	flags.Reserved = tmp % 2
 	tmp >>= 1
 	flags.CleanSession = tmp % 2
 	tmp >>= 1
@@ -234,7 +260,7 @@ func parseConnectFlags(body byte) *model.ConnectFlags {
 	tmp >>= 1
 	flags.WillQos = tmp % 4
 	tmp >>= 2
-	flags.WillQos = tmp % 2
+	flags.WillRetain = tmp % 2
 	tmp >>= 1
 	flags.PasswordFlag = tmp % 2
 	tmp >>= 1
@@ -243,88 +269,128 @@ func parseConnectFlags(body byte) *model.ConnectFlags {
 }
 
 //解析消息头
-func parsePayload(body []byte, msg *model.MQTTMessage) *model.Payload {
-	var payload *model.Payload
+func parsePayload(r *packetReader, msg *model.MQTTMessage, version int) (*model.Payload, error) {
 	switch msg.FixedHeader.PackageType {
 	case constant.MQTT_MSG_TYPE_CONNECT:
-		payload = parseConnectPayload(body, msg)
+		return parseConnectPayload(r, msg)
 	case constant.MQTT_MSG_TYPE_SUBSCRIBE:
-		payload = parseSubscribePayload(body, msg)
+		return parseSubscribePayload(r, msg, version == constant.MQTT_PROTOCOL_LEVEL_5)
 	case constant.MQTT_MSG_TYPE_UNSUBSCRIBE:
-		payload = parseUnsubscribePayload(body, msg)
+		return parseUnsubscribePayload(r, msg)
 	case constant.MQTT_MSG_TYPE_PUBLISH:
-		payload = parsePublishPayload(body, msg)
+		return parsePublishPayload(r, msg)
 	}
-	return payload
+	return nil, nil
 }
 
 //解析connect payload
-func parseConnectPayload(body []byte, msg *model.MQTTMessage) *model.Payload {
+func parseConnectPayload(r *packetReader, msg *model.MQTTMessage) (*model.Payload, error) {
+	payload := &model.Payload{}
+	var err error
 	//clientId
-	clientIdLen := int(body[1])
-	payload := &model.Payload{
-		ClientId: string(body[2 : clientIdLen+2]),
+	if payload.ClientId, err = r.readString(); err != nil {
+		return nil, err
 	}
-	offset := 3 + clientIdLen
 	//Will topic & Will message
 	if msg.VariableHeader.ConnectFlags.WillFlag == 1 {
-		//will topic
-		topicLen := int(body[offset])
-		offset++
-		payload.WillTopic = string(body[offset : offset+topicLen])
-		logger.Debug("will topic:" + string(body[offset:offset+topicLen]))
-		offset += topicLen
-		offset++
-
-		//will message
-		messageLen := int(body[offset])
-		offset++
-		payload.WillMessage = string(body[offset : offset+messageLen])
-		logger.Debug("will message:" + string(body[offset:offset+messageLen]))
-		offset += messageLen
-		offset++
+		if msg.VariableHeader.ProtocolVersion == constant.MQTT_PROTOCOL_LEVEL_5 {
+			if payload.WillProperties, err = parseProperties(r); err != nil {
+				return nil, err
+			}
+		}
+		if payload.WillTopic, err = r.readString(); err != nil {
+			return nil, err
+		}
+		logger.Debug("will topic:" + payload.WillTopic)
+		if payload.WillMessage, err = r.readString(); err != nil {
+			return nil, err
+		}
+		logger.Debug("will message:" + payload.WillMessage)
 	}
 	//username
 	if msg.VariableHeader.ConnectFlags.UserNameFlag == 1 {
-		userLen := int(body[offset])
-		offset++
-		payload.UserName = string(body[offset : offset+userLen])
-		logger.Debug("username:" + string(body[offset:offset+userLen]))
-		offset += userLen
-		offset++
+		if payload.UserName, err = r.readString(); err != nil {
+			return nil, err
+		}
+		logger.Debug("username:" + payload.UserName)
 	}
 	//password
 	if msg.VariableHeader.ConnectFlags.PasswordFlag == 1 {
-		passLen := int(body[offset])
-		offset++
-		payload.Password = string(body[offset : offset+passLen])
-		logger.Debug("password:" + string(body[offset:offset+passLen]))
-		offset += passLen
-		offset++
-	}
-	return payload
+		if payload.Password, err = r.readString(); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+//解析subscribe payload, 一个数据包中可以包含多个主题过滤器
+func parseSubscribePayload(r *packetReader, msg *model.MQTTMessage, v5 bool) (*model.Payload, error) {
+	payload := &model.Payload{}
+	for r.remaining() > 0 {
+		topic, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		options, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		sub, err := parseSubscriptionOptions(options, v5)
+		if err != nil {
+			return nil, err
+		}
+		sub.TopicFilter = topic
+		payload.Subscriptions = append(payload.Subscriptions, sub)
+	}
+	//至少包含一个主题过滤器
+	if len(payload.Subscriptions) == 0 {
+		return nil, ErrMalformedPacket
+	}
+	return payload, nil
 }
 
-//解析subscribe payload
-func parseSubscribePayload(body []byte, msg *model.MQTTMessage) *model.Payload {
-	subLen := int(body[1])
-	payload := &model.Payload{
-		SubscribePayload: string(body[2 : 2+subLen]),
-		SubscribeAckQos:  int(body[subLen+2]),
-	}
-	return payload
+//解析订阅选项, mqtt3只有最低两位的qos, mqtt5增加了No Local、Retain As Published和Retain Handling
+func parseSubscriptionOptions(options byte, v5 bool) (*model.Subscription, error) {
+	sub := &model.Subscription{
+		Qos: int(options & 3),
+	}
+	if sub.Qos > 2 {
+		return nil, ErrMalformedPacket
+	}
+	if !v5 {
+		if options>>2 != 0 {
+			return nil, ErrMalformedPacket
+		}
+		return sub, nil
+	}
+	sub.NoLocal = int(options>>2) & 1
+	sub.RetainAsPublished = int(options>>3) & 1
+	sub.RetainHandling = int(options>>4) & 3
+	if sub.RetainHandling > 2 || options>>6 != 0 {
+		return nil, ErrMalformedPacket
+	}
+	return sub, nil
 }
 
 //解析unsubscribe payload
-func parseUnsubscribePayload(body []byte, msg *model.MQTTMessage) *model.Payload {
-	return &model.Payload{
-		UnsubscribeTopics: string(body[2 : 2+int(body[1])]),
+func parseUnsubscribePayload(r *packetReader, msg *model.MQTTMessage) (*model.Payload, error) {
+	payload := &model.Payload{}
+	for r.remaining() > 0 {
+		topic, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		payload.UnsubscribeTopics = append(payload.UnsubscribeTopics, topic)
 	}
+	if len(payload.UnsubscribeTopics) == 0 {
+		return nil, ErrMalformedPacket
+	}
+	return payload, nil
 }
 
 //解析publish payload
-func parsePublishPayload(body []byte, msg *model.MQTTMessage) *model.Payload {
+func parsePublishPayload(r *packetReader, msg *model.MQTTMessage) (*model.Payload, error) {
 	return &model.Payload{
-		Data: string(body),
-	}
+		Data: string(r.rest()),
+	}, nil
 }
@@ -1,7 +1,10 @@
 package mqtt
 
 import (
+	"bytes"
 	"fmt"
+	"newgateway/constant"
+	"newgateway/model"
 	"testing"
 )
 
@@ -27,3 +30,103 @@ func deparser(a int) {
 		x /= 128
 	}
 }
+
+func TestParseSubscribeMultipleFilters(t *testing.T) {
+	packet := []byte{
+		0x82, 0x0e,
+		0x00, 0x01,
+		0x00, 0x03, 'a', '/', 'b', 0x01,
+		0x00, 0x03, 'c', '/', 'd', 0x02,
+	}
+	msg, err := NewDecoder(bytes.NewReader(packet)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs := msg.Payload.Subscriptions
+	if len(subs) != 2 || subs[0].TopicFilter != "a/b" || subs[0].Qos != 1 || subs[1].TopicFilter != "c/d" || subs[1].Qos != 2 {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+
+	packet = []byte{
+		0xa2, 0x0c,
+		0x00, 0x02,
+		0x00, 0x03, 'a', '/', 'b',
+		0x00, 0x03, 'c', '/', 'd',
+	}
+	msg, err = NewDecoder(bytes.NewReader(packet)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := msg.Payload.UnsubscribeTopics; len(topics) != 2 || topics[0] != "a/b" || topics[1] != "c/d" {
+		t.Fatalf("unexpected unsubscribe topics %v", topics)
+	}
+}
+
+func TestSubackReturnCodes(t *testing.T) {
+	suback := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:     constant.MQTT_MSG_TYPE_SUBACK,
+			RemainingLength: 4,
+		},
+		VariableHeader: &model.VariableHeader{
+			MessageId: 1,
+		},
+		Payload: &model.Payload{
+			ReturnCodes: []int{1, constant.MQTT_SUBACK_RETURN_CODE_FAILURE},
+		},
+	}
+	expected := []byte{0x90, 0x04, 0x00, 0x01, 0x01, 0x80}
+	if arr := MQTT2ByteArr(suback); !bytes.Equal(arr, expected) {
+		t.Fatalf("expected %v, got %v", expected, arr)
+	}
+}
+
+func TestConnackSessionPresent(t *testing.T) {
+	connack := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:     constant.MQTT_MSG_TYPE_CONNECTACK,
+			RemainingLength: 2,
+		},
+		VariableHeader: &model.VariableHeader{
+			SessionPresent: 1,
+		},
+	}
+	expected := []byte{0x20, 0x02, 0x01, 0x00}
+	if arr := MQTT2ByteArr(connack); !bytes.Equal(arr, expected) {
+		t.Fatalf("expected %v, got %v", expected, arr)
+	}
+}
+
+func TestPublishFlags(t *testing.T) {
+	pub := &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType: constant.MQTT_MSG_TYPE_PUBLISH,
+			SpecificToken: &model.SpecificToken{
+				DUP: 1,
+				Qos: 1,
+			},
+			RemainingLength: 7,
+		},
+		VariableHeader: &model.VariableHeader{
+			TopicName: "a/b",
+			MessageId: 7,
+		},
+		Payload: &model.Payload{},
+	}
+	expected := []byte{0x3a, 0x07, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x07}
+	if arr := MQTT2ByteArr(pub); !bytes.Equal(arr, expected) {
+		t.Fatalf("expected %v, got %v", expected, arr)
+	}
+}
+
+func TestParseConnectFlags(t *testing.T) {
+	//username, password, will retain, will qos 2, will flag, clean session
+	flags := parseConnectFlags(0xf6)
+	if flags.UserNameFlag != 1 || flags.PasswordFlag != 1 || flags.WillRetain != 1 || flags.WillQos != 2 || flags.WillFlag != 1 || flags.CleanSession != 1 || flags.Reserved != 0 {
+		t.Fatalf("unexpected flags %+v", flags)
+	}
+	flags = parseConnectFlags(0x0c)
+	if flags.WillRetain != 0 || flags.WillQos != 1 || flags.WillFlag != 1 {
+		t.Fatalf("unexpected flags %+v", flags)
+	}
+}
@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"newgateway/constant"
+	"newgateway/model"
+)
+
+//整数类型的属性及其字节数
+var intProperties = []struct {
+	id    byte
+	size  int
+	field func(p *model.Properties) **int
+}{
+	{constant.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR, 1, func(p *model.Properties) **int { return &p.PayloadFormatIndicator }},
+	{constant.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL, 4, func(p *model.Properties) **int { return &p.MessageExpiryInterval }},
+	{constant.MQTT_PROP_SESSION_EXPIRY_INTERVAL, 4, func(p *model.Properties) **int { return &p.SessionExpiryInterval }},
+	{constant.MQTT_PROP_SERVER_KEEP_ALIVE, 2, func(p *model.Properties) **int { return &p.ServerKeepAlive }},
+	{constant.MQTT_PROP_REQUEST_PROBLEM_INFORMATION, 1, func(p *model.Properties) **int { return &p.RequestProblemInformation }},
+	{constant.MQTT_PROP_WILL_DELAY_INTERVAL, 4, func(p *model.Properties) **int { return &p.WillDelayInterval }},
+	{constant.MQTT_PROP_REQUEST_RESPONSE_INFORMATION, 1, func(p *model.Properties) **int { return &p.RequestResponseInformation }},
+	{constant.MQTT_PROP_RECEIVE_MAXIMUM, 2, func(p *model.Properties) **int { return &p.ReceiveMaximum }},
+	{constant.MQTT_PROP_TOPIC_ALIAS_MAXIMUM, 2, func(p *model.Properties) **int { return &p.TopicAliasMaximum }},
+	{constant.MQTT_PROP_TOPIC_ALIAS, 2, func(p *model.Properties) **int { return &p.TopicAlias }},
+	{constant.MQTT_PROP_MAXIMUM_QOS, 1, func(p *model.Properties) **int { return &p.MaximumQos }},
+	{constant.MQTT_PROP_RETAIN_AVAILABLE, 1, func(p *model.Properties) **int { return &p.RetainAvailable }},
+	{constant.MQTT_PROP_MAXIMUM_PACKET_SIZE, 4, func(p *model.Properties) **int { return &p.MaximumPacketSize }},
+	{constant.MQTT_PROP_WILDCARD_SUBSCRIPTION_AVAILABLE, 1, func(p *model.Properties) **int { return &p.WildcardSubscriptionAvailable }},
+	{constant.MQTT_PROP_SUBSCRIPTION_IDENTIFIER_AVAILABLE, 1, func(p *model.Properties) **int { return &p.SubscriptionIdentifierAvailable }},
+	{constant.MQTT_PROP_SHARED_SUBSCRIPTION_AVAILABLE, 1, func(p *model.Properties) **int { return &p.SharedSubscriptionAvailable }},
+}
+
+//字符串和二进制类型的属性, 两者的编码方式相同
+var stringProperties = []struct {
+	id    byte
+	field func(p *model.Properties) *string
+}{
+	{constant.MQTT_PROP_CONTENT_TYPE, func(p *model.Properties) *string { return &p.ContentType }},
+	{constant.MQTT_PROP_RESPONSE_TOPIC, func(p *model.Properties) *string { return &p.ResponseTopic }},
+	{constant.MQTT_PROP_CORRELATION_DATA, func(p *model.Properties) *string { return &p.CorrelationData }},
+	{constant.MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER, func(p *model.Properties) *string { return &p.AssignedClientIdentifier }},
+	{constant.MQTT_PROP_AUTHENTICATION_METHOD, func(p *model.Properties) *string { return &p.AuthenticationMethod }},
+	{constant.MQTT_PROP_AUTHENTICATION_DATA, func(p *model.Properties) *string { return &p.AuthenticationData }},
+	{constant.MQTT_PROP_RESPONSE_INFORMATION, func(p *model.Properties) *string { return &p.ResponseInformation }},
+	{constant.MQTT_PROP_SERVER_REFERENCE, func(p *model.Properties) *string { return &p.ServerReference }},
+	{constant.MQTT_PROP_REASON_STRING, func(p *model.Properties) *string { return &p.ReasonString }},
+}
+
+//读取变长整数
+func (r *packetReader) readVarInt() (int, error) {
+	value := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(b&127) * multiplier
+		if b&128 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedPacket
+}
+
+func (r *packetReader) readUint32() (int, error) {
+	if r.offset+4 > len(r.body) {
+		return 0, ErrMalformedPacket
+	}
+	b := r.body[r.offset:]
+	v := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	r.offset += 4
+	return v, nil
+}
+
+//解析mqtt5属性, 属性长度之后的内容超出数据包或包含未知、重复的属性时返回ErrMalformedPacket
+func parseProperties(r *packetReader) (*model.Properties, error) {
+	length, err := r.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+	if length > r.remaining() {
+		return nil, ErrMalformedPacket
+	}
+	pr := &packetReader{body: r.body[r.offset : r.offset+length]}
+	r.offset += length
+
+	props := &model.Properties{}
+	seen := make(map[byte]bool)
+	for pr.remaining() > 0 {
+		id, err := pr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		//只有用户属性和订阅标识符可以出现多次
+		if id != constant.MQTT_PROP_USER_PROPERTY && id != constant.MQTT_PROP_SUBSCRIPTION_IDENTIFIER {
+			if seen[id] {
+				return nil, ErrMalformedPacket
+			}
+			seen[id] = true
+		}
+		if err := parseProperty(pr, id, props); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+func parseProperty(r *packetReader, id byte, props *model.Properties) error {
+	switch id {
+	case constant.MQTT_PROP_USER_PROPERTY:
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		value, err := r.readString()
+		if err != nil {
+			return err
+		}
+		props.UserProperties = append(props.UserProperties, &model.UserProperty{Key: key, Value: value})
+		return nil
+	case constant.MQTT_PROP_SUBSCRIPTION_IDENTIFIER:
+		v, err := r.readVarInt()
+		if err != nil {
+			return err
+		}
+		props.SubscriptionIdentifiers = append(props.SubscriptionIdentifiers, v)
+		return nil
+	}
+	for _, p := range intProperties {
+		if p.id != id {
+			continue
+		}
+		var (
+			v   int
+			err error
+		)
+		switch p.size {
+		case 1:
+			var b byte
+			b, err = r.readByte()
+			v = int(b)
+		case 2:
+			v, err = r.readUint16()
+		default:
+			v, err = r.readUint32()
+		}
+		if err != nil {
+			return err
+		}
+		*p.field(props) = model.Int(v)
+		return nil
+	}
+	for _, p := range stringProperties {
+		if p.id != id {
+			continue
+		}
+		v, err := r.readString()
+		if err != nil {
+			return err
+		}
+		*p.field(props) = v
+		return nil
+	}
+	return ErrMalformedPacket
+}
+
+//写入变长整数
+func appendVarInt(arr []byte, x int) []byte {
+	for {
+		b := byte(x % 128)
+		x /= 128
+		if x > 0 {
+			b |= 128
+		}
+		arr = append(arr, b)
+		if x == 0 {
+			return arr
+		}
+	}
+}
+
+func appendUint16(arr []byte, v int) []byte {
+	return append(arr, byte(v>>8), byte(v))
+}
+
+func appendUint32(arr []byte, v int) []byte {
+	return append(arr, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//写入带两字节长度前缀的字符串
+func appendString(arr []byte, s string) []byte {
+	arr = appendUint16(arr, len(s))
+	return append(arr, s...)
+}
+
+//写入属性长度和属性, props为nil时写入长度0
+func appendProperties(arr []byte, props *model.Properties) []byte {
+	body := encodeProperties(props)
+	arr = appendVarInt(arr, len(body))
+	return append(arr, body...)
+}
+
+func encodeProperties(props *model.Properties) []byte {
+	var body []byte
+	if props == nil {
+		return body
+	}
+	for _, p := range intProperties {
+		v := *p.field(props)
+		if v == nil {
+			continue
+		}
+		body = append(body, p.id)
+		switch p.size {
+		case 1:
+			body = append(body, byte(*v))
+		case 2:
+			body = appendUint16(body, *v)
+		default:
+			body = appendUint32(body, *v)
+		}
+	}
+	for _, p := range stringProperties {
+		if v := *p.field(props); v != "" {
+			body = append(body, p.id)
+			body = appendString(body, v)
+		}
+	}
+	for _, id := range props.SubscriptionIdentifiers {
+		body = append(body, constant.MQTT_PROP_SUBSCRIPTION_IDENTIFIER)
+		body = appendVarInt(body, id)
+	}
+	for _, up := range props.UserProperties {
+		body = append(body, constant.MQTT_PROP_USER_PROPERTY)
+		body = appendString(body, up.Key)
+		body = appendString(body, up.Value)
+	}
+	return body
+}
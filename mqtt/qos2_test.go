@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"net"
+	"newgateway/constant"
+	"newgateway/model"
+	"testing"
+)
+
+//使用本地tcp连接, 写入有缓冲, 同步写回响应时不会阻塞测试
+func newPipeClient(t *testing.T) (*Client, *Decoder, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &Client{
+		Conn:          server,
+		AssureClosing: make(chan bool),
+		Session:       newSession("c1", false),
+	}
+	return cli, NewDecoder(conn), func() {
+		server.Close()
+		conn.Close()
+	}
+}
+
+func decodeType(t *testing.T, dec *Decoder, packageType int) *model.MQTTMessage {
+	msg, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.FixedHeader.PackageType != packageType {
+		t.Fatalf("expected packet type %d, got %d", packageType, msg.FixedHeader.PackageType)
+	}
+	return msg
+}
+
+func ackMessage(packageType, id int) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader:    &model.FixedHeader{PackageType: packageType, RemainingLength: 2},
+		VariableHeader: &model.VariableHeader{MessageId: id},
+	}
+}
+
+func TestQos2Outbound(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+
+	pub := testPublish(0)
+	pub.FixedHeader.SpecificToken.Qos = 2
+	pub.FixedHeader.RemainingLength = 2 + len("a/b") + 2
+	go cli.deliver(pub, nil)
+	msg := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBLISH)
+	id := msg.VariableHeader.MessageId
+	if msg.FixedHeader.SpecificToken.Qos != 2 || id == 0 {
+		t.Fatalf("unexpected publish qos %d id %d", msg.FixedHeader.SpecificToken.Qos, id)
+	}
+
+	//PUBACK不能确认qos2消息
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBACK, id))
+	if len(cli.Session.Inflight) != 1 {
+		t.Fatal("qos2 message should not be acknowledged by puback")
+	}
+
+	//未收到PUBREC前重发PUBLISH
+	if msgs := cli.Session.retransmit(0); len(msgs) != 1 || msgs[0].FixedHeader.PackageType != constant.MQTT_MSG_TYPE_PUBLISH || msgs[0].FixedHeader.SpecificToken.DUP != 1 {
+		t.Fatalf("expected publish to be retransmitted, got %v", msgs)
+	}
+
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, id))
+	if rel := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBREL); rel.VariableHeader.MessageId != id {
+		t.Fatalf("unexpected pubrel id %d", rel.VariableHeader.MessageId)
+	}
+
+	//重复的PUBREC再次返回PUBREL
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, id))
+	decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBREL)
+
+	//收到PUBREC后只重发PUBREL
+	if msgs := cli.Session.retransmit(0); len(msgs) != 1 || msgs[0].FixedHeader.PackageType != constant.MQTT_MSG_TYPE_PUBREL {
+		t.Fatalf("expected pubrel to be retransmitted, got %v", msgs)
+	}
+
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBCOMP, id))
+	if len(cli.Session.Inflight) != 0 {
+		t.Fatal("expected message to be completed by pubcomp")
+	}
+	//重复的PUBCOMP被忽略
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBCOMP, id))
+}
+
+func TestQos2UnknownPubrec(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, 9))
+	if rel := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBREL); rel.VariableHeader.MessageId != 9 {
+		t.Fatalf("unexpected pubrel id %d", rel.VariableHeader.MessageId)
+	}
+	if len(cli.Session.Inflight) != 0 {
+		t.Fatal("unknown pubrec should not create inflight message")
+	}
+}
+
+func TestDealResponseOrder(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+
+	//响应按请求的顺序写回
+	for i := 1; i <= 20; i++ {
+		cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBREL, i))
+		cli.Deal(&model.MQTTMessage{FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_PINGREQ}})
+	}
+	for i := 1; i <= 20; i++ {
+		if comp := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBCOMP); comp.VariableHeader.MessageId != i {
+			t.Fatalf("expected pubcomp %d, got %d", i, comp.VariableHeader.MessageId)
+		}
+		decodeType(t, dec, constant.MQTT_MSG_TYPE_PINGRESP)
+	}
+}
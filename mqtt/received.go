@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"newgateway/model"
+	"time"
+)
+
+//查找已收到但还未收到PUBREL的qos2消息, 存在时返回之前回复的PUBREC
+func (s *Session) received(messageId int) (*model.MQTTMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if received, ok := s.Received[messageId]; ok {
+		return received.Message, true
+	}
+	return nil, false
+}
+
+//记录等待PUBREL的PUBREC消息
+func (s *Session) storeReceived(pubrec *model.MQTTMessage) {
+	s.mu.Lock()
+	s.Received[pubrec.VariableHeader.MessageId] = &InflightMessage{
+		Message: pubrec,
+		SentAt:  time.Now(),
+	}
+	s.mu.Unlock()
+	s.saveLater()
+}
+
+//等待PUBREL的qos2消息数量
+func (s *Session) receivedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Received)
+}
+
+//收到PUBREL后删除, 返回消息是否存在
+func (s *Session) removeReceived(messageId int) bool {
+	s.mu.Lock()
+	_, ok := s.Received[messageId]
+	delete(s.Received, messageId)
+	s.mu.Unlock()
+	if ok {
+		s.saveLater()
+	}
+	return ok
+}
+
+//返回需要重发的PUBREC, 重发间隔从interval开始每次翻倍, 最大为maxInterval
+func (s *Session) resendReceived(interval, maxInterval time.Duration) []*model.MQTTMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var msgs []*model.MQTTMessage
+	for _, received := range s.Received {
+		if now.Sub(received.SentAt) < backoff(interval, maxInterval, received.Retries) {
+			continue
+		}
+		received.SentAt = now
+		received.Retries++
+		msgs = append(msgs, received.Message)
+	}
+	sortMessages(msgs)
+	return msgs
+}
+
+//第retries次重发前的等待时间
+func backoff(interval, maxInterval time.Duration, retries int) time.Duration {
+	d := interval
+	//最多翻倍16次, 避免溢出
+	for i := 0; i < retries && i < 16; i++ {
+		d *= 2
+		if maxInterval > 0 && d >= maxInterval {
+			return maxInterval
+		}
+	}
+	return d
+}
@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"newgateway/constant"
+	"newgateway/model"
+	"testing"
+	"time"
+)
+
+func testQos2Publish(id int) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:     constant.MQTT_MSG_TYPE_PUBLISH,
+			SpecificToken:   &model.SpecificToken{Qos: 2},
+			RemainingLength: 2 + len("a/b") + 2 + len("hello"),
+		},
+		VariableHeader: &model.VariableHeader{TopicName: "a/b", MessageId: id},
+		Payload:        &model.Payload{Data: "hello"},
+	}
+}
+
+func TestQos2InboundDuplicate(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+	//发布前已记录的报文标识符视为重复消息, 不会再次发布
+	cli.Session.storeReceived(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, 7))
+
+	dup := testQos2Publish(7)
+	dup.FixedHeader.SpecificToken.DUP = 1
+	cli.Deal(dup)
+	if rec := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBREC); rec.VariableHeader.MessageId != 7 {
+		t.Fatalf("unexpected pubrec id %d", rec.VariableHeader.MessageId)
+	}
+
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBREL, 7))
+	if comp := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBCOMP); comp.VariableHeader.MessageId != 7 {
+		t.Fatalf("unexpected pubcomp id %d", comp.VariableHeader.MessageId)
+	}
+	if _, ok := cli.Session.received(7); ok {
+		t.Fatal("expected received message to be released by pubrel")
+	}
+}
+
+func TestResendReceivedBackoff(t *testing.T) {
+	s := newSession("c1", false)
+	s.storeReceived(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, 1))
+	if msgs := s.resendReceived(time.Hour, time.Hour); len(msgs) != 0 {
+		t.Fatal("pubrec should not be resent before interval")
+	}
+	s.Received[1].SentAt = time.Now().Add(-time.Minute)
+	if msgs := s.resendReceived(time.Minute, 0); len(msgs) != 1 {
+		t.Fatal("expected pubrec to be resent")
+	}
+	//第二次重发需要等待两倍的间隔
+	s.Received[1].SentAt = time.Now().Add(-time.Minute)
+	if msgs := s.resendReceived(time.Minute, 0); len(msgs) != 0 {
+		t.Fatal("expected backoff before second resend")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		retries  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 10 * time.Second},
+	}
+	for _, c := range cases {
+		if d := backoff(time.Second, 10*time.Second, c.retries); d != c.expected {
+			t.Errorf("backoff(%d) = %v, expected %v", c.retries, d, c.expected)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package mqtt
+
+import (
+	"newgateway/config"
+	"newgateway/constant"
+	"newgateway/logger"
+	"sync"
+	"time"
+)
+
+var sessionManager *SessionManager
+
+func init() {
+	store, err := NewSessionStore()
+	if err != nil {
+		panic(err)
+	}
+	m, err := NewSessionManager(store, time.Duration(config.GetConfig().Session.ExpiryInterval)*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	m.InflightWindow = config.GetConfig().Server.InflightWindow
+	m.SaveDelay = time.Duration(config.GetConfig().Session.SaveInterval) * time.Millisecond
+	if m.SaveDelay == 0 {
+		m.SaveDelay = 100 * time.Millisecond
+	}
+	sessionManager = m
+	go sessionManager.Sweep(time.Minute)
+}
+
+//获取全局的会话管理
+func GetSessionManager() *SessionManager {
+	return sessionManager
+}
+
+//客户端会话, CleanSession=0时在断开连接后保留, 重连后继续投递
+type Session struct {
+	ClientId string
+	//CleanSession=0
+	Persistent bool
+	//订阅, 主题过滤器 -> 订阅
+	Subscriptions map[string]*Subscription
+	//已发送但未确认的qos1/qos2消息, 报文标识符 -> 消息
+	Inflight map[int]*InflightMessage
+	//已收到qos2消息并回复了PUBREC, 等待PUBREL, 报文标识符 -> PUBREC消息
+	Received map[int]*InflightMessage
+	//下一个尝试分配的报文标识符
+	NextMessageId int
+	//断开连接后的过期时间, 连接中时为零值
+	ExpireAt time.Time
+	//mqtt5客户端指定的会话过期时间, 单位秒, 0表示使用配置的过期时间, SessionNeverExpire表示不过期
+	ExpiryInterval int
+
+	//当前使用该会话的客户端
+	client *Client
+	//持久会话的存储, 非持久会话为nil
+	store SessionStore
+	//合并保存的等待时间, 0表示每次修改都立即保存
+	saveDelay time.Duration
+	//有等待合并保存的修改时不为nil
+	saveTimer *time.Timer
+	//保证按顺序写入存储, 后保存的内容不会被之前的保存覆盖
+	saveMu sync.Mutex
+	//发送窗口, 限制同时等待确认的消息数量
+	window chan struct{}
+	mu     sync.Mutex
+}
+
+func newSession(clientId string, persistent bool) *Session {
+	return &Session{
+		ClientId:      clientId,
+		Persistent:    persistent,
+		Subscriptions: make(map[string]*Subscription),
+		Inflight:      make(map[int]*InflightMessage),
+		Received:      make(map[int]*InflightMessage),
+		NextMessageId: 1,
+	}
+}
+
+//立即保存持久会话, 包括等待合并保存的修改, 失败时只记录日志
+func (s *Session) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	store := s.store
+	s.stopSaveTimer()
+	s.mu.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.Save(s); err != nil {
+		logger.Error("save session of client["+s.ClientId+"] failed: ", err)
+	}
+}
+
+//合并saveDelay内的多次修改后保存, 用于每条qos1/qos2消息都会产生的修改
+//进程崩溃时最多丢失saveDelay内的修改, 未确认的消息会从kafka重新投递
+func (s *Session) saveLater() {
+	s.mu.Lock()
+	if s.store == nil || s.saveTimer != nil {
+		s.mu.Unlock()
+		return
+	}
+	if s.saveDelay <= 0 {
+		s.mu.Unlock()
+		s.save()
+		return
+	}
+	s.saveTimer = time.AfterFunc(s.saveDelay, s.flush)
+	s.mu.Unlock()
+}
+
+//保存等待合并保存的修改, 没有时不保存
+func (s *Session) flush() {
+	s.mu.Lock()
+	pending := s.saveTimer != nil
+	s.mu.Unlock()
+	if pending {
+		s.save()
+	}
+}
+
+//需要持有s.mu
+func (s *Session) stopSaveTimer() {
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+}
+
+//不再保存会话, 返回之前是否保存在存储中
+//删除存储中的会话前调用, 等待正在进行的保存完成, 避免删除后又被写入
+func (s *Session) detachStore() bool {
+	s.mu.Lock()
+	stored := s.store != nil
+	s.store = nil
+	s.stopSaveTimer()
+	s.mu.Unlock()
+	s.saveMu.Lock()
+	s.saveMu.Unlock()
+	return stored
+}
+
+//断开连接后是否保留会话
+func (s *Session) isPersistent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Persistent
+}
+
+//记录订阅, 使进程重启后也能恢复
+func (s *Session) storeSubscription(sub *Subscription) {
+	s.mu.Lock()
+	s.Subscriptions[sub.Filter] = sub
+	s.mu.Unlock()
+	s.save()
+}
+
+//删除订阅
+func (s *Session) removeSubscription(filter string) {
+	s.mu.Lock()
+	delete(s.Subscriptions, filter)
+	s.mu.Unlock()
+	s.save()
+}
+
+//按客户端id管理会话
+type SessionManager struct {
+	sessions map[string]*Session
+	//持久会话的存储
+	store SessionStore
+	//断开连接后会话的保留时间, 0表示不过期
+	expiry time.Duration
+	//每个客户端同时等待确认的最大消息数, 0表示只受报文标识符数量限制
+	InflightWindow int
+	//合并保存未确认消息等修改的等待时间, 0表示每次修改都立即保存
+	SaveDelay time.Duration
+	mu        sync.Mutex
+}
+
+//创建会话管理, 并加载存储中保存的会话
+func NewSessionManager(store SessionStore, expiry time.Duration) (*SessionManager, error) {
+	m := &SessionManager{
+		sessions: make(map[string]*Session),
+		store:    store,
+		expiry:   expiry,
+	}
+	sessions, err := store.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		s.store = store
+		//进程退出时仍在线的会话从现在开始计算过期时间
+		if d := m.expiryOf(s); s.ExpireAt.IsZero() && d > 0 {
+			s.ExpireAt = time.Now().Add(d)
+		}
+		m.sessions[s.ClientId] = s
+	}
+	if len(sessions) > 0 {
+		logger.Infof("loaded %d sessions", len(sessions))
+	}
+	return m, nil
+}
+
+//为客户端取得会话, 返回的bool表示是否沿用了已有的会话
+//clean为true时丢弃已有会话并创建新会话, persistent表示断开连接后是否保留会话
+//mqtt3中两者相反, mqtt5中分别由Clean Start和会话过期时间决定; 同一客户端id已在线时先断开旧连接
+func (m *SessionManager) Acquire(cli *Client, clean, persistent bool) (*Session, bool) {
+	for {
+		m.mu.Lock()
+		s, ok := m.sessions[cli.ClientId]
+		if ok && s.client != nil && s.client != cli {
+			//同一客户端id重复连接, 断开旧连接, 旧连接关闭时会释放会话
+			old := s.client
+			m.mu.Unlock()
+			logger.Warn("client[" + cli.ClientId + "] reconnected, closing previous connection")
+			old.Disconnect(constant.MQTT_REASON_SESSION_TAKEN_OVER)
+			m.mu.Lock()
+			if s.client == old {
+				s.client = nil
+			}
+			m.mu.Unlock()
+			continue
+		}
+		present := ok && !clean && !m.expired(s)
+		if !present {
+			if ok && s.detachStore() {
+				m.deleteStored(cli.ClientId)
+			}
+			s = newSession(cli.ClientId, persistent)
+			//客户端id为空时不保存会话
+			if cli.ClientId != "" {
+				m.sessions[cli.ClientId] = s
+			}
+		}
+		s.ExpireAt = time.Time{}
+		s.client = cli
+		s.mu.Lock()
+		s.Persistent = persistent
+		s.ExpiryInterval = cli.SessionExpiryInterval
+		if persistent {
+			s.store = m.store
+		}
+		s.saveDelay = m.SaveDelay
+		s.mu.Unlock()
+		s.resetWindow(m.window(cli))
+		m.mu.Unlock()
+		s.save()
+		return s, present
+	}
+}
+
+//客户端断开连接时释放会话
+//持久会话保存订阅和未确认的消息并开始计算过期时间, 否则直接删除
+func (m *SessionManager) Release(cli *Client, subscriptions []*Subscription) {
+	s := cli.Session
+	if s == nil {
+		return
+	}
+	m.mu.Lock()
+	if s.client != cli {
+		m.mu.Unlock()
+		return
+	}
+	s.client = nil
+	//Persistent由s.mu保护, 可能同时被DISCONNECT修改
+	if !s.isPersistent() {
+		if m.sessions[s.ClientId] == s {
+			delete(m.sessions, s.ClientId)
+		}
+		m.mu.Unlock()
+		//mqtt5客户端可以在DISCONNECT中将会话改为不保留
+		if s.detachStore() {
+			m.deleteStored(s.ClientId)
+		}
+		return
+	}
+	s.mu.Lock()
+	s.Subscriptions = make(map[string]*Subscription, len(subscriptions))
+	for _, sub := range subscriptions {
+		s.Subscriptions[sub.Filter] = sub
+	}
+	if d := m.expiryOf(s); d > 0 {
+		s.ExpireAt = time.Now().Add(d)
+	}
+	s.mu.Unlock()
+	m.mu.Unlock()
+	s.save()
+}
+
+//会话断开连接后的保留时间, 0表示不过期
+func (m *SessionManager) expiryOf(s *Session) time.Duration {
+	switch s.ExpiryInterval {
+	case 0:
+		return m.expiry
+	case SessionNeverExpire:
+		return 0
+	}
+	return time.Duration(s.ExpiryInterval) * time.Second
+}
+
+//发送窗口大小, 不超过mqtt5客户端的Receive Maximum
+func (m *SessionManager) window(cli *Client) int {
+	size := m.InflightWindow
+	if cli.ReceiveMaximum > 0 && (size <= 0 || cli.ReceiveMaximum < size) {
+		size = cli.ReceiveMaximum
+	}
+	return size
+}
+
+func (m *SessionManager) expired(s *Session) bool {
+	return s.client == nil && !s.ExpireAt.IsZero() && time.Now().After(s.ExpireAt)
+}
+
+func (m *SessionManager) deleteStored(clientId string) {
+	if err := m.store.Delete(clientId); err != nil {
+		logger.Error("delete session of client["+clientId+"] failed: ", err)
+	}
+}
+
+//定期清理过期的会话
+func (m *SessionManager) Sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.mu.Lock()
+		for id, s := range m.sessions {
+			if m.expired(s) {
+				logger.Info("session of client[" + id + "] expired")
+				delete(m.sessions, id)
+				s.detachStore()
+				m.deleteStored(id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+//保存所有等待合并保存的修改并关闭会话存储, 应在所有客户端关闭后调用
+func (m *SessionManager) Close() error {
+	m.mu.Lock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.flush()
+	}
+	return m.store.Close()
+}
@@ -0,0 +1,199 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"newgateway/constant"
+	"newgateway/model"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录保存次数的会话存储
+type countingStore struct {
+	*MemoryStore
+	saves int32
+}
+
+func (c *countingStore) Save(s *Session) error {
+	atomic.AddInt32(&c.saves, 1)
+	return c.MemoryStore.Save(s)
+}
+
+func newTestSessionManager(t *testing.T, store SessionStore, expiry time.Duration) *SessionManager {
+	m, err := NewSessionManager(store, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSessionPersistent(t *testing.T) {
+	m := newTestSessionManager(t, NewMemoryStore(), time.Hour)
+	cli := &Client{ClientId: "c1"}
+	s, present := m.Acquire(cli, false, true)
+	if present {
+		t.Fatal("new session should not be present")
+	}
+	cli.Session = s
+	m.Release(cli, []*Subscription{{Filter: "a/#", Qos: 1}})
+
+	cli2 := &Client{ClientId: "c1"}
+	s2, present := m.Acquire(cli2, false, true)
+	if !present || s2 != s {
+		t.Fatal("expected persistent session to be resumed")
+	}
+	if sub := s2.Subscriptions["a/#"]; sub == nil || sub.Qos != 1 {
+		t.Fatalf("unexpected subscriptions %v", s2.Subscriptions)
+	}
+}
+
+func TestSessionClean(t *testing.T) {
+	m := newTestSessionManager(t, NewMemoryStore(), time.Hour)
+	cli := &Client{ClientId: "c1"}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	m.Release(cli, nil)
+
+	cli2 := &Client{ClientId: "c1"}
+	if _, present := m.Acquire(cli2, true, false); present {
+		t.Fatal("clean session should discard previous session")
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	m := newTestSessionManager(t, NewMemoryStore(), time.Millisecond)
+	cli := &Client{ClientId: "c1"}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	m.Release(cli, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	cli2 := &Client{ClientId: "c1"}
+	if _, present := m.Acquire(cli2, false, true); present {
+		t.Fatal("expired session should not be resumed")
+	}
+}
+
+func TestBoltStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.db")
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestSessionManager(t, store, time.Hour)
+	cli := &Client{ClientId: "c1"}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	cli.Session.storeInflight(&model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{
+			PackageType:   constant.MQTT_MSG_TYPE_PUBLISH,
+			SpecificToken: &model.SpecificToken{Qos: 1},
+		},
+		VariableHeader: &model.VariableHeader{TopicName: "a/b", MessageId: 3},
+		Payload:        &model.Payload{Data: "hello"},
+	})
+	cli.Session.storeReceived(&model.MQTTMessage{
+		FixedHeader:    &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_PUBREC},
+		VariableHeader: &model.VariableHeader{MessageId: 5},
+	})
+	sub := &Subscription{Filter: "a/#", Qos: 1}
+	sub.SetOffset("a", 0, 42)
+	m.Release(cli, []*Subscription{sub})
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//模拟进程重启
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = newTestSessionManager(t, store, time.Hour)
+	defer m.Close()
+	cli = &Client{ClientId: "c1"}
+	s, present := m.Acquire(cli, false, true)
+	if !present {
+		t.Fatal("expected session to survive restart")
+	}
+	if msg := s.Inflight[3]; msg == nil || msg.Message.Payload.Data != "hello" {
+		t.Fatalf("unexpected inflight %v", s.Inflight)
+	}
+	if _, ok := s.Received[5]; !ok {
+		t.Fatalf("unexpected received %v", s.Received)
+	}
+	if sub := s.Subscriptions["a/#"]; sub == nil || sub.Offsets["a"][0] != 42 {
+		t.Fatalf("unexpected subscriptions %v", s.Subscriptions)
+	}
+}
+
+func TestSessionSaveLater(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	m := newTestSessionManager(t, store, time.Hour)
+	m.SaveDelay = time.Hour
+	cli := &Client{ClientId: "c1"}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	saves := atomic.LoadInt32(&store.saves)
+
+	//多次修改合并保存, 关闭时保存等待中的修改
+	for i := 0; i < 10; i++ {
+		if err := cli.Session.allocateInflight(testPublish(0), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&store.saves); n != saves {
+		t.Fatalf("expected saves to be delayed, got %d more", n-saves)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&store.saves); n != saves+1 {
+		t.Fatalf("expected one merged save, got %d", n-saves)
+	}
+	sessions, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || len(sessions[0].Inflight) != 10 {
+		t.Fatalf("unexpected stored sessions %v", sessions)
+	}
+}
+
+func TestSessionDeleteCancelsSave(t *testing.T) {
+	store := NewMemoryStore()
+	m := newTestSessionManager(t, store, time.Hour)
+	m.SaveDelay = 10 * time.Millisecond
+	cli := &Client{ClientId: "c1"}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	cli.Session.storeReceived(ackMessage(constant.MQTT_MSG_TYPE_PUBREC, 1))
+
+	//clean session丢弃旧会话后, 等待中的保存不能重新写入
+	cli2 := &Client{ClientId: "c1"}
+	cli.Session.client = nil
+	m.Acquire(cli2, true, false)
+	time.Sleep(30 * time.Millisecond)
+	if sessions, _ := store.LoadAll(); len(sessions) != 0 {
+		t.Fatalf("expected session to be deleted, got %v", sessions)
+	}
+}
+
+//DISCONNECT中修改会话过期时间, 同时连接关闭释放会话
+func TestSessionExpiryUpdateConcurrent(t *testing.T) {
+	m := newTestSessionManager(t, NewMemoryStore(), time.Hour)
+	cli := &Client{ClientId: "c1", ProtocolVersion: constant.MQTT_PROTOCOL_LEVEL_5, SessionExpiryInterval: 60}
+	cli.Session, _ = m.Acquire(cli, false, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cli.updateSessionExpiry(&model.Properties{SessionExpiryInterval: model.Int(0)})
+	}()
+	//不通过channel等待, 使race检测能发现没有加锁的读取
+	time.Sleep(10 * time.Millisecond)
+	m.Release(cli, nil)
+	<-done
+}
@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/constant"
+	"newgateway/kafka"
+	"newgateway/topic"
+	"sync"
+	"testing"
+)
+
+type testCommitter struct {
+	delivered []int64
+	acked     []int64
+	mu        sync.Mutex
+}
+
+func (c *testCommitter) Deliver(message *sarama.ConsumerMessage) {
+	c.mu.Lock()
+	c.delivered = append(c.delivered, message.Offset)
+	c.mu.Unlock()
+}
+
+func (c *testCommitter) Ack(message *sarama.ConsumerMessage) {
+	c.mu.Lock()
+	c.acked = append(c.acked, message.Offset)
+	c.mu.Unlock()
+}
+
+func (c *testCommitter) ackedOffsets() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int64(nil), c.acked...)
+}
+
+func consumerMessage(mqttTopic string, offset int64) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:  "jobs",
+		Offset: offset,
+		Value:  []byte("payload"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(kafka.HeaderMQTTTopic), Value: []byte(mqttTopic)},
+		},
+	}
+}
+
+func TestConsumeShared(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+
+	group, topicFilter, ok := topic.ParseShared("$share/workers/jobs/+")
+	if !ok || group != "workers" {
+		t.Fatalf("unexpected shared subscription %q %q", group, topicFilter)
+	}
+	sub := &Subscription{Filter: "$share/workers/jobs/+", Qos: 1, topicFilter: topicFilter}
+	committer := &testCommitter{}
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	messages <- consumerMessage("other/1", 1)
+	messages <- consumerMessage("jobs/1", 2)
+	close(messages)
+	go cli.consume(messages, committer, sub)
+
+	//按去掉前缀的过滤器匹配, 不匹配的消息直接确认
+	msg := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBLISH)
+	if msg.VariableHeader.TopicName != "jobs/1" {
+		t.Fatalf("unexpected topic %q", msg.VariableHeader.TopicName)
+	}
+	if acked := committer.ackedOffsets(); len(acked) != 1 || acked[0] != 1 {
+		t.Fatalf("expected only filtered message to be acked, got %v", acked)
+	}
+	//客户端确认后提交
+	cli.Deal(ackMessage(constant.MQTT_MSG_TYPE_PUBACK, msg.VariableHeader.MessageId))
+	if acked := committer.ackedOffsets(); len(acked) != 2 || acked[1] != 2 {
+		t.Fatalf("expected message to be acked after puback, got %v", acked)
+	}
+}
+
+func TestDeliveryQos(t *testing.T) {
+	cases := []struct {
+		header string
+		qos    int
+		expect int
+	}{
+		{"", 1, 1},
+		{"0", 2, 0},
+		{"1", 2, 1},
+		{"2", 1, 1},
+		{"invalid", 1, 1},
+	}
+	for _, c := range cases {
+		message := consumerMessage("jobs/1", 1)
+		if c.header != "" {
+			message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(kafka.HeaderQos), Value: []byte(c.header)})
+		}
+		if qos := deliveryQos(c.qos, message); qos != c.expect {
+			t.Errorf("header %q subscription qos %d: expected %d, got %d", c.header, c.qos, c.expect, qos)
+		}
+	}
+}
+
+func TestConsumeDowngradeQos(t *testing.T) {
+	cli, dec, closeFn := newPipeClient(t)
+	defer closeFn()
+
+	sub := &Subscription{Filter: "jobs/+", Qos: 2, topicFilter: "jobs/+"}
+	committer := &testCommitter{}
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	message := consumerMessage("jobs/1", 1)
+	message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(kafka.HeaderQos), Value: []byte("0")})
+	messages <- message
+	close(messages)
+	go cli.consume(messages, committer, sub)
+
+	//qos0发布的消息按qos0发送, 发送后直接确认
+	msg := decodeType(t, dec, constant.MQTT_MSG_TYPE_PUBLISH)
+	if msg.FixedHeader.SpecificToken.Qos != 0 {
+		t.Fatalf("expected qos 0, got %d", msg.FixedHeader.SpecificToken.Qos)
+	}
+	if len(cli.Session.Inflight) != 0 {
+		t.Fatal("qos0 message should not be inflight")
+	}
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"newgateway/config"
+	"sync"
+)
+
+//会话存储方式
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreBolt   = "bolt"
+)
+
+//会话存储, 保存持久会话的订阅、未确认的消息和等待PUBREL的消息
+type SessionStore interface {
+	//读取所有保存的会话
+	LoadAll() ([]*Session, error)
+	//保存会话, 已存在时覆盖
+	Save(s *Session) error
+	//删除会话
+	Delete(clientId string) error
+	Close() error
+}
+
+//根据配置创建会话存储, 默认保存在内存中
+func NewSessionStore() (SessionStore, error) {
+	cfg := config.GetConfig().Session
+	switch cfg.Store {
+	case "", SessionStoreMemory:
+		return NewMemoryStore(), nil
+	case SessionStoreBolt:
+		return NewBoltStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", cfg.Store)
+	}
+}
+
+//将会话序列化为json
+func encodeSession(s *Session) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s)
+}
+
+func decodeSession(data []byte) (*Session, error) {
+	s := newSession("", true)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//内存中的会话存储, 进程重启后丢失
+type MemoryStore struct {
+	sessions map[string][]byte
+	mu       sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string][]byte),
+	}
+}
+
+func (m *MemoryStore) LoadAll() ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, data := range m.sessions {
+		s, err := decodeSession(data)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) Save(s *Session) error {
+	data, err := encodeSession(s)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.sessions[s.ClientId] = data
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) Delete(clientId string) error {
+	m.mu.Lock()
+	delete(m.sessions, clientId)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
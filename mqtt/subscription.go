@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"newgateway/kafka"
+	"newgateway/model"
+	"newgateway/router"
+	"sync"
+)
+
+//客户端对一个主题过滤器的订阅, 一个过滤器可能对应多个kafka topic
+type Subscription struct {
+	//订阅时的主题过滤器
+	Filter string
+	//授予的Qos
+	Qos int
+	//mqtt5订阅选项, 不接收自己发布的消息
+	NoLocal bool
+	//mqtt5订阅选项, 保持消息发布时的retain标志
+	RetainAsPublished bool
+	//kafka topic -> 分区 -> 下一条要投递的offset, 会话恢复时从这里继续消费
+	Offsets map[string]map[int32]int64
+	//共享订阅对应的kafka消费组, 不是共享订阅时为nil
+	Shared *kafka.SharedSubscriber `json:"-"`
+	//在路由中的订阅, 共享订阅时为nil
+	Routed *router.Subscriber `json:"-"`
+
+	//去掉共享订阅前缀后用于匹配主题的过滤器
+	topicFilter string
+	mu          sync.Mutex
+}
+
+//记录已投递的消息位置
+func (s *Subscription) SetOffset(topic string, partition int32, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Offsets == nil {
+		s.Offsets = make(map[string]map[int32]int64)
+	}
+	if s.Offsets[topic] == nil {
+		s.Offsets[topic] = make(map[int32]int64)
+	}
+	s.Offsets[topic][partition] = offset
+}
+
+//复制一份不包含kafka订阅的快照, 用于保存到会话中
+func (s *Subscription) Snapshot() *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := &Subscription{
+		Filter:            s.Filter,
+		Qos:               s.Qos,
+		NoLocal:           s.NoLocal,
+		RetainAsPublished: s.RetainAsPublished,
+		Offsets:           make(map[string]map[int32]int64, len(s.Offsets)),
+	}
+	for topic, partitions := range s.Offsets {
+		snapshot.Offsets[topic] = make(map[int32]int64, len(partitions))
+		for p, o := range partitions {
+			snapshot.Offsets[topic][p] = o
+		}
+	}
+	return snapshot
+}
+
+//还原为subscribe中的主题过滤器和订阅选项, 用于恢复会话
+func (s *Subscription) options() *model.Subscription {
+	sub := &model.Subscription{
+		TopicFilter: s.Filter,
+		Qos:         s.Qos,
+	}
+	if s.NoLocal {
+		sub.NoLocal = 1
+	}
+	if s.RetainAsPublished {
+		sub.RetainAsPublished = 1
+	}
+	return sub
+}
+
+//关闭过滤器的kafka订阅
+func (s *Subscription) Close() {
+	if s.Shared != nil {
+		s.Shared.Close()
+	}
+	if s.Routed != nil {
+		s.Routed.Close()
+	}
+}
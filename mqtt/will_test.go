@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"newgateway/constant"
+	"newgateway/model"
+	"testing"
+)
+
+func connectWithWill(willTopic string, qos, retain int) *model.MQTTMessage {
+	return &model.MQTTMessage{
+		FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_CONNECT},
+		VariableHeader: &model.VariableHeader{
+			ConnectFlags: &model.ConnectFlags{WillFlag: 1, WillQos: qos, WillRetain: retain},
+		},
+		Payload: &model.Payload{WillTopic: willTopic, WillMessage: "offline"},
+	}
+}
+
+func TestSetWill(t *testing.T) {
+	cli := &Client{ClientId: "c1"}
+	cli.SetWill(connectWithWill("devices/c1/status", 1, 1))
+	if cli.will == nil {
+		t.Fatal("expected will to be set")
+	}
+	token := cli.will.FixedHeader.SpecificToken
+	if token.Qos != 1 || token.Retain != 1 || cli.will.VariableHeader.TopicName != "devices/c1/status" || cli.will.Payload.Data != "offline" {
+		t.Fatalf("unexpected will %+v %+v", token, cli.will.VariableHeader)
+	}
+
+	//通配符主题不能作为遗嘱主题
+	cli = &Client{ClientId: "c1"}
+	cli.SetWill(connectWithWill("devices/+/status", 0, 0))
+	if cli.will != nil {
+		t.Fatal("invalid will topic should be ignored")
+	}
+}
+
+func TestDisconnectSuppressesWill(t *testing.T) {
+	cli := &Client{ClientId: "c1", Closing: make(chan bool, 1)}
+	cli.SetWill(connectWithWill("devices/c1/status", 0, 0))
+	cli.Deal(&model.MQTTMessage{FixedHeader: &model.FixedHeader{PackageType: constant.MQTT_MSG_TYPE_DISCONNECT}})
+	if !cli.disconnected.Get() {
+		t.Fatal("expected client to be marked as disconnected")
+	}
+	//收到DISCONNECT后不再发布遗嘱, 不会访问kafka
+	cli.publishWill()
+}
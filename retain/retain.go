@@ -0,0 +1,172 @@
+package retain
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/config"
+	"newgateway/kafka"
+	"newgateway/logger"
+	"newgateway/topic"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//等待写入的保留消息数量上限, 队列满时写入方阻塞
+const queueSize = 1024
+
+var store *Store
+
+func init() {
+	store = NewStore()
+	if t := config.GetConfig().Retain.KafkaTopic; t != "" {
+		//从compacted topic中恢复保留消息, 并持续同步其它网关写入的保留消息
+		replayer, err := kafka.Replay(t, store.apply)
+		if err != nil {
+			panic(err)
+		}
+		store.kafkaTopic = t
+		store.replayer = replayer
+	}
+}
+
+//获取按配置文件初始化的保留消息存储
+func GetStore() *Store {
+	return store
+}
+
+//一条保留消息
+type Message struct {
+	Topic   string
+	Payload string
+	Qos     int
+	//过期时间, 零值表示不过期, 过期后不再发送给新订阅者
+	ExpireAt time.Time
+}
+
+//保留消息存储, 每个mqtt主题只保留最新的一条
+//配置了kafka topic时同时写入kafka, 以主题作为key, 由compaction只保留每个主题最新的消息
+type Store struct {
+	messages map[string]*Message
+	//kafka中的备份topic, 为空时只保存在内存中
+	kafkaTopic string
+	//同步其它网关写入的保留消息
+	replayer *kafka.Replayer
+	//等待写入的保留消息, 由一个goroutine按加入的顺序写入
+	queue chan *retainRequest
+	mu    sync.RWMutex
+}
+
+//排队写入的保留消息, done不为nil时通知写入结果
+type retainRequest struct {
+	msg  *Message
+	done chan error
+}
+
+func NewStore() *Store {
+	s := &Store{
+		messages: make(map[string]*Message),
+		queue:    make(chan *retainRequest, queueSize),
+	}
+	go s.work()
+	return s
+}
+
+//停止同步kafka中的保留消息
+func (s *Store) Close() error {
+	if s.replayer == nil {
+		return nil
+	}
+	return s.replayer.Close()
+}
+
+//保存保留消息, payload为空时删除该主题的保留消息, 等待写入完成
+//与RetainAsync使用同一个队列, 同一主题的保留消息按调用顺序写入
+func (s *Store) Retain(msg *Message) error {
+	done := make(chan error, 1)
+	s.queue <- &retainRequest{msg: msg, done: done}
+	return <-done
+}
+
+//异步保存保留消息, 写入失败时只记录日志
+func (s *Store) RetainAsync(msg *Message) {
+	s.queue <- &retainRequest{msg: msg}
+}
+
+//按顺序写入队列中的保留消息
+func (s *Store) work() {
+	for req := range s.queue {
+		err := s.write(req.msg)
+		if req.done != nil {
+			req.done <- err
+		} else if err != nil {
+			logger.Error("retain message of topic["+req.msg.Topic+"] failed: ", err)
+		}
+	}
+}
+
+//更新内存中的保留消息, 并写入kafka
+func (s *Store) write(msg *Message) error {
+	s.set(msg)
+	if s.kafkaTopic == "" {
+		return nil
+	}
+	_, _, err := kafka.Publish(&kafka.Message{
+		Topic:      s.kafkaTopic,
+		Key:        msg.Topic,
+		Value:      msg.Payload,
+		Tombstone:  msg.Payload == "",
+		MQTTTopic:  msg.Topic,
+		Qos:        msg.Qos,
+		Retain:     1,
+		ReceivedAt: time.Now(),
+		ExpireAt:   msg.ExpireAt,
+	})
+	return err
+}
+
+func (s *Store) set(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Payload == "" {
+		delete(s.messages, msg.Topic)
+		return
+	}
+	s.messages[msg.Topic] = msg
+}
+
+//返回与主题过滤器匹配的保留消息
+func (s *Store) Match(filter string) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var msgs []*Message
+	now := time.Now()
+	for name, msg := range s.messages {
+		if !msg.ExpireAt.IsZero() && now.After(msg.ExpireAt) {
+			continue
+		}
+		if topic.Match(filter, name) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+//应用从kafka中读取到的保留消息
+func (s *Store) apply(msg *sarama.ConsumerMessage) {
+	if len(msg.Key) == 0 {
+		return
+	}
+	qos := 0
+	if v, ok := kafka.Header(msg, kafka.HeaderQos); ok {
+		var err error
+		if qos, err = strconv.Atoi(v); err != nil {
+			logger.Warn("invalid qos header of retained message[" + string(msg.Key) + "]")
+		}
+	}
+	s.set(&Message{
+		Topic:    string(msg.Key),
+		Payload:  string(msg.Value),
+		Qos:      qos,
+		ExpireAt: kafka.ExpireAt(msg),
+	})
+}
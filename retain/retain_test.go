@@ -0,0 +1,70 @@
+package retain
+
+import (
+	"github.com/Shopify/sarama"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetain(t *testing.T) {
+	s := NewStore()
+	s.Retain(&Message{Topic: "sensors/a/temp", Payload: "21", Qos: 1})
+	s.Retain(&Message{Topic: "sensors/b/temp", Payload: "22"})
+	s.Retain(&Message{Topic: "sensors/a/temp", Payload: "23", Qos: 1})
+
+	if msgs := s.Match("sensors/+/temp"); len(msgs) != 2 {
+		t.Fatalf("expected 2 retained messages, got %d", len(msgs))
+	}
+	msgs := s.Match("sensors/a/temp")
+	if len(msgs) != 1 || msgs[0].Payload != "23" || msgs[0].Qos != 1 {
+		t.Fatalf("unexpected retained messages %v", msgs)
+	}
+
+	//空消息清除保留消息
+	s.Retain(&Message{Topic: "sensors/a/temp"})
+	if msgs := s.Match("sensors/a/temp"); len(msgs) != 0 {
+		t.Fatalf("expected retained message to be cleared, got %v", msgs)
+	}
+}
+
+func TestApply(t *testing.T) {
+	s := NewStore()
+	s.apply(&sarama.ConsumerMessage{
+		Key:     []byte("status"),
+		Value:   []byte("online"),
+		Headers: []*sarama.RecordHeader{{Key: []byte("mqtt-qos"), Value: []byte("1")}},
+	})
+	msgs := s.Match("#")
+	if len(msgs) != 1 || msgs[0].Topic != "status" || msgs[0].Payload != "online" || msgs[0].Qos != 1 {
+		t.Fatalf("unexpected retained messages %v", msgs)
+	}
+	//tombstone删除保留消息
+	s.apply(&sarama.ConsumerMessage{Key: []byte("status")})
+	if msgs := s.Match("#"); len(msgs) != 0 {
+		t.Fatalf("expected retained message to be deleted, got %v", msgs)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s := NewStore()
+	s.Retain(&Message{Topic: "status", Payload: "online", ExpireAt: time.Now().Add(-time.Second)})
+	s.Retain(&Message{Topic: "version", Payload: "1.0", ExpireAt: time.Now().Add(time.Hour)})
+	msgs := s.Match("#")
+	if len(msgs) != 1 || msgs[0].Topic != "version" {
+		t.Fatalf("expected only unexpired retained message, got %v", msgs)
+	}
+}
+
+func TestRetainAsyncOrder(t *testing.T) {
+	s := NewStore()
+	for i := 0; i < 100; i++ {
+		s.RetainAsync(&Message{Topic: "status", Payload: strconv.Itoa(i)})
+	}
+	//同步写入在之前的异步写入完成后才返回
+	s.Retain(&Message{Topic: "version", Payload: "1.0"})
+	msgs := s.Match("status")
+	if len(msgs) != 1 || msgs[0].Payload != "99" {
+		t.Fatalf("expected the last retained message, got %v", msgs)
+	}
+}
@@ -0,0 +1,751 @@
+package router
+
+import (
+	"github.com/Shopify/sarama"
+	"newgateway/common"
+	"newgateway/config"
+	"newgateway/kafka"
+	"newgateway/logger"
+	"newgateway/mapping"
+	"newgateway/metrics"
+	"newgateway/topic"
+	"sync"
+	"time"
+)
+
+var router *Router
+
+func init() {
+	cfg := config.GetConfig().Kafka.Router
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = 1000
+	}
+	timeout := time.Duration(cfg.BlockTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	router = NewRouter(size, timeout)
+}
+
+//获取按配置文件初始化的订阅路由
+func GetRouter() *Router {
+	return router
+}
+
+//订阅路由, 每个kafka topic只消费一次, 按主题过滤器将消息转发给所有匹配的订阅者
+//topic从最新消息开始消费, 路由本身不提交消费位置
+//持久会话的订阅通过消费组提交已确认的位置, 重连时落后于路由的分区先由短期的追赶消费补发, 追上后加入路由
+type Router struct {
+	//第一次订阅时获取
+	consumer *kafka.Consumer
+	trie     *node
+	//kafka topic -> 消费
+	streams map[string]*stream
+	//所有订阅, 刷新元数据时重新匹配topic
+	subscribers map[*Subscriber]struct{}
+	queueSize   int
+	//队列已满时qos1/qos2消息等待的时间
+	blockTimeout time.Duration
+	mu           sync.RWMutex
+}
+
+//一个kafka topic的消费, 没有订阅者时关闭
+type stream struct {
+	subscriber *kafka.Subscriber
+	refs       int
+	//分区 -> 下一条转发的消息位置
+	next map[int32]int64
+	mu   sync.Mutex
+}
+
+//分区转发到的位置, 转发消息之前更新
+func (st *stream) advance(partition int32, next int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.next == nil {
+		st.next = make(map[int32]int64)
+	}
+	st.next[partition] = next
+}
+
+//分区下一条转发的消息位置, 从最早消息开始消费且还没有转发消息的分区返回false
+func (st *stream) position(partition int32) (int64, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	next, ok := st.next[partition]
+	return next, ok
+}
+
+//kafka topic中的一个分区
+type partition struct {
+	topic string
+	id    int32
+}
+
+//追赶消费空闲时检查是否已经追上路由的间隔
+const joinInterval = 200 * time.Millisecond
+
+func NewRouter(queueSize int, blockTimeout time.Duration) *Router {
+	return &Router{
+		trie:         newNode(),
+		streams:      make(map[string]*stream),
+		subscribers:  make(map[*Subscriber]struct{}),
+		queueSize:    queueSize,
+		blockTimeout: blockTimeout,
+	}
+}
+
+//订阅主题过滤器, 消费所有满足match的kafka topic, qos为订阅授予的Qos
+func (r *Router) Subscribe(filter string, qos int, match func(topic string) bool) (*Subscriber, error) {
+	consumer := r.acquireConsumer()
+	topicList, err := consumer.Topics()
+	if err != nil {
+		return nil, err
+	}
+	s := r.newSubscriber(filter, qos, match)
+	if err := r.attach(s, matchTopics(topicList, match), nil); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.trie.insert(filter, s)
+	r.subscribers[s] = struct{}{}
+	r.mu.Unlock()
+	return s, nil
+}
+
+//持久会话订阅主题过滤器, 已确认的位置提交到消费组group, offsets为会话中记录的各topic分区位置
+//开始位置落后于路由的分区由追赶消费从开始位置补发, 追上路由后关闭追赶消费, 之后的消息由路由转发
+func (r *Router) SubscribePersistent(filter string, qos int, match func(topic string) bool, group string, offsets map[string]map[int32]int64) (*Subscriber, error) {
+	consumer := r.acquireConsumer()
+	topicList, err := consumer.Topics()
+	if err != nil {
+		return nil, err
+	}
+	committer, err := consumer.NewCommitter(group)
+	if err != nil {
+		return nil, err
+	}
+	s := r.newSubscriber(filter, qos, match)
+	s.committer = committer
+	s.catching = make(map[partition]int64)
+	s.joined = make(map[partition]int64)
+	s.catchups = make(map[partition]*kafka.Subscriber)
+	if err := r.attach(s, matchTopics(topicList, match), nil); err != nil {
+		committer.Close()
+		return nil, err
+	}
+	//开始位置需要访问kafka, 在锁外计算
+	starts := make(map[partition]int64)
+	for _, t := range s.topics {
+		partitions, err := consumer.Partitions(t)
+		if err == nil {
+			for _, id := range partitions {
+				var start int64
+				if start, err = committer.StartOffset(t, id, offsets[t]); err != nil {
+					break
+				}
+				starts[partition{t, id}] = start
+			}
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	//持有写锁时没有正在转发的消息, 路由的位置之前的消息需要追赶, 之后的由路由转发
+	r.mu.Lock()
+	for p, start := range starts {
+		st, ok := r.streams[p.topic]
+		if !ok {
+			continue
+		}
+		if next, ok := st.position(p.id); ok && start < next {
+			s.catching[p] = start
+		} else {
+			s.joined[p] = start
+		}
+	}
+	r.trie.insert(filter, s)
+	r.subscribers[s] = struct{}{}
+	catching := make(map[partition]int64, len(s.catching))
+	for p, next := range s.catching {
+		catching[p] = next
+	}
+	r.mu.Unlock()
+	if err := r.startCatchUp(s, catching); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *Router) newSubscriber(filter string, qos int, match func(topic string) bool) *Subscriber {
+	return &Subscriber{
+		Filter:  filter,
+		Qos:     qos,
+		match:   match,
+		queue:   make(chan *sarama.ConsumerMessage, r.queueSize),
+		closing: make(chan struct{}),
+		router:  r,
+	}
+}
+
+//满足match的topic
+func matchTopics(topicList []string, match func(topic string) bool) []string {
+	var topics []string
+	for _, t := range topicList {
+		if match(t) {
+			topics = append(topics, t)
+		}
+	}
+	return topics
+}
+
+//使用单独的kafka消费追赶落后的分区, 路由已经在消费这些分区, 不能用同一个消费
+func (r *Router) startCatchUp(s *Subscriber, catching map[partition]int64) error {
+	if len(catching) == 0 {
+		return nil
+	}
+	consumer := kafka.GetConsumer()
+	s.cmu.Lock()
+	if s.catchups == nil {
+		//订阅已经关闭
+		s.cmu.Unlock()
+		consumer.Release()
+		return nil
+	}
+	s.catchConsumer = consumer
+	s.cmu.Unlock()
+	for p, next := range catching {
+		logger.Info("subscription[" + s.Filter + "] catching up topic[" + p.topic + "]")
+		sub, err := consumer.ConsumePartitions(p.topic, map[int32]int64{p.id: next})
+		if err != nil {
+			return err
+		}
+		s.cmu.Lock()
+		if s.catchups == nil {
+			//订阅已经关闭
+			s.cmu.Unlock()
+			sub.Close()
+			return nil
+		}
+		s.catchups[p] = sub
+		s.catchWG.Add(1)
+		s.cmu.Unlock()
+		go r.catchUp(s, p, sub.PartitionConsumer(p.id))
+	}
+	return nil
+}
+
+//补发分区中路由开始转发之前的消息, 追上路由或订阅关闭后退出
+//分区中可能有不存在的offset(压缩或事务标记), 追赶消费空闲且已读到路由的位置时也认为已经追上
+func (r *Router) catchUp(s *Subscriber, p partition, pc sarama.PartitionConsumer) {
+	ticker := time.NewTicker(joinInterval)
+	defer ticker.Stop()
+	idle := false
+	for {
+		select {
+		case message, ok := <-pc.Messages():
+			if !ok || !r.catchUpMessage(s, p, message) {
+				return
+			}
+			idle = false
+		case <-ticker.C:
+			if idle && len(pc.Messages()) == 0 && r.tryJoin(s, p, pc.HighWaterMarkOffset()) {
+				return
+			}
+			idle = true
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+//投递追赶消费读到的消息, 追上路由后加入路由, 返回是否继续追赶
+func (r *Router) catchUpMessage(s *Subscriber, p partition, message *sarama.ConsumerMessage) bool {
+	name := MQTTTopic(message)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	next, ok := s.catching[p]
+	if s.closed || !ok {
+		return false
+	}
+	if message.Offset < next {
+		return true
+	}
+	//追赶期间路由不会投递该分区的消息, 持有cmu保证与加入后的投递有序
+	if topic.Match(s.Filter, name) {
+		r.enqueue(s, message, name)
+	}
+	next = message.Offset + 1
+	s.catching[p] = next
+	st, ok := r.streams[p.topic]
+	if !ok {
+		return true
+	}
+	if position, ok := st.position(p.id); ok && next >= position {
+		s.join(p, next)
+		return false
+	}
+	return true
+}
+
+//追赶消费已经读完hwm之前的消息, hwm不早于路由的位置时加入路由
+func (r *Router) tryJoin(s *Subscriber, p partition, hwm int64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	next, ok := s.catching[p]
+	if !ok {
+		return true
+	}
+	st, ok := r.streams[p.topic]
+	if !ok {
+		return false
+	}
+	position, ok := st.position(p.id)
+	if !ok || hwm < position {
+		return false
+	}
+	if position > next {
+		next = position
+	}
+	s.join(p, next)
+	return true
+}
+
+//第一次订阅时获取kafka消费, 并开始接收元数据刷新
+func (r *Router) acquireConsumer() *kafka.Consumer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.consumer == nil {
+		r.consumer = kafka.GetConsumer()
+		kafka.Watch(r)
+	}
+	return r.consumer
+}
+
+//订阅者开始接收topics的消息, 还没有消费的topic按offsets开始消费, offsets中没有的topic从最新消息开始
+//打开消费需要访问kafka, 在锁外进行, 只在加入路由时持有锁; 期间topic被其它订阅释放时重新打开
+func (r *Router) attach(s *Subscriber, topics []string, offsets map[string]map[int32]int64) error {
+	for len(topics) > 0 {
+		r.mu.RLock()
+		var missing []string
+		for _, topic := range topics {
+			if _, ok := r.streams[topic]; !ok {
+				missing = append(missing, topic)
+			}
+		}
+		r.mu.RUnlock()
+		opened := make(map[string]*stream, len(missing))
+		for _, topic := range missing {
+			st, err := r.open(topic, offsets[topic])
+			if err != nil {
+				closeStreams(opened)
+				r.mu.Lock()
+				r.detach(s)
+				r.mu.Unlock()
+				return err
+			}
+			opened[topic] = st
+		}
+		var pending []string
+		r.mu.Lock()
+		for _, topic := range topics {
+			if !r.install(s, topic, opened) {
+				pending = append(pending, topic)
+			}
+		}
+		r.mu.Unlock()
+		//已经被其它订阅打开的topic不再需要
+		closeStreams(opened)
+		topics = pending
+	}
+	return nil
+}
+
+//从offsets中的位置打开topic的消费, 没有位置的分区从最新消息开始, 记录各分区实际开始的位置
+func (r *Router) open(topic string, offsets map[int32]int64) (*stream, error) {
+	partitions, err := r.consumer.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	start := make(map[int32]int64, len(partitions))
+	next := make(map[int32]int64, len(partitions))
+	for _, id := range partitions {
+		offset, ok := offsets[id]
+		if !ok {
+			offset = sarama.OffsetNewest
+		}
+		if offset, err = r.consumer.Offset(topic, id, offset); err != nil {
+			return nil, err
+		}
+		start[id] = offset
+		next[id] = offset
+	}
+	sub, err := r.consumer.NewSubscriber(topic, start, "", r.queueSize)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{subscriber: sub, next: next}, nil
+}
+
+//将topic的消费加入订阅者, 需要持有锁; topic还没有消费时使用opened中打开的消费
+//两者都没有时返回false, 由调用方重新打开
+func (r *Router) install(s *Subscriber, topic string, opened map[string]*stream) bool {
+	if s.closed {
+		return true
+	}
+	st, ok := r.streams[topic]
+	if !ok {
+		if st, ok = opened[topic]; !ok {
+			return false
+		}
+		delete(opened, topic)
+		logger.Info("router start consuming topic[" + topic + "]")
+		r.streams[topic] = st
+		for _, pc := range st.subscriber.PartitionConsumers() {
+			go r.dispatch(st, pc)
+		}
+	}
+	st.refs++
+	s.topics = append(s.topics, topic)
+	return true
+}
+
+//关闭没有加入路由的消费
+func closeStreams(streams map[string]*stream) {
+	for _, st := range streams {
+		go st.subscriber.Close()
+	}
+}
+
+//订阅者不再接收消息, 没有订阅者的topic停止消费
+func (r *Router) detach(s *Subscriber) {
+	for _, topic := range s.topics {
+		r.release(topic)
+	}
+	s.topics = nil
+}
+
+func (r *Router) release(topic string) {
+	st, ok := r.streams[topic]
+	if !ok {
+		return
+	}
+	st.refs--
+	if st.refs > 0 {
+		return
+	}
+	logger.Info("router stop consuming topic[" + topic + "]")
+	delete(r.streams, topic)
+	//关闭分区消费时会等待转发的goroutine退出, 不能持有锁
+	go st.subscriber.Close()
+}
+
+//按刷新的元数据消费新增的分区, 将新增的topic加入匹配的订阅, 删除的topic从订阅中移除
+//订阅之后创建的topic和分区从最早的消息开始
+//访问kafka时不持有锁, 只在更新订阅时持有锁, 不阻塞消息的转发
+func (r *Router) Refresh(topics map[string][]int32) {
+	r.mu.RLock()
+	streams := make(map[string]*stream, len(r.streams))
+	for topic, st := range r.streams {
+		streams[topic] = st
+	}
+	subscribers := make([]*Subscriber, 0, len(r.subscribers))
+	for s := range r.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	r.mu.RUnlock()
+
+	for topic, st := range streams {
+		partitions, ok := topics[topic]
+		if !ok {
+			continue
+		}
+		//已经停止的消费不会再增加分区
+		pcs, err := r.consumer.ConsumeNewPartitions(st.subscriber, partitions)
+		if err != nil {
+			logger.Error("consume new partitions of topic["+topic+"] failed: ", err)
+		}
+		for _, pc := range pcs {
+			go r.dispatch(st, pc)
+		}
+	}
+	for _, s := range subscribers {
+		found := r.refreshTopics(s, topics)
+		if len(found) == 0 {
+			continue
+		}
+		offsets := make(map[string]map[int32]int64, len(found))
+		for _, topic := range found {
+			logger.Info("topic[" + topic + "] found for subscription[" + s.Filter + "]")
+			offsets[topic] = kafka.OldestOffsets(topics[topic])
+		}
+		if err := r.attach(s, found, offsets); err != nil {
+			logger.Error("attach topics to subscription["+s.Filter+"] failed: ", err)
+		}
+	}
+}
+
+//从订阅中移除已删除的topic, 返回新增的匹配topic
+func (r *Router) refreshTopics(s *Subscriber, topics map[string][]int32) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	attached := make([]string, 0, len(s.topics))
+	for _, topic := range s.topics {
+		if _, ok := topics[topic]; ok {
+			attached = append(attached, topic)
+		} else {
+			logger.Info("topic[" + topic + "] of subscription[" + s.Filter + "] deleted")
+			r.release(topic)
+		}
+	}
+	s.topics = attached
+	var found []string
+	for topic := range topics {
+		if !s.attached(topic) && s.match(topic) {
+			found = append(found, topic)
+		}
+	}
+	return found
+}
+
+//转发分区中的消息, 分区消费关闭后退出
+func (r *Router) dispatch(st *stream, pc sarama.PartitionConsumer) {
+	for message := range pc.Messages() {
+		r.route(st, message)
+	}
+}
+
+//将消息放入所有匹配的订阅者队列
+func (r *Router) route(st *stream, message *sarama.ConsumerMessage) {
+	name := MQTTTopic(message)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	//topic已经停止消费, 或被重新打开的消费替代
+	if r.streams[message.Topic] != st {
+		return
+	}
+	//先更新位置, 之后加入路由的追赶不会重复投递这条消息
+	st.advance(message.Partition, message.Offset+1)
+	for _, s := range r.trie.match(name) {
+		if s.accept(message) {
+			r.enqueue(s, message, name)
+		}
+	}
+}
+
+//放入订阅者的队列, 队列已满时丢弃qos0消息, 不阻塞其它订阅者
+//qos1/qos2消息最多等待blockTimeout, 超时后关闭订阅, 由客户端断开连接, 持久会话重连后从确认的位置继续
+func (r *Router) enqueue(s *Subscriber, message *sarama.ConsumerMessage, name string) bool {
+	select {
+	case <-s.closing:
+		return false
+	case s.queue <- message:
+		return true
+	default:
+	}
+	if s.lossy(message) {
+		metrics.Add("router.dropped", 1)
+		logger.Warn("queue of subscription[" + s.Filter + "] is full, qos0 message of topic[" + name + "] dropped")
+		return false
+	}
+	timer := time.NewTimer(r.blockTimeout)
+	defer timer.Stop()
+	select {
+	case s.queue <- message:
+		return true
+	case <-s.closing:
+		return false
+	case <-timer.C:
+	}
+	metrics.Add("router.overflow", 1)
+	logger.Warn("queue of subscription[" + s.Filter + "] is full for " + r.blockTimeout.String() + ", closing slow subscriber")
+	s.overflowed.Set(true)
+	s.stop()
+	//转发时持有读锁, 不能在这里关闭订阅
+	go s.Close()
+	return false
+}
+
+//还原kafka消息对应的mqtt主题, 优先使用消息头中的原始主题, 否则按映射规则还原
+func MQTTTopic(message *sarama.ConsumerMessage) string {
+	if name, ok := kafka.Header(message, kafka.HeaderMQTTTopic); ok && name != "" {
+		return name
+	}
+	name, _ := mapping.GetMapper().ToMQTT(message.Topic, message.Key)
+	return name
+}
+
+//路由中的一个订阅, 有独立的有界队列, 发送较慢的订阅者不会影响其它订阅者
+type Subscriber struct {
+	Filter string
+	//订阅授予的Qos, 为0时队列已满可以丢弃消息
+	Qos int
+
+	match  func(topic string) bool
+	queue  chan *sarama.ConsumerMessage
+	router *Router
+	//接收的kafka topic
+	topics []string
+	closed bool
+	//开始关闭时关闭, 不再等待队列
+	closing  chan struct{}
+	stopOnce sync.Once
+	//是否因为发送太慢被关闭
+	overflowed common.AtomicBool
+	closeOnce  sync.Once
+
+	//持久会话提交消费位置, 非持久会话为nil
+	committer *kafka.Committer
+	//还在追赶的分区 -> 追赶到的位置
+	catching map[partition]int64
+	//已加入路由的分区 -> 开始投递的位置, 之前的消息已经由追赶投递
+	joined map[partition]int64
+	//分区 -> 追赶消费, 订阅关闭后为nil
+	catchups map[partition]*kafka.Subscriber
+	//追赶使用的kafka消费, 所有分区追赶结束后归还
+	catchConsumer *kafka.Consumer
+	catchWG       sync.WaitGroup
+	cmu           sync.Mutex
+}
+
+//路由转发的消息是否投递给订阅者, 需要持有路由的读锁
+//还在追赶的分区: 追赶已经到达这条消息时加入路由, 否则由追赶投递
+func (s *Subscriber) accept(message *sarama.ConsumerMessage) bool {
+	if s.committer == nil {
+		return true
+	}
+	p := partition{message.Topic, message.Partition}
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	if next, ok := s.catching[p]; ok {
+		if message.Offset > next {
+			return false
+		}
+		s.join(p, next)
+	}
+	return message.Offset >= s.joined[p]
+}
+
+//分区追赶结束, 之后由路由投递next开始的消息, 关闭分区的追赶消费, 需要持有cmu
+func (s *Subscriber) join(p partition, next int64) {
+	logger.Info("subscription[" + s.Filter + "] caught up topic[" + p.topic + "]")
+	delete(s.catching, p)
+	s.joined[p] = next
+	if sub, ok := s.catchups[p]; ok {
+		delete(s.catchups, p)
+		go func() {
+			sub.Close()
+			s.catchWG.Done()
+		}()
+	}
+	if len(s.catching) == 0 && s.catchConsumer != nil {
+		c := s.catchConsumer
+		s.catchConsumer = nil
+		//分区消费关闭后才能归还, 否则其它订阅可能无法消费同一分区
+		go func() {
+			s.catchWG.Wait()
+			c.Release()
+		}()
+	}
+}
+
+//发送给订阅者的消息qos为0, 队列已满时可以丢弃
+func (s *Subscriber) lossy(message *sarama.ConsumerMessage) bool {
+	if s.Qos == 0 {
+		return true
+	}
+	v, ok := kafka.Header(message, kafka.HeaderQos)
+	return ok && v == "0"
+}
+
+//停止等待队列
+func (s *Subscriber) stop() {
+	s.stopOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+//订阅开始关闭后关闭的channel
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.closing
+}
+
+//订阅是否因为qos1/qos2消息在队列中等待超时被关闭
+func (s *Subscriber) Overflowed() bool {
+	return s.overflowed.Get()
+}
+
+//是否已经接收该topic的消息
+func (s *Subscriber) attached(topic string) bool {
+	for _, t := range s.topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+//与过滤器匹配的消息, 关闭后channel被关闭
+func (s *Subscriber) Messages() <-chan *sarama.ConsumerMessage {
+	return s.queue
+}
+
+//记录消息已投递给客户端, 非持久会话不提交消费位置
+func (s *Subscriber) Deliver(message *sarama.ConsumerMessage) {
+	if s.committer != nil {
+		s.committer.Deliver(message)
+	}
+}
+
+//客户端确认了消息, 或消息不需要投递
+func (s *Subscriber) Ack(message *sarama.ConsumerMessage) {
+	if s.committer != nil {
+		s.committer.Ack(message)
+	}
+}
+
+//取消订阅, 持久会话等待追赶消费关闭并提交已确认的位置后返回, 可以重复调用
+func (s *Subscriber) Close() {
+	//先停止等待队列的转发, 避免关闭时等待转发超时
+	s.stop()
+	s.closeOnce.Do(func() {
+		r := s.router
+		r.mu.Lock()
+		s.closed = true
+		r.trie.remove(s.Filter, s)
+		delete(r.subscribers, s)
+		r.detach(s)
+		//转发时持有读锁, 关闭后不会再写入
+		close(s.queue)
+		r.mu.Unlock()
+		if s.committer == nil {
+			return
+		}
+		s.cmu.Lock()
+		catchups := s.catchups
+		c := s.catchConsumer
+		s.catchups = nil
+		s.catching = nil
+		s.catchConsumer = nil
+		s.cmu.Unlock()
+		for _, sub := range catchups {
+			sub.Close()
+			s.catchWG.Done()
+		}
+		s.catchWG.Wait()
+		if c != nil {
+			c.Release()
+		}
+		s.committer.Close()
+	})
+}
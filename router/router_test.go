@@ -0,0 +1,313 @@
+package router
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"newgateway/common"
+	"newgateway/kafka"
+	"testing"
+	"time"
+)
+
+func testMessage(mqttTopic string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic: "sensors",
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(kafka.HeaderMQTTTopic), Value: []byte(mqttTopic)},
+		},
+	}
+}
+
+//没有消费kafka topic的订阅, 只测试转发
+func subscribe(r *Router, filter string) *Subscriber {
+	s := &Subscriber{
+		Filter:  filter,
+		queue:   make(chan *sarama.ConsumerMessage, r.queueSize),
+		closing: make(chan struct{}),
+		router:  r,
+	}
+	r.trie.insert(filter, s)
+	return s
+}
+
+//转发消息, 第一次转发时创建topic的消费
+func routeMessage(r *Router, message *sarama.ConsumerMessage) {
+	st, ok := r.streams[message.Topic]
+	if !ok {
+		st = &stream{}
+		r.streams[message.Topic] = st
+	}
+	r.route(st, message)
+}
+
+func TestRoute(t *testing.T) {
+	r := NewRouter(1, time.Second)
+	slow := subscribe(r, "sensors/#")
+	other := subscribe(r, "sensors/+/humidity")
+
+	routeMessage(r, testMessage("sensors/dev1/temp"))
+	//队列已满时丢弃, 不影响其它订阅者
+	routeMessage(r, testMessage("sensors/dev1/humidity"))
+	if len(slow.queue) != 1 || MQTTTopic(<-slow.queue) != "sensors/dev1/temp" {
+		t.Fatal("expected first message to be queued for sensors/#")
+	}
+	if len(other.queue) != 1 || MQTTTopic(<-other.queue) != "sensors/dev1/humidity" {
+		t.Fatal("expected humidity message to be queued")
+	}
+
+	//关闭后不再转发, 队列被关闭
+	other.Close()
+	other.Close()
+	routeMessage(r, testMessage("sensors/dev2/humidity"))
+	if _, ok := <-other.Messages(); ok {
+		t.Fatal("expected closed subscriber queue")
+	}
+	if len(slow.queue) != 1 {
+		t.Fatal("expected message to be routed to remaining subscriber")
+	}
+}
+
+func TestRouteBackpressure(t *testing.T) {
+	r := NewRouter(1, 50*time.Millisecond)
+	s := subscribe(r, "sensors/#")
+	s.Qos = 1
+	r.subscribers[s] = struct{}{}
+	routeMessage(r, testMessage("sensors/dev1/temp"))
+
+	//qos1消息等待队列空出
+	first := make(chan *sarama.ConsumerMessage)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		first <- <-s.queue
+	}()
+	routeMessage(r, testMessage("sensors/dev2/temp"))
+	if MQTTTopic(<-first) != "sensors/dev1/temp" || MQTTTopic(<-s.queue) != "sensors/dev2/temp" {
+		t.Fatal("expected qos1 message to wait for the queue")
+	}
+
+	//以qos0发布的消息不等待
+	routeMessage(r, testMessage("sensors/dev3/temp"))
+	qos0 := testMessage("sensors/dev4/temp")
+	qos0.Headers = append(qos0.Headers, &sarama.RecordHeader{Key: []byte(kafka.HeaderQos), Value: []byte("0")})
+	start := time.Now()
+	routeMessage(r, qos0)
+	if time.Since(start) >= r.blockTimeout || s.Overflowed() {
+		t.Fatal("qos0 message should be dropped without waiting")
+	}
+
+	//等待超时后关闭订阅
+	routeMessage(r, testMessage("sensors/dev5/temp"))
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected slow subscriber to be closed")
+	}
+	if !s.Overflowed() {
+		t.Fatal("expected subscriber to be marked as overflowed")
+	}
+	for range s.Messages() {
+	}
+}
+
+func TestRefreshDeletedTopic(t *testing.T) {
+	r := NewRouter(1, time.Second)
+	s := subscribe(r, "sensors/#")
+	s.match = func(topic string) bool { return false }
+	s.topics = []string{"sensors"}
+	r.subscribers[s] = struct{}{}
+	r.streams["sensors"] = &stream{subscriber: &kafka.Subscriber{Topic: "sensors"}, refs: 1}
+
+	//删除的topic从订阅中移除, 没有订阅者后停止消费
+	r.Refresh(map[string][]int32{"other": {0}})
+	if len(s.topics) != 0 || len(r.streams) != 0 {
+		t.Fatalf("expected deleted topic to be detached, got %v %v", s.topics, r.streams)
+	}
+}
+
+//查询分区位置时返回固定位置的kafka客户端
+type offsetClient struct {
+	sarama.Client
+	offset int64
+}
+
+func (c *offsetClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	return c.offset, nil
+}
+
+//ConsumePartition阻塞到gate关闭, 用于检查访问kafka时没有持有路由的锁
+type blockingConsumer struct {
+	*mocks.Consumer
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (c *blockingConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	close(c.entered)
+	<-c.gate
+	return c.Consumer.ConsumePartition(topic, partition, offset)
+}
+
+func TestRefreshOutsideLock(t *testing.T) {
+	mc := mocks.NewConsumer(t, nil)
+	mc.SetTopicMetadata(map[string][]int32{"sensors": {0}})
+	mc.ExpectConsumePartition("sensors", 0, 7)
+	c := &blockingConsumer{Consumer: mc, entered: make(chan struct{}), gate: make(chan struct{})}
+	r := NewRouter(1, time.Second)
+	r.consumer = kafka.NewConsumerFrom(c, &offsetClient{offset: 7})
+	s := subscribe(r, "sensors/#")
+	s.match = func(topic string) bool { return topic == "sensors" }
+	r.subscribers[s] = struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		r.Refresh(map[string][]int32{"sensors": {0}})
+		close(done)
+	}()
+	<-c.entered
+	//打开新topic的消费时仍然可以转发消息
+	routed := make(chan struct{})
+	go func() {
+		r.route(&stream{}, testMessage("sensors/dev1/temp"))
+		close(routed)
+	}()
+	select {
+	case <-routed:
+	case <-time.After(time.Second):
+		t.Fatal("route blocked while refresh was consuming a new topic")
+	}
+	close(c.gate)
+	<-done
+	if !s.attached("sensors") || r.streams["sensors"] == nil {
+		t.Fatal("expected new topic to be attached")
+	}
+	if next, ok := r.streams["sensors"].position(0); !ok || next != 7 {
+		t.Fatalf("expected stream to start at the resolved offset, got %d", next)
+	}
+	r.streams["sensors"].subscriber.Close()
+}
+
+func offsetMessage(offset int64) *sarama.ConsumerMessage {
+	message := testMessage("sensors/dev1/temp")
+	message.Offset = offset
+	return message
+}
+
+//持久会话的订阅, 分区0从next开始追赶, 路由已经转发到position, 不访问kafka
+func catchingSubscriber(r *Router, next, position int64) (*Subscriber, *stream) {
+	s := subscribe(r, "sensors/#")
+	s.Qos = 1
+	s.committer = &kafka.Committer{}
+	s.catching = map[partition]int64{{"sensors", 0}: next}
+	s.joined = make(map[partition]int64)
+	s.catchups = make(map[partition]*kafka.Subscriber)
+	st := &stream{}
+	st.advance(0, position)
+	r.streams["sensors"] = st
+	return s, st
+}
+
+func queuedOffsets(s *Subscriber) []int64 {
+	var offsets []int64
+	for len(s.queue) > 0 {
+		offsets = append(offsets, (<-s.queue).Offset)
+	}
+	return offsets
+}
+
+func expectOffsets(t *testing.T, s *Subscriber, expected ...int64) {
+	offsets := queuedOffsets(s)
+	if len(offsets) != len(expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets)
+	}
+	for i := range expected {
+		if offsets[i] != expected[i] {
+			t.Fatalf("expected offsets %v, got %v", expected, offsets)
+		}
+	}
+}
+
+func TestCatchUpBehindRouter(t *testing.T) {
+	r := NewRouter(10, time.Second)
+	s, st := catchingSubscriber(r, 3, 5)
+	p := partition{"sensors", 0}
+
+	//追赶期间路由转发的消息由追赶投递
+	r.route(st, offsetMessage(5))
+	expectOffsets(t, s)
+	for _, offset := range []int64{3, 4} {
+		if !r.catchUpMessage(s, p, offsetMessage(offset)) {
+			t.Fatal("expected catch-up to continue before reaching the router")
+		}
+	}
+	//追上路由后加入, 之后的消息由路由投递
+	if r.catchUpMessage(s, p, offsetMessage(5)) {
+		t.Fatal("expected catch-up to join the router")
+	}
+	r.route(st, offsetMessage(6))
+	expectOffsets(t, s, 3, 4, 5, 6)
+	if len(s.catching) != 0 || s.joined[p] != 6 {
+		t.Fatalf("expected partition to join at 6, got %v %v", s.catching, s.joined)
+	}
+}
+
+func TestCatchUpReachedByRouter(t *testing.T) {
+	r := NewRouter(10, time.Second)
+	s, _ := catchingSubscriber(r, 3, 5)
+	p := partition{"sensors", 0}
+	//topic被重新打开, 从最早的消息开始, 还不知道路由的位置
+	st := &stream{}
+	r.streams["sensors"] = st
+	r.catchUpMessage(s, p, offsetMessage(3))
+	r.catchUpMessage(s, p, offsetMessage(4))
+
+	//路由转发到追赶的位置时加入, 追赶不再投递
+	r.route(st, offsetMessage(5))
+	if r.catchUpMessage(s, p, offsetMessage(5)) {
+		t.Fatal("expected catch-up to stop after joining")
+	}
+	r.route(st, offsetMessage(6))
+	expectOffsets(t, s, 3, 4, 5, 6)
+}
+
+func TestCatchUpIdleJoin(t *testing.T) {
+	r := NewRouter(10, time.Second)
+	s, st := catchingSubscriber(r, 3, 5)
+	p := partition{"sensors", 0}
+
+	//追赶消费还没有读到路由的位置
+	if r.tryJoin(s, p, 4) {
+		t.Fatal("expected catch-up to continue before reaching the router")
+	}
+	//3和4不存在, 读完之后加入路由
+	if !r.tryJoin(s, p, 5) || s.joined[p] != 5 {
+		t.Fatalf("expected partition to join at 5, got %v", s.joined)
+	}
+	r.route(st, offsetMessage(5))
+	expectOffsets(t, s, 5)
+}
+
+//关闭较慢的分区消费, 记录是否已关闭
+type slowPartitionConsumer struct {
+	sarama.PartitionConsumer
+	closed common.AtomicBool
+}
+
+func (pc *slowPartitionConsumer) Close() error {
+	time.Sleep(50 * time.Millisecond)
+	pc.closed.Set(true)
+	return nil
+}
+
+func TestCloseWaitsForCatchUp(t *testing.T) {
+	r := NewRouter(10, time.Second)
+	s, _ := catchingSubscriber(r, 3, 5)
+	pc := &slowPartitionConsumer{}
+	s.catchups[partition{"sensors", 0}] = &kafka.Subscriber{Topic: "sensors", PcList: []sarama.PartitionConsumer{pc}}
+	s.catchWG.Add(1)
+
+	s.Close()
+	if !pc.closed.Get() {
+		t.Fatal("catch-up should be closed before the subscription is closed")
+	}
+	s.Close()
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"newgateway/topic"
+	"strings"
+)
+
+//主题过滤器前缀树, 每一层对应主题的一个层级
+type node struct {
+	children map[string]*node
+	//在该层结束的过滤器的订阅者
+	subscribers map[*Subscriber]struct{}
+}
+
+func newNode() *node {
+	return &node{
+		children:    make(map[string]*node),
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+//添加订阅者
+func (n *node) insert(filter string, s *Subscriber) {
+	for _, level := range strings.Split(filter, topic.Separator) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.subscribers[s] = struct{}{}
+}
+
+//删除订阅者, 并删除不再有订阅者的分支
+func (n *node) remove(filter string, s *Subscriber) {
+	n.removeLevels(strings.Split(filter, topic.Separator), s)
+}
+
+func (n *node) removeLevels(levels []string, s *Subscriber) {
+	if len(levels) == 0 {
+		delete(n.subscribers, s)
+		return
+	}
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+	child.removeLevels(levels[1:], s)
+	if len(child.subscribers) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+//返回与主题名匹配的订阅者, 规则与topic.Match一致
+func (n *node) match(name string) []*Subscriber {
+	var matched []*Subscriber
+	levels := strings.Split(name, topic.Separator)
+	//以$开头的主题不会被以通配符开头的过滤器匹配
+	n.matchLevels(levels, strings.HasPrefix(name, "$"), &matched)
+	return matched
+}
+
+func (n *node) matchLevels(levels []string, noWildcard bool, matched *[]*Subscriber) {
+	if !noWildcard {
+		//#同时匹配父级本身, 例如sport/#匹配sport
+		if child, ok := n.children[topic.MultiLevelWildcard]; ok {
+			for s := range child.subscribers {
+				*matched = append(*matched, s)
+			}
+		}
+	}
+	if len(levels) == 0 {
+		for s := range n.subscribers {
+			*matched = append(*matched, s)
+		}
+		return
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.matchLevels(levels[1:], false, matched)
+	}
+	if !noWildcard {
+		if child, ok := n.children[topic.SingleLevelWildcard]; ok {
+			child.matchLevels(levels[1:], false, matched)
+		}
+	}
+}
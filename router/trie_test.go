@@ -0,0 +1,51 @@
+package router
+
+import "testing"
+
+func TestTrieMatch(t *testing.T) {
+	root := newNode()
+	filters := []string{"#", "+", "sport/#", "sport/+/player1", "sport/tennis/player1", "+/+", "$SYS/#"}
+	subs := make(map[string]*Subscriber)
+	for _, f := range filters {
+		subs[f] = &Subscriber{Filter: f}
+		root.insert(f, subs[f])
+	}
+	cases := map[string][]string{
+		"sport":                {"#", "+", "sport/#"},
+		"sport/tennis/player1": {"#", "sport/#", "sport/+/player1", "sport/tennis/player1"},
+		"sport/tennis":         {"#", "sport/#", "+/+"},
+		"$SYS/monitor":         {"$SYS/#"},
+		"a//b":                 {"#"},
+	}
+	for name, expected := range cases {
+		matched := make(map[string]bool)
+		for _, s := range root.match(name) {
+			matched[s.Filter] = true
+		}
+		if len(matched) != len(expected) {
+			t.Errorf("%q: expected %v, got %v", name, expected, matched)
+			continue
+		}
+		for _, f := range expected {
+			if !matched[f] {
+				t.Errorf("%q: expected %q to match", name, f)
+			}
+		}
+	}
+}
+
+func TestTrieRemove(t *testing.T) {
+	root := newNode()
+	a, b := &Subscriber{Filter: "a/+"}, &Subscriber{Filter: "a/+"}
+	root.insert("a/+", a)
+	root.insert("a/+", b)
+	root.remove("a/+", a)
+	if matched := root.match("a/x"); len(matched) != 1 || matched[0] != b {
+		t.Fatalf("expected only b to match, got %v", matched)
+	}
+	root.remove("a/+", b)
+	//没有订阅者的分支被删除
+	if len(root.children) != 0 {
+		t.Fatalf("expected empty trie, got %v", root.children)
+	}
+}
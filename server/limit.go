@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"newgateway/logger"
+	"newgateway/metrics"
+	"sync"
+	"sync/atomic"
+)
+
+//限制同时连接数的监听, 超过上限的新连接会被立即关闭
+type limitListener struct {
+	net.Listener
+	max    int64
+	active int64
+}
+
+func LimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		max:      int64(max),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(&l.active, 1) > l.max {
+			atomic.AddInt64(&l.active, -1)
+			logger.Warn("too many connections on ", l.Addr(), ", connection from ", conn.RemoteAddr(), " rejected")
+			metrics.Add("connections.rejected", 1)
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { atomic.AddInt64(&l.active, -1) }}, nil
+	}
+}
+
+//关闭时释放连接数
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+//被包装的原始连接
+func (c *limitConn) Underlying() net.Conn {
+	return c.Conn
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
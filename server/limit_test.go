@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := LimitListener(tcp, 1)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn := <-accepted
+
+	//超过上限的连接被立即关闭
+	second, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected second connection to be closed")
+	}
+
+	//释放后可以建立新连接
+	conn.Close()
+	third, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expected third connection to be accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"newgateway/config"
+	"os"
+)
+
+//使用客户端证书作为用户名的方式
+const (
+	CertUserNameCN  = "cn"
+	CertUserNameSAN = "san"
+)
+
+type listenerKey struct{}
+
+//在context中记录连接所属的监听配置
+func WithListener(ctx context.Context, cfg config.Listener) context.Context {
+	return context.WithValue(ctx, listenerKey{}, cfg)
+}
+
+//获取连接所属的监听配置
+func ListenerFromContext(ctx context.Context) (config.Listener, bool) {
+	cfg, ok := ctx.Value(listenerKey{}).(config.Listener)
+	return cfg, ok
+}
+
+//监听协议
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolTLS  = "tls"
+	ProtocolWS   = "ws"
+	ProtocolWSS  = "wss"
+	ProtocolUnix = "unix"
+)
+
+//按配置的协议创建监听, 配置了max-connections时限制同时连接数
+func Listen(cfg config.Listener) (net.Listener, error) {
+	var network string
+	switch cfg.Protocol {
+	case "", ProtocolTCP, ProtocolWS:
+		network = "tcp"
+	case ProtocolTLS, ProtocolWSS:
+		if cfg.TLS == nil {
+			return nil, fmt.Errorf("listener %s: protocol %s requires tls config", cfg.Address, cfg.Protocol)
+		}
+		network = "tcp"
+	case ProtocolUnix:
+		network = "unix"
+		if err := removeStaleSocket(cfg.Address); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("listener %s: invalid protocol %q", cfg.Address, cfg.Protocol)
+	}
+	listener, err := net.Listen(network, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Protocol == ProtocolTLS || cfg.Protocol == ProtocolWSS {
+		tlsConfig, err := NewTLSConfig(cfg.TLS)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if cfg.Protocol == ProtocolWS || cfg.Protocol == ProtocolWSS {
+		path := ""
+		if cfg.WebSocket != nil {
+			path = cfg.WebSocket.Path
+		}
+		listener = NewWebSocketListener(listener, path)
+	}
+	if cfg.MaxConnections > 0 {
+		listener = LimitListener(listener, cfg.MaxConnections)
+	}
+	return listener, nil
+}
+
+//删除上次进程异常退出时遗留的unix socket文件, 不是socket的文件不做处理
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	return os.Remove(path)
+}
+
+//根据配置创建tls.Config
+func NewTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	switch cfg.ClientAuth {
+	case "", "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "request":
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case "verify-if-given":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require-and-verify":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client-auth %q", cfg.ClientAuth)
+	}
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + cfg.CA)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	switch cfg.CertUserName {
+	case "", CertUserNameCN, CertUserNameSAN:
+	default:
+		return nil, fmt.Errorf("invalid cert-username %q", cfg.CertUserName)
+	}
+	return tlsConfig, nil
+}
+
+//从已校验的客户端证书中取得用户名
+//监听未配置cert-username、连接不是TLS或客户端未提供已校验的证书时返回false
+func CertUserName(ctx context.Context, conn net.Conn) (string, bool, error) {
+	cfg, ok := ListenerFromContext(ctx)
+	if !ok || (cfg.Protocol != ProtocolTLS && cfg.Protocol != ProtocolWSS) || cfg.TLS == nil || cfg.TLS.CertUserName == "" {
+		return "", false, nil
+	}
+	//取得被LimitListener包装前的连接
+	for {
+		wrapped, ok := conn.(interface {
+			Underlying() net.Conn
+		})
+		if !ok {
+			break
+		}
+		conn = wrapped.Underlying()
+	}
+	//读取证书前需要完成握手, websocket连接在升级前已完成握手
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return "", false, err
+		}
+	}
+	stater, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return "", false, nil
+	}
+	state := stater.ConnectionState()
+	//只使用经过CA校验的证书
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false, nil
+	}
+	cert := state.PeerCertificates[0]
+	switch cfg.TLS.CertUserName {
+	case CertUserNameCN:
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, true, nil
+		}
+	case CertUserNameSAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], true, nil
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], true, nil
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"newgateway/config"
+	"testing"
+	"time"
+)
+
+//生成由parent签发的证书, parent为nil时自签名
+func newCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertUserName(t *testing.T) {
+	ca, caKey, _ := newCert(t, "ca", true, nil, nil)
+	_, _, serverCert := newCert(t, "server", false, ca, caKey)
+	_, _, clientCert := newCert(t, "device-42", false, ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+		})
+		if err == nil {
+			conn.Handshake()
+			time.Sleep(100 * time.Millisecond)
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := WithListener(context.Background(), config.Listener{
+		Protocol: ProtocolTLS,
+		TLS:      &config.TLS{CertUserName: CertUserNameCN},
+	})
+	name, ok, err := CertUserName(ctx, conn)
+	if err != nil || !ok || name != "device-42" {
+		t.Fatalf("expected device-42, got %q %v %v", name, ok, err)
+	}
+
+	//未配置cert-username时不使用证书
+	name, ok, err = CertUserName(context.Background(), conn)
+	if err != nil || ok {
+		t.Fatalf("expected no cert username, got %q %v %v", name, ok, err)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"newgateway/logger"
+	"sync"
+	"time"
+)
+
+//mqtt over websocket使用的子协议, mqttv3.1兼容旧版本客户端
+var subprotocols = []string{"mqtt", "mqttv3.1"}
+
+var errListenerClosed = errors.New("websocket listener closed")
+
+//将websocket连接包装成net.Conn, 使handler可以像处理tcp连接一样处理websocket连接
+type wsListener struct {
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	conns    chan net.Conn
+	closing  chan bool
+	once     sync.Once
+}
+
+//在listener上启动http服务, 并在path上接受websocket连接
+//listener为TLS监听时即为wss
+func NewWebSocketListener(listener net.Listener, path string) net.Listener {
+	if path == "" {
+		path = "/mqtt"
+	}
+	l := &wsListener{
+		listener: listener,
+		upgrader: websocket.Upgrader{
+			Subprotocols: subprotocols,
+			//设备和浏览器面板来自不同的域, 不校验Origin
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns:   make(chan net.Conn),
+		closing: make(chan bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.handle)
+	l.server = &http.Server{Handler: mux}
+	go func() {
+		if err := l.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("websocket server err: ", err)
+		}
+	}()
+	return l
+}
+
+func (l *wsListener) handle(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("websocket upgrade failed: ", err)
+		return
+	}
+	if ws.Subprotocol() == "" {
+		logger.Warn("websocket client did not request mqtt subprotocol")
+		ws.Close()
+		return
+	}
+	conn := &wsConn{ws: ws, tlsState: r.TLS}
+	select {
+	case l.conns <- conn:
+	case <-l.closing:
+		ws.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closing:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.closing)
+	})
+	return l.server.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+//以net.Conn的方式读写websocket二进制消息
+type wsConn struct {
+	ws *websocket.Conn
+	//当前正在读取的消息
+	reader io.Reader
+	//写操作需要互斥
+	writeMu sync.Mutex
+	//wss连接的tls状态
+	tlsState *tls.ConnectionState
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, errors.New("websocket: mqtt requires binary messages")
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			//一条消息读完, 继续读取下一条
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+//wss连接的tls状态, 非wss时返回空状态
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.tlsState
+}
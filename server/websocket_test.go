@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewWebSocketListener(tcp, "/mqtt")
+	defer listener.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err := dialer.Dial("ws://"+tcp.Addr().String()+"/mqtt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//一个mqtt数据包被拆分到两条websocket消息中
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0xc0})
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0x00, 0xe0, 0x00})
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0xc0, 0x00, 0xe0, 0x00}) {
+		t.Fatalf("unexpected bytes %v", buf)
+	}
+
+	if _, err := conn.Write([]byte{0xd0, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	messageType, data, err := ws.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage || !bytes.Equal(data, []byte{0xd0, 0x00}) {
+		t.Fatalf("unexpected message %d %v %v", messageType, data, err)
+	}
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestWebSocketRequiresSubprotocol(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewWebSocketListener(tcp, "/mqtt")
+	defer listener.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+tcp.Addr().String()+"/mqtt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("expected connection without subprotocol to be closed")
+	}
+}
@@ -0,0 +1,168 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	//主题层级分隔符
+	Separator = "/"
+	//单层通配符
+	SingleLevelWildcard = "+"
+	//多层通配符
+	MultiLevelWildcard = "#"
+	//共享订阅前缀, $share/{组名}/{主题过滤器}
+	SharePrefix = "$share"
+)
+
+var (
+	ErrEmptyTopic      = errors.New("topic: empty topic")
+	ErrInvalidWildcard = errors.New("topic: invalid wildcard")
+	ErrWildcardInName  = errors.New("topic: wildcard in topic name")
+	ErrInvalidShare    = errors.New("topic: invalid shared subscription")
+)
+
+//校验主题过滤器
+//+必须占据整个层级, #必须占据整个层级且只能出现在最后一层
+//共享订阅的组名不能为空或包含通配符, 组名之后必须有主题过滤器
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return ErrEmptyTopic
+	}
+	if group, f, ok := ParseShared(filter); ok {
+		if group == "" || f == "" || strings.ContainsAny(group, SingleLevelWildcard+MultiLevelWildcard) {
+			return ErrInvalidShare
+		}
+		filter = f
+	}
+	levels := strings.Split(filter, Separator)
+	for i, level := range levels {
+		if level == SingleLevelWildcard {
+			continue
+		}
+		if level == MultiLevelWildcard {
+			if i != len(levels)-1 {
+				return ErrInvalidWildcard
+			}
+			continue
+		}
+		if strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return ErrInvalidWildcard
+		}
+	}
+	return nil
+}
+
+//校验发布时使用的主题名, 主题名中不允许出现通配符
+func ValidateName(name string) error {
+	if name == "" {
+		return ErrEmptyTopic
+	}
+	if strings.ContainsAny(name, SingleLevelWildcard+MultiLevelWildcard) {
+		return ErrWildcardInName
+	}
+	return nil
+}
+
+//解析共享订阅, 返回组名和主题过滤器, 不是共享订阅时ok为false, topicFilter为原过滤器
+func ParseShared(filter string) (group, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, SharePrefix+Separator) {
+		return "", filter, false
+	}
+	rest := filter[len(SharePrefix)+len(Separator):]
+	i := strings.Index(rest, Separator)
+	if i < 0 {
+		return rest, "", true
+	}
+	return rest[:i], rest[i+len(Separator):], true
+}
+
+//主题过滤器中是否包含通配符
+func HasWildcard(filter string) bool {
+	return strings.ContainsAny(filter, SingleLevelWildcard+MultiLevelWildcard)
+}
+
+//判断主题名是否与主题过滤器匹配
+//以$开头的主题不会被以通配符开头的过滤器匹配
+func Match(filter, name string) bool {
+	if filter == "" || name == "" {
+		return false
+	}
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, SingleLevelWildcard) || strings.HasPrefix(filter, MultiLevelWildcard)) {
+		return false
+	}
+	filterLevels := strings.Split(filter, Separator)
+	nameLevels := strings.Split(name, Separator)
+	for i, level := range filterLevels {
+		if level == MultiLevelWildcard {
+			//#同时匹配父级本身, 例如sport/#匹配sport
+			return true
+		}
+		if i >= len(nameLevels) {
+			return false
+		}
+		if level != SingleLevelWildcard && level != nameLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(nameLevels)
+}
+
+//判断两个主题过滤器是否可能匹配到同一个主题名
+func Intersects(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	aLevels := strings.Split(a, Separator)
+	bLevels := strings.Split(b, Separator)
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == MultiLevelWildcard || bLevels[i] == MultiLevelWildcard {
+			return true
+		}
+		if aLevels[i] == SingleLevelWildcard || bLevels[i] == SingleLevelWildcard {
+			continue
+		}
+		if aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	if len(aLevels) == len(bLevels) {
+		return true
+	}
+	//层级数不同时, 较长的一方多出的部分只能是#
+	if len(aLevels) > len(bLevels) {
+		return len(aLevels) == len(bLevels)+1 && aLevels[len(bLevels)] == MultiLevelWildcard
+	}
+	return len(bLevels) == len(aLevels)+1 && bLevels[len(aLevels)] == MultiLevelWildcard
+}
+
+//判断主题过滤器outer是否覆盖inner, 即所有与inner匹配的主题名都与outer匹配
+func Covers(outer, inner string) bool {
+	if outer == "" || inner == "" {
+		return false
+	}
+	outerLevels := strings.Split(outer, Separator)
+	innerLevels := strings.Split(inner, Separator)
+	for i, level := range outerLevels {
+		if level == MultiLevelWildcard {
+			return true
+		}
+		if i >= len(innerLevels) {
+			return false
+		}
+		switch innerLevels[i] {
+		case MultiLevelWildcard:
+			return false
+		case SingleLevelWildcard:
+			if level != SingleLevelWildcard {
+				return false
+			}
+		default:
+			if level != SingleLevelWildcard && level != innerLevels[i] {
+				return false
+			}
+		}
+	}
+	return len(outerLevels) == len(innerLevels)
+}
@@ -0,0 +1,108 @@
+package topic
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"sensors/+/temp", "sensors/dev42/temp", true},
+		{"sensors/+/temp", "sensors/dev42/humidity", false},
+		{"sensors/+/temp", "sensors/a/b/temp", false},
+		{"sensors/+", "sensors/", true},
+		{"fleet/#", "fleet", true},
+		{"fleet/#", "fleet/truck/1/gps", true},
+		{"fleet/#", "fleets/truck", false},
+		{"#", "a/b/c", true},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+	for _, c := range cases {
+		if Match(c.filter, c.name) != c.match {
+			t.Errorf("Match(%q, %q) expected %v", c.filter, c.name, c.match)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	valid := []string{"#", "+", "a/+/b", "a/#", "+/+/#", "/", "a//b", "$share/g/a/#", "$share/g//"}
+	for _, f := range valid {
+		if err := ValidateFilter(f); err != nil {
+			t.Errorf("%q expected valid, got %v", f, err)
+		}
+	}
+	invalid := []string{"", "a/#/b", "a#", "a/b+", "sport+", "#/a", "$share/g", "$share//a", "$share/g+/a", "$share/g/a#"}
+	for _, f := range invalid {
+		if err := ValidateFilter(f); err == nil {
+			t.Errorf("%q expected invalid", f)
+		}
+	}
+	if err := ValidateName("a/+/b"); err != ErrWildcardInName {
+		t.Errorf("expected ErrWildcardInName, got %v", err)
+	}
+}
+
+func TestParseShared(t *testing.T) {
+	cases := []struct {
+		filter, group, topicFilter string
+		ok                         bool
+	}{
+		{"$share/workers/jobs/+", "workers", "jobs/+", true},
+		{"$share/workers", "workers", "", true},
+		{"$shared/workers/jobs", "", "$shared/workers/jobs", false},
+		{"jobs/+", "", "jobs/+", false},
+	}
+	for _, c := range cases {
+		group, f, ok := ParseShared(c.filter)
+		if group != c.group || f != c.topicFilter || ok != c.ok {
+			t.Errorf("%q: got (%q, %q, %v)", c.filter, group, f, ok)
+		}
+	}
+}
+
+func TestIntersects(t *testing.T) {
+	cases := []struct {
+		a, b       string
+		intersects bool
+	}{
+		{"sensors/+/temp", "sensors/dev42/temp", true},
+		{"sensors/+/temp", "sensors/#", true},
+		{"sensors/+/temp", "+/+/humidity", false},
+		{"sensors/+/temp", "fleet/#", false},
+		{"fleet/#", "fleet", true},
+		{"a/b", "a/b/c", false},
+		{"#", "a/b", true},
+	}
+	for _, c := range cases {
+		if Intersects(c.a, c.b) != c.intersects || Intersects(c.b, c.a) != c.intersects {
+			t.Errorf("Intersects(%q, %q) expected %v", c.a, c.b, c.intersects)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	cases := []struct {
+		outer, inner string
+		covers       bool
+	}{
+		{"devices/c1/#", "devices/c1/+", true},
+		{"devices/c1/#", "devices/c1", true},
+		{"devices/+", "devices/#", false},
+		{"devices/+/temp", "devices/+/temp", true},
+		{"devices/+/temp", "devices/#", false},
+		{"devices/c1/temp", "devices/+/temp", false},
+		{"#", "a/+/#", true},
+	}
+	for _, c := range cases {
+		if Covers(c.outer, c.inner) != c.covers {
+			t.Errorf("Covers(%q, %q) expected %v", c.outer, c.inner, c.covers)
+		}
+	}
+}